@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// AdminConfig configures the admin API.
+type AdminConfig struct {
+	// Tokens maps each bearer token the admin API accepts to the name of the
+	// admin it identifies, which is recorded in the audit events of their
+	// actions.
+	Tokens map[string]string
+}
+
+// WithAdminAPI serves the admin API on the proxy's HTTP server, under /admin/.
+// Requests must carry one of the configured tokens as an
+// "Authorization: Bearer" header.
+func WithAdminAPI(cfg AdminConfig) ServerOption {
+	return func(m *MITMAuditingSSHServerWithHTTP) {
+		m.admin = cfg
+	}
+}
+
+// adminHandlerFunc handles an admin API request made by admin.
+type adminHandlerFunc func(w http.ResponseWriter, r *http.Request, admin string)
+
+// registerAdminAPI registers the admin API's handlers if any tokens are
+// configured.
+func (m *MITMAuditingSSHServerWithHTTP) registerAdminAPI(mux *http.ServeMux) {
+	if len(m.admin.Tokens) == 0 {
+		return
+	}
+	mux.Handle("GET /admin/sessions", m.adminHandler(m.handleListSessions))
+	mux.Handle("GET /admin/sessions/{id}", m.adminHandler(m.handleGetSession))
+	mux.Handle("POST /admin/sessions/{id}/terminate", m.adminHandler(m.handleTerminateSession))
+	mux.Handle("POST /admin/sessions/{id}/pause", m.adminHandler(m.handlePauseSession))
+	mux.Handle("POST /admin/sessions/{id}/resume", m.adminHandler(m.handleResumeSession))
+	mux.Handle("POST /admin/sessions/{id}/approve", m.adminHandler(m.handleApproveCommand))
+	mux.Handle("POST /admin/sessions/{id}/reject", m.adminHandler(m.handleRejectCommand))
+	mux.Handle("GET /admin/sessions/{id}/shadow", m.adminHandler(m.handleShadowSession))
+	mux.Handle("GET /admin/sessions/{id}/control", m.adminHandler(m.handleControlSession))
+}
+
+// adminHandler authenticates requests before passing them on to h.
+func (m *MITMAuditingSSHServerWithHTTP) adminHandler(h adminHandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := m.authenticateAdmin(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ssh-proxy admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r, admin)
+	})
+}
+
+// authenticateAdmin returns the admin identified by the request's bearer token.
+func (m *MITMAuditingSSHServerWithHTTP) authenticateAdmin(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	// Every token is compared, so the time taken does not tell which of
+	// them a guess came closest to.
+	var admin string
+	for candidate, name := range m.admin.Tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			admin = name
+		}
+	}
+	return admin, admin != ""
+}
+
+func (m *MITMAuditingSSHServerWithHTTP) handleListSessions(w http.ResponseWriter, r *http.Request, admin string) {
+	writeJSON(w, http.StatusOK, m.sessions.list())
+}
+
+func (m *MITMAuditingSSHServerWithHTTP) handleGetSession(w http.ResponseWriter, r *http.Request, admin string) {
+	live := m.sessions.get(r.PathValue("id"))
+	if live == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, live.info())
+}
+
+// sessionActionRequest is the body of a request to terminate, pause or resume
+// a session, or approve or reject its command, which may be empty.
+type sessionActionRequest struct {
+	// Reason is shown to the user and recorded in the audit event.
+	Reason string `json:"reason"`
+}
+
+// sessionAction decodes the request to act on a session and returns the
+// session. If it fails, an error response has been written.
+func (m *MITMAuditingSSHServerWithHTTP) sessionAction(w http.ResponseWriter, r *http.Request) (*liveSession, sessionActionRequest, bool) {
+	var req sessionActionRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return nil, req, false
+	}
+	live := m.sessions.get(r.PathValue("id"))
+	if live == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, req, false
+	}
+	return live, req, true
+}
+
+func (m *MITMAuditingSSHServerWithHTTP) handleTerminateSession(w http.ResponseWriter, r *http.Request, admin string) {
+	live, req, ok := m.sessionAction(w, r)
+	if !ok {
+		return
+	}
+	if !live.terminate(admin, req.Reason) {
+		http.Error(w, "Session already terminated", http.StatusConflict)
+		return
+	}
+	zapctx.Info(r.Context(), "session terminated by admin",
+		zap.String("session", live.id),
+		zap.String("admin", admin),
+		zap.String("reason", req.Reason),
+	)
+	writeJSON(w, http.StatusOK, live.info())
+}
+
+func (m *MITMAuditingSSHServerWithHTTP) handlePauseSession(w http.ResponseWriter, r *http.Request, admin string) {
+	live, req, ok := m.sessionAction(w, r)
+	if !ok {
+		return
+	}
+	if err := live.pause(admin, req.Reason); err != nil {
+		http.Error(w, "Cannot pause session: "+err.Error(), http.StatusConflict)
+		return
+	}
+	zapctx.Info(r.Context(), "session paused by admin",
+		zap.String("session", live.id),
+		zap.String("admin", admin),
+		zap.String("reason", req.Reason),
+	)
+	writeJSON(w, http.StatusOK, live.info())
+}
+
+func (m *MITMAuditingSSHServerWithHTTP) handleResumeSession(w http.ResponseWriter, r *http.Request, admin string) {
+	live, req, ok := m.sessionAction(w, r)
+	if !ok {
+		return
+	}
+	if err := live.resume(admin, req.Reason); err != nil {
+		http.Error(w, "Cannot resume session: "+err.Error(), http.StatusConflict)
+		return
+	}
+	zapctx.Info(r.Context(), "session resumed by admin",
+		zap.String("session", live.id),
+		zap.String("admin", admin),
+		zap.String("reason", req.Reason),
+	)
+	writeJSON(w, http.StatusOK, live.info())
+}
+
+func (m *MITMAuditingSSHServerWithHTTP) handleApproveCommand(w http.ResponseWriter, r *http.Request, admin string) {
+	m.decideCommand(w, r, admin, true)
+}
+
+func (m *MITMAuditingSSHServerWithHTTP) handleRejectCommand(w http.ResponseWriter, r *http.Request, admin string) {
+	m.decideCommand(w, r, admin, false)
+}
+
+// decideCommand approves or rejects the command a session is waiting on
+// approval of.
+func (m *MITMAuditingSSHServerWithHTTP) decideCommand(w http.ResponseWriter, r *http.Request, admin string, approved bool) {
+	live, req, ok := m.sessionAction(w, r)
+	if !ok {
+		return
+	}
+	info := live.info()
+	if err := live.decideApproval(admin, approved, req.Reason); err != nil {
+		http.Error(w, "Cannot decide on command: "+err.Error(), http.StatusConflict)
+		return
+	}
+	zapctx.Info(r.Context(), "command approval decided by admin",
+		zap.String("session", live.id),
+		zap.String("admin", admin),
+		zap.Bool("approved", approved),
+		zap.String("reason", req.Reason),
+	)
+	writeJSON(w, http.StatusOK, info)
+}
+
+// writeJSON writes v as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zapctx.Error(context.TODO(), "failed to write response", zap.Error(err))
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gliderssh "github.com/gliderlabs/ssh"
+)
+
+// testAdmins are the admin API tokens of test proxies, and the admins they
+// identify.
+var testAdmins = AdminConfig{Tokens: map[string]string{"alice-token": "alice", "bob-token": "bob"}}
+
+// adminRequest makes an admin API request with token, returning the response
+// and its body.
+func adminRequest(t *testing.T, p *testProxy, method, path, token, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, p.http.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// eventData returns the data of type T of the events handed to s so far.
+func eventData[T EventData](s *testSink) []T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var data []T
+	for _, e := range s.events {
+		if d, ok := e.Data.(T); ok {
+			data = append(data, d)
+		}
+	}
+	return data
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "no credentials", wantStatus: http.StatusUnauthorized},
+		{name: "basic credentials", authorization: "Basic YWxpY2UtdG9rZW4=", wantStatus: http.StatusUnauthorized},
+		{name: "empty token", authorization: "Bearer ", wantStatus: http.StatusUnauthorized},
+		{name: "unknown token", authorization: "Bearer mallory-token", wantStatus: http.StatusUnauthorized},
+		{name: "token prefix", authorization: "Bearer alice", wantStatus: http.StatusUnauthorized},
+		{name: "valid token", authorization: "Bearer alice-token", wantStatus: http.StatusOK},
+		{name: "another valid token", authorization: "Bearer bob-token", wantStatus: http.StatusOK},
+	}
+	p := newTestProxy(t, &testSink{}, echoTarget, WithAdminAPI(testAdmins))
+	defer p.close()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, p.http.URL+"/admin/sessions", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("status %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+			if test.wantStatus == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAdminAPIDisabled(t *testing.T) {
+	p := newTestProxy(t, &testSink{}, echoTarget)
+	defer p.close()
+	if resp, _ := adminRequest(t, p, http.MethodGet, "/admin/sessions", "alice-token", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d without tokens configured, want 404", resp.StatusCode)
+	}
+}
+
+func TestAdminListSessions(t *testing.T) {
+	p := newTestProxy(t, &testSink{}, echoTarget, WithAdminAPI(testAdmins))
+	defer p.close()
+
+	var sessions []SessionInfo
+	_, body := adminRequest(t, p, http.MethodGet, "/admin/sessions", "alice-token", "")
+	if err := json.Unmarshal([]byte(body), &sessions); err != nil || len(sessions) != 0 {
+		t.Fatalf("sessions = %s, %v, want none", body, err)
+	}
+
+	client := p.dial(t)
+	defer client.Close()
+	_, stdin, out := startShell(t, client)
+	io.WriteString(stdin, "hello\r")
+	waitFor(t, func() bool { return strings.Contains(out.String(), "hello") })
+
+	_, body = adminRequest(t, p, http.MethodGet, "/admin/sessions", "alice-token", "")
+	if err := json.Unmarshal([]byte(body), &sessions); err != nil || len(sessions) != 1 {
+		t.Fatalf("sessions = %s, %v, want one", body, err)
+	}
+	info := sessions[0]
+	if info.Type != "pty" || info.Session.User != "test" || info.Started.IsZero() {
+		t.Errorf("session = %+v, want a pty session of test", info)
+	}
+	if info.Pty == nil || *info.Pty != (SessionPty{Term: "xterm", Width: 80, Height: 24}) {
+		t.Errorf("pty = %+v, want xterm 80x24", info.Pty)
+	}
+	if info.BytesIn != uint64(len("hello\r")) || info.BytesOut < info.BytesIn {
+		t.Errorf("relayed %d bytes in and %d out, want %d in echoed", info.BytesIn, info.BytesOut, len("hello\r"))
+	}
+
+	resp, body := adminRequest(t, p, http.MethodGet, "/admin/sessions/"+info.ID, "alice-token", "")
+	var got SessionInfo
+	if err := json.Unmarshal([]byte(body), &got); resp.StatusCode != http.StatusOK || err != nil || got.ID != info.ID {
+		t.Errorf("GET session = %d %s, want session %s", resp.StatusCode, body, info.ID)
+	}
+	if resp, _ := adminRequest(t, p, http.MethodGet, "/admin/sessions/unknown", "alice-token", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET unknown session = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAdminTerminateSession(t *testing.T) {
+	tests := []struct {
+		name string
+		// id is the session to terminate, the user's when empty.
+		id         string
+		body       string
+		wantStatus int
+		// wantNotice is shown to the user when the session is terminated,
+		// and wantReason audited.
+		wantNotice string
+		wantReason string
+	}{{
+		name:       "with a reason",
+		body:       `{"reason": "maintenance"}`,
+		wantStatus: http.StatusOK,
+		wantNotice: "*** Session terminated by an administrator: maintenance ***",
+		wantReason: "maintenance",
+	}, {
+		name:       "without a body",
+		wantStatus: http.StatusOK,
+		wantNotice: "*** Session terminated by an administrator ***",
+	}, {
+		name:       "unknown session",
+		id:         "unknown",
+		wantStatus: http.StatusNotFound,
+	}, {
+		name:       "invalid body",
+		body:       `{"reason": `,
+		wantStatus: http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &testSink{}
+			p := newTestProxy(t, sink, echoTarget, WithAdminAPI(testAdmins))
+			defer p.close()
+			client := p.dial(t)
+			defer client.Close()
+			sess, _, out := startShell(t, client)
+			waitFor(t, func() bool { return len(p.mitm.sessions.list()) == 1 })
+
+			id := test.id
+			if id == "" {
+				id = p.mitm.sessions.list()[0].ID
+			}
+			resp, body := adminRequest(t, p, http.MethodPost, "/admin/sessions/"+id+"/terminate", "alice-token", test.body)
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("terminate = %d %s, want %d", resp.StatusCode, body, test.wantStatus)
+			}
+			if test.wantStatus != http.StatusOK {
+				if len(p.mitm.sessions.list()) != 1 {
+					t.Error("session ended, want it left running")
+				}
+				return
+			}
+
+			var info SessionInfo
+			if err := json.Unmarshal([]byte(body), &info); err != nil || !info.Terminated {
+				t.Errorf("terminate = %s, %v, want the terminated session", body, err)
+			}
+			// Terminating a session ends it and its client's session.
+			sess.Wait()
+			waitFor(t, func() bool { return len(p.mitm.sessions.list()) == 0 })
+			if !strings.Contains(out.String(), test.wantNotice) {
+				t.Errorf("user shown %q, want %q", out.String(), test.wantNotice)
+			}
+			waitFor(t, func() bool { return len(eventData[TerminateEvent](sink)) == 1 })
+			if got := eventData[TerminateEvent](sink)[0]; got != (TerminateEvent{Admin: "alice", Reason: test.wantReason}) {
+				t.Errorf("audited %+v, want termination by alice for %q", got, test.wantReason)
+			}
+
+			// A terminated session is gone.
+			if resp, _ := adminRequest(t, p, http.MethodPost, "/admin/sessions/"+id+"/terminate", "bob-token", ""); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("terminating again = %d, want 404", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestLiveSessionTerminateTwice(t *testing.T) {
+	sink := &testSink{}
+	p := newTestProxy(t, sink, echoTarget)
+	defer p.close()
+	client := p.dial(t)
+	defer client.Close()
+	startShell(t, client)
+	waitFor(t, func() bool { return len(p.mitm.sessions.list()) == 1 })
+	live := p.mitm.sessions.get(p.mitm.sessions.list()[0].ID)
+
+	if !live.terminate("alice", "") {
+		t.Fatal("terminate() = false, want true")
+	}
+	if live.terminate("bob", "") {
+		t.Error("terminating again = true, want false")
+	}
+	if !live.info().Terminated {
+		t.Error("session not listed as terminated")
+	}
+}
+
+// recordingSession is a target's session recording the input it reads.
+type recordingSession struct {
+	gliderssh.Session
+	received io.Writer
+}
+
+func (s recordingSession) Read(p []byte) (int, error) {
+	n, err := s.Session.Read(p)
+	s.received.Write(p[:n])
+	return n, err
+}
+
+func TestAdminPauseSession(t *testing.T) {
+	tests := []struct {
+		name string
+		// end ends the paused session, by resuming or terminating it.
+		end string
+		// wantRelayed is whether the input held while paused reaches the
+		// target once the session is no longer paused.
+		wantRelayed bool
+	}{
+		{name: "resumed", end: "resume", wantRelayed: true},
+		{name: "terminated", end: "terminate", wantRelayed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink, received := &testSink{}, &lockedBuffer{}
+			target := func(s gliderssh.Session) {
+				echoTarget(recordingSession{Session: s, received: received})
+			}
+			p := newTestProxy(t, sink, target, WithAdminAPI(testAdmins))
+			defer p.close()
+			shell := startWatchedShell(t, p)
+			path := "/admin/sessions/" + shell.id
+
+			if resp, body := adminRequest(t, p, http.MethodPost, path+"/resume", "alice-token", ""); resp.StatusCode != http.StatusConflict {
+				t.Errorf("resume before pausing = %d %q, want 409", resp.StatusCode, body)
+			}
+			resp, body := adminRequest(t, p, http.MethodPost, path+"/pause", "alice-token", `{"reason": "review"}`)
+			var info SessionInfo
+			if err := json.Unmarshal([]byte(body), &info); resp.StatusCode != http.StatusOK || err != nil || !info.Paused {
+				t.Fatalf("pause = %d %s, want the paused session", resp.StatusCode, body)
+			}
+			if resp, body := adminRequest(t, p, http.MethodPost, path+"/pause", "bob-token", ""); resp.StatusCode != http.StatusConflict {
+				t.Errorf("pausing again = %d %q, want 409", resp.StatusCode, body)
+			}
+			waitFor(t, func() bool {
+				return strings.Contains(shell.out.String(), "*** Session paused by an administrator, your input and its output are held: review ***")
+			})
+
+			// Input typed while paused is held.
+			io.WriteString(shell.stdin, "held\r")
+			time.Sleep(50 * time.Millisecond)
+			if strings.Contains(shell.out.String(), "held\r") {
+				t.Fatalf("input relayed while paused: %q", shell.out.String())
+			}
+
+			if resp, body := adminRequest(t, p, http.MethodPost, path+"/"+test.end, "bob-token", ""); resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s = %d %q, want 200", test.end, resp.StatusCode, body)
+			}
+			if test.wantRelayed {
+				waitFor(t, func() bool { return strings.Contains(shell.out.String(), "held\r") })
+				if !strings.Contains(shell.out.String(), "*** Session resumed by an administrator ***") {
+					t.Errorf("user shown %q, want told of resuming", shell.out.String())
+				}
+				shell.exit()
+			} else {
+				shell.sess.Wait()
+				shell.client.Close()
+			}
+			waitFor(t, func() bool {
+				types := sink.types()
+				return len(types) > 0 && types[len(types)-1] == EventDisconnect
+			})
+
+			if got := eventData[PauseEvent](sink); len(got) != 1 || got[0] != (PauseEvent{Admin: "alice", Reason: "review"}) {
+				t.Errorf("pause events %+v, want alice's", got)
+			}
+			wantResumes := 0
+			if test.end == "resume" {
+				wantResumes = 1
+			}
+			if got := eventData[ResumeEvent](sink); len(got) != wantResumes {
+				t.Errorf("resume events %+v, want %d", got, wantResumes)
+			}
+			if relayed := strings.Contains(received.String(), "held"); relayed != test.wantRelayed {
+				t.Errorf("held input relayed %v, want %v", relayed, test.wantRelayed)
+			}
+		})
+	}
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventVersion is the version of the audit event schema, it is incremented
+// whenever an event's fields change. Version 2 added the session's target.
+const EventVersion = 2
+
+// EventType identifies the kind of an audit event.
+type EventType string
+
+const (
+	// EventConnect is the client's SSH connection being established.
+	EventConnect EventType = "connect"
+	// EventAuth is the client authenticating to the proxy.
+	EventAuth EventType = "auth"
+	// EventPtyRequest is the client requesting a PTY.
+	EventPtyRequest EventType = "pty_request"
+	// EventWindowChange is the client's terminal being resized.
+	EventWindowChange EventType = "window_change"
+	// EventShell is the client starting an interactive shell.
+	EventShell EventType = "shell"
+	// EventExec is the client executing a single command.
+	EventExec EventType = "exec"
+	// EventSubsystem is the client requesting a subsystem, such as sftp.
+	EventSubsystem EventType = "subsystem"
+	// EventPortForward is the client requesting port forwarding.
+	EventPortForward EventType = "port_forward"
+	// EventInput is input sent by the client within a PTY session.
+	EventInput EventType = "input"
+	// EventCommand is a command line submitted within a PTY session, as
+	// reconstructed from the client's input.
+	EventCommand EventType = "command"
+	// EventOutput is output written by the target.
+	EventOutput EventType = "output"
+	// EventShellCommand is a command reported by the target shell's
+	// integration markers.
+	EventShellCommand EventType = "shell_command"
+	// EventExitStatus is the target session exiting.
+	EventExitStatus EventType = "exit_status"
+	// EventDisconnect is the client's SSH connection closing.
+	EventDisconnect EventType = "disconnect"
+	// EventTerminate is an admin terminating the session.
+	EventTerminate EventType = "terminate"
+	// EventShadow is an admin starting or stopping watching the session, or
+	// taking or releasing control of it.
+	EventShadow EventType = "shadow"
+	// EventAdminInput is input sent by an admin in control of a PTY session.
+	EventAdminInput EventType = "admin_input"
+	// EventPause is an admin pausing the session, holding its input and
+	// output.
+	EventPause EventType = "pause"
+	// EventResume is an admin resuming a paused session.
+	EventResume EventType = "resume"
+	// EventCommandPolicy is the command policy deciding whether a command may
+	// run, or an admin approving or rejecting a command requiring approval.
+	EventCommandPolicy EventType = "command_policy"
+	// EventCheckpoint is a signed checkpoint of a HashChainSink's chain,
+	// which belongs to no session.
+	EventCheckpoint EventType = "checkpoint"
+)
+
+// Event is a single audit event. Every event of an SSH connection carries the
+// same SessionID and a Sequence number one greater than the event before it.
+type Event struct {
+	// Version is the EventVersion the event was created with.
+	Version int `json:"version"`
+
+	// Sequence is the event's position within its session, starting at 1.
+	Sequence uint64 `json:"seq"`
+
+	// Type is the type of Data.
+	Type EventType `json:"type"`
+
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+
+	// Session is the details of the session the event belongs to.
+	Session SessionDetails `json:"session"`
+
+	// Data holds the event's type specific fields.
+	Data EventData `json:"data"`
+
+	// GlobalSequence, SessionPrevHash, PrevHash and Hash are set by a
+	// HashChainSink, chaining each event to the one before it in its session
+	// and in the sink's stream of events.
+	GlobalSequence  uint64 `json:"global_seq,omitempty"`
+	SessionPrevHash string `json:"session_prev_hash,omitempty"`
+	PrevHash        string `json:"prev_hash,omitempty"`
+	// Hash must remain the last field, see HashChainSink.
+	Hash string `json:"hash,omitempty"`
+}
+
+// EventData is the type specific part of an Event.
+type EventData interface {
+	// EventType returns the type of event the data belongs to.
+	EventType() EventType
+}
+
+// ConnectEvent is the data of an EventConnect.
+type ConnectEvent struct {
+	ClientAddr    string `json:"client_addr"`
+	ClientVersion string `json:"client_version"`
+}
+
+// AuthEvent is the data of an EventAuth.
+type AuthEvent struct {
+	User string `json:"user"`
+	// Method is the SSH authentication method used, "none" when the client
+	// was authenticated by the HTTP CONNECT request alone.
+	Method  string `json:"method"`
+	Success bool   `json:"success"`
+}
+
+// PtyRequestEvent is the data of an EventPtyRequest.
+type PtyRequestEvent struct {
+	Term   string `json:"term"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// WindowChangeEvent is the data of an EventWindowChange.
+type WindowChangeEvent struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ShellEvent is the data of an EventShell.
+type ShellEvent struct{}
+
+// ExecEvent is the data of an EventExec.
+type ExecEvent struct {
+	Command []string `json:"command"`
+}
+
+// SubsystemEvent is the data of an EventSubsystem.
+type SubsystemEvent struct {
+	Name     string `json:"name"`
+	Accepted bool   `json:"accepted"`
+}
+
+// PortForwardEvent is the data of an EventPortForward.
+type PortForwardEvent struct {
+	// Direction is "local" for direct-tcpip channels and "remote" for
+	// tcpip-forward requests.
+	Direction string `json:"direction"`
+	Host      string `json:"host"`
+	Port      uint32 `json:"port"`
+	Accepted  bool   `json:"accepted"`
+}
+
+// InputEvent is the data of an EventInput.
+type InputEvent struct {
+	Data string `json:"data"`
+}
+
+// CommandEvent is the data of an EventCommand.
+type CommandEvent struct {
+	Command   string `json:"command"`
+	Uncertain bool   `json:"uncertain"`
+}
+
+// OutputEvent is the data of an EventOutput.
+type OutputEvent struct {
+	Stream OutputStream `json:"stream"`
+	Data   string       `json:"data"`
+	// Relayed is when the proxy relayed the output to the client, which may
+	// be before the event was emitted.
+	Relayed   time.Time `json:"relayed"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Sampled   bool      `json:"sampled,omitempty"`
+	Dropped   int       `json:"dropped,omitempty"`
+}
+
+// ShellCommandEvent is the data of an EventShellCommand.
+type ShellCommandEvent struct {
+	Command          string        `json:"command"`
+	WorkingDirectory string        `json:"working_directory,omitempty"`
+	ExitCode         *int          `json:"exit_code,omitempty"`
+	Started          time.Time     `json:"started"`
+	Duration         time.Duration `json:"duration"`
+}
+
+// ExitStatusEvent is the data of an EventExitStatus.
+type ExitStatusEvent struct {
+	ExitCode int `json:"exit_code"`
+	// Signal is the signal the target's process was killed by, if any.
+	Signal string `json:"signal,omitempty"`
+}
+
+// DisconnectEvent is the data of an EventDisconnect.
+type DisconnectEvent struct {
+	Duration time.Duration `json:"duration"`
+}
+
+// TerminateEvent is the data of an EventTerminate.
+type TerminateEvent struct {
+	// Admin is the name of the admin who terminated the session.
+	Admin  string `json:"admin"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ShadowAction is what an admin did to a session, in an EventShadow.
+type ShadowAction string
+
+const (
+	// ShadowAttach is an admin starting watching the session.
+	ShadowAttach ShadowAction = "attach"
+	// ShadowDetach is an admin stopping watching the session.
+	ShadowDetach ShadowAction = "detach"
+	// ShadowTakeControl is a watching admin taking control of the session,
+	// their input being sent alongside the user's.
+	ShadowTakeControl ShadowAction = "take_control"
+	// ShadowReleaseControl is an admin releasing control of the session.
+	ShadowReleaseControl ShadowAction = "release_control"
+)
+
+// ShadowEvent is the data of an EventShadow.
+type ShadowEvent struct {
+	// Admin is the name of the admin watching the session.
+	Admin  string       `json:"admin"`
+	Action ShadowAction `json:"action"`
+	// Reason is why the admin was detached or lost control, if they did
+	// not detach themselves.
+	Reason string `json:"reason,omitempty"`
+}
+
+// AdminInputEvent is the data of an EventAdminInput. Input is audited a line
+// at a time, with secrets redacted.
+type AdminInputEvent struct {
+	// Admin is the name of the admin who sent the input.
+	Admin string `json:"admin"`
+	Data  string `json:"data"`
+}
+
+// PauseEvent is the data of an EventPause.
+type PauseEvent struct {
+	// Admin is the name of the admin who paused the session.
+	Admin  string `json:"admin"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ResumeEvent is the data of an EventResume.
+type ResumeEvent struct {
+	// Admin is the name of the admin who resumed the session.
+	Admin  string `json:"admin"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// CommandPolicyEvent is the data of an EventCommandPolicy.
+type CommandPolicyEvent struct {
+	Command string       `json:"command"`
+	Action  PolicyAction `json:"action"`
+	// Rule is the name of the policy rule which decided the action, empty
+	// for the policy's default.
+	Rule string `json:"rule,omitempty"`
+	// Admin is the admin who approved or rejected a command requiring
+	// approval, and Reason why, or why it was rejected without them.
+	Admin  string `json:"admin,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// CheckpointEvent is the data of an EventCheckpoint.
+type CheckpointEvent struct {
+	// KeyID identifies the key the checkpoint was signed with.
+	KeyID string `json:"key_id"`
+	// Signature is the base64 ed25519 signature of checkpointMessage for the
+	// checkpoint's GlobalSequence and PrevHash.
+	Signature string `json:"signature"`
+}
+
+func (ConnectEvent) EventType() EventType       { return EventConnect }
+func (AuthEvent) EventType() EventType          { return EventAuth }
+func (PtyRequestEvent) EventType() EventType    { return EventPtyRequest }
+func (WindowChangeEvent) EventType() EventType  { return EventWindowChange }
+func (ShellEvent) EventType() EventType         { return EventShell }
+func (ExecEvent) EventType() EventType          { return EventExec }
+func (SubsystemEvent) EventType() EventType     { return EventSubsystem }
+func (PortForwardEvent) EventType() EventType   { return EventPortForward }
+func (InputEvent) EventType() EventType         { return EventInput }
+func (CommandEvent) EventType() EventType       { return EventCommand }
+func (OutputEvent) EventType() EventType        { return EventOutput }
+func (ShellCommandEvent) EventType() EventType  { return EventShellCommand }
+func (ExitStatusEvent) EventType() EventType    { return EventExitStatus }
+func (DisconnectEvent) EventType() EventType    { return EventDisconnect }
+func (TerminateEvent) EventType() EventType     { return EventTerminate }
+func (ShadowEvent) EventType() EventType        { return EventShadow }
+func (AdminInputEvent) EventType() EventType    { return EventAdminInput }
+func (PauseEvent) EventType() EventType         { return EventPause }
+func (ResumeEvent) EventType() EventType        { return EventResume }
+func (CommandPolicyEvent) EventType() EventType { return EventCommandPolicy }
+func (CheckpointEvent) EventType() EventType    { return EventCheckpoint }
+
+// eventDataDecoders decode the data of each type of event from JSON.
+var eventDataDecoders = map[EventType]func([]byte) (EventData, error){
+	EventConnect:       decodeEventData[ConnectEvent],
+	EventAuth:          decodeEventData[AuthEvent],
+	EventPtyRequest:    decodeEventData[PtyRequestEvent],
+	EventWindowChange:  decodeEventData[WindowChangeEvent],
+	EventShell:         decodeEventData[ShellEvent],
+	EventExec:          decodeEventData[ExecEvent],
+	EventSubsystem:     decodeEventData[SubsystemEvent],
+	EventPortForward:   decodeEventData[PortForwardEvent],
+	EventInput:         decodeEventData[InputEvent],
+	EventCommand:       decodeEventData[CommandEvent],
+	EventOutput:        decodeEventData[OutputEvent],
+	EventShellCommand:  decodeEventData[ShellCommandEvent],
+	EventExitStatus:    decodeEventData[ExitStatusEvent],
+	EventDisconnect:    decodeEventData[DisconnectEvent],
+	EventTerminate:     decodeEventData[TerminateEvent],
+	EventShadow:        decodeEventData[ShadowEvent],
+	EventAdminInput:    decodeEventData[AdminInputEvent],
+	EventPause:         decodeEventData[PauseEvent],
+	EventResume:        decodeEventData[ResumeEvent],
+	EventCommandPolicy: decodeEventData[CommandPolicyEvent],
+	EventCheckpoint:    decodeEventData[CheckpointEvent],
+}
+
+func decodeEventData[T EventData](b []byte) (EventData, error) {
+	var data T
+	err := json.Unmarshal(b, &data)
+	return data, err
+}
+
+// UnmarshalJSON implements json.Unmarshaler, decoding Data into the type
+// named by Type.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	type event Event
+	var raw struct {
+		event
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	decode, ok := eventDataDecoders[raw.Type]
+	if !ok {
+		return fmt.Errorf("unknown event type %q", raw.Type)
+	}
+	data, err := decode(raw.Data)
+	if err != nil {
+		return fmt.Errorf("invalid %s event data: %w", raw.Type, err)
+	}
+	*e = Event(raw.event)
+	e.Data = data
+	return nil
+}
+
+// EventSink receives the audit events of every session.
+type EventSink interface {
+	// HandleEvent is called with each event. Events of a single session are
+	// handed over one at a time in Sequence order, but events of different
+	// sessions may be handed over concurrently.
+	HandleEvent(e Event)
+}
+
+// EventDeliverer may optionally be implemented by an EventSink able to report
+// whether events were delivered, so a Spool can retry them until they are.
+type EventDeliverer interface {
+	// DeliverEvents delivers events in order, returning an error if any of
+	// them may not have been delivered.
+	DeliverEvents(events []Event) error
+}
+
+// SessionAdmitter may optionally be implemented by an EventSink to refuse new
+// sessions while it cannot audit them.
+type SessionAdmitter interface {
+	// AdmitSession returns an error if a new session must be refused.
+	AdmitSession() error
+}
+
+// SinkWrapper may optionally be implemented by an EventSink passing events on
+// to another sink, such as a HashChainSink, so the admission and health of the
+// sink it wraps are not hidden behind it.
+type SinkWrapper interface {
+	// Unwrap returns the sink events are passed on to, or nil if none.
+	Unwrap() EventSink
+}
+
+// findSink returns sink, or the first sink it wraps, implementing T. A sink
+// implementing T answers for the sinks it wraps.
+func findSink[T any](sink EventSink) (T, bool) {
+	for sink != nil {
+		if t, ok := sink.(T); ok {
+			return t, true
+		}
+		wrapper, ok := sink.(SinkWrapper)
+		if !ok {
+			break
+		}
+		sink = wrapper.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// admitSession returns an error if sink, or the first sink it wraps admitting
+// sessions, refuses a new session.
+func admitSession(sink EventSink) error {
+	if admitter, ok := findSink[SessionAdmitter](sink); ok {
+		return admitter.AdmitSession()
+	}
+	return nil
+}
+
+// auditQueueSize is the number of events queued for the sink per connection.
+const auditQueueSize = 1024
+
+// sessionAudit emits the audit events of a single SSH connection, numbering
+// them in the order they are handed to the sink.
+//
+// Events are handed to the sink from a bounded queue by the connection's own
+// goroutine, so a slow sink only holds up whoever emits an event once the
+// queue is full.
+type sessionAudit struct {
+	sink   EventSink
+	queued func(delta int)
+	start  time.Time
+	done   chan struct{}
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	queue        []Event
+	seq          uint64
+	connected    bool
+	disconnected bool
+	details      SessionDetails
+}
+
+// newSessionAudit returns a sessionAudit handing events to sink, calling
+// queued with the change in the number of events queued.
+func newSessionAudit(sink EventSink, queued func(delta int)) *sessionAudit {
+	a := &sessionAudit{
+		sink:   sink,
+		queued: queued,
+		start:  time.Now(),
+		done:   make(chan struct{}),
+	}
+	a.cond = sync.NewCond(&a.mu)
+	go a.run()
+	return a
+}
+
+// run hands queued events to the sink until the connection has disconnected
+// and every event has been handed over.
+func (a *sessionAudit) run() {
+	defer close(a.done)
+	a.mu.Lock()
+	for {
+		for len(a.queue) == 0 && !a.disconnected {
+			a.cond.Wait()
+		}
+		if len(a.queue) == 0 {
+			a.mu.Unlock()
+			return
+		}
+		e := a.queue[0]
+		a.queue[0] = Event{}
+		a.queue = a.queue[1:]
+		a.queued(-1)
+		a.cond.Broadcast()
+		a.mu.Unlock()
+		a.sink.HandleEvent(e)
+		a.mu.Lock()
+	}
+}
+
+// emit queues an event for the sink. The first event of the connection is
+// preceded by its connect and auth events, events after its disconnect are
+// dropped.
+func (a *sessionAudit) emit(sess SessionDetails, data EventData) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.disconnected {
+		return
+	}
+
+	if !a.connected {
+		a.connected = true
+		a.details = SessionDetails{
+			ClientAddr:    sess.ClientAddr,
+			ClientVersion: sess.ClientVersion,
+			User:          sess.User,
+			SessionID:     sess.SessionID,
+			Target:        sess.Target,
+		}
+		a.emitLocked(a.details, ConnectEvent{
+			ClientAddr:    sess.ClientAddr,
+			ClientVersion: sess.ClientVersion,
+		})
+		a.emitLocked(a.details, AuthEvent{
+			User:    sess.User,
+			Method:  "none",
+			Success: true,
+		})
+	}
+	a.emitLocked(sess, data)
+}
+
+// emitLocked waits for room in the queue and queues the event. Events are
+// numbered once queued, so they are numbered in the order they are handed over.
+func (a *sessionAudit) emitLocked(sess SessionDetails, data EventData) {
+	for len(a.queue) >= auditQueueSize && !a.disconnected {
+		a.cond.Wait()
+	}
+	if a.disconnected {
+		return
+	}
+	a.seq++
+	a.queue = append(a.queue, Event{
+		Version:  EventVersion,
+		Sequence: a.seq,
+		Type:     data.EventType(),
+		Time:     time.Now(),
+		Session:  sess,
+		Data:     data,
+	})
+	a.queued(1)
+	a.cond.Broadcast()
+}
+
+// disconnect emits the connection's disconnect event, if it emitted any
+// events, and waits for every event to be handed to the sink.
+func (a *sessionAudit) disconnect() {
+	a.mu.Lock()
+	if a.connected && !a.disconnected {
+		a.emitLocked(a.details, DisconnectEvent{Duration: time.Since(a.start)})
+	}
+	a.disconnected = true
+	a.cond.Broadcast()
+	a.mu.Unlock()
+	<-a.done
+}
+
+// NewAuditLoggerSink returns an EventSink handing events to an SSHAuditLogger,
+// so loggers written against SSHAuditLogger keep working. The optional
+// SSHOutputAuditor, SSHShellCommandAuditor and SSHAuditFlusher interfaces are
+// honoured.
+func NewAuditLoggerSink(l SSHAuditLogger) EventSink {
+	return &auditLoggerSink{
+		logger:   l,
+		sessions: map[string]*auditLoggerSession{},
+	}
+}
+
+type auditLoggerSink struct {
+	logger SSHAuditLogger
+
+	// sessions is keyed by SessionDetails.Channel, as the logger is called
+	// once per session channel.
+	mu       sync.Mutex
+	sessions map[string]*auditLoggerSession
+}
+
+// auditLoggerSession holds the channels feeding an SSHAuditLogger for a session.
+type auditLoggerSession struct {
+	sessionID string
+	input     chan []byte
+	output    chan OutputChunk
+	commands  chan ShellCommand
+
+	// receivers tracks the logger's Receive calls reading the channels.
+	receivers sync.WaitGroup
+}
+
+// receive runs a Receive call of the logger in its own goroutine.
+func (s *auditLoggerSession) receive(f func()) {
+	s.receivers.Add(1)
+	go func() {
+		defer s.receivers.Done()
+		f()
+	}()
+}
+
+func (s *auditLoggerSink) session(details SessionDetails) *auditLoggerSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[details.Channel]
+	if !ok {
+		sess = &auditLoggerSession{sessionID: details.SessionID}
+		s.sessions[details.Channel] = sess
+	}
+	return sess
+}
+
+// end closes the channels feeding the logger for sess, and waits for the
+// logger's Receive calls to return.
+func (s *auditLoggerSession) end() {
+	if s.input != nil {
+		close(s.input)
+	}
+	if s.output != nil {
+		close(s.output)
+	}
+	if s.commands != nil {
+		close(s.commands)
+	}
+	s.receivers.Wait()
+}
+
+// Unwrap implements SinkWrapper, returning the logger if it is also an
+// EventSink.
+func (s *auditLoggerSink) Unwrap() EventSink {
+	sink, _ := s.logger.(EventSink)
+	return sink
+}
+
+// HandleEvent implements EventSink.
+func (s *auditLoggerSink) HandleEvent(e Event) {
+	switch data := e.Data.(type) {
+	case ExecEvent:
+		s.logger.ReceiveCommandInput(e.Session)
+	case InputEvent:
+		sess := s.session(e.Session)
+		if sess.input == nil {
+			sess.input = make(chan []byte)
+			sess.receive(func() { s.logger.ReceivePTYInput(sess.input, e.Session) })
+		}
+		sess.input <- []byte(data.Data)
+	case OutputEvent:
+		auditor, ok := s.logger.(SSHOutputAuditor)
+		if !ok {
+			return
+		}
+		sess := s.session(e.Session)
+		if sess.output == nil {
+			sess.output = make(chan OutputChunk)
+			sess.receive(func() { auditor.ReceiveOutput(sess.output, e.Session) })
+		}
+		sess.output <- OutputChunk{
+			Stream:    data.Stream,
+			Data:      []byte(data.Data),
+			Timestamp: data.Relayed,
+			Truncated: data.Truncated,
+			Sampled:   data.Sampled,
+			Dropped:   data.Dropped,
+		}
+	case ShellCommandEvent:
+		auditor, ok := s.logger.(SSHShellCommandAuditor)
+		if !ok {
+			return
+		}
+		sess := s.session(e.Session)
+		if sess.commands == nil {
+			sess.commands = make(chan ShellCommand)
+			sess.receive(func() { auditor.ReceiveShellCommands(sess.commands, e.Session) })
+		}
+		sess.commands <- ShellCommand{
+			Command:          data.Command,
+			WorkingDirectory: data.WorkingDirectory,
+			ExitCode:         data.ExitCode,
+			Started:          data.Started,
+			Duration:         data.Duration,
+		}
+	case ExitStatusEvent:
+		// The session channel has ended.
+		s.mu.Lock()
+		sess, ok := s.sessions[e.Session.Channel]
+		delete(s.sessions, e.Session.Channel)
+		s.mu.Unlock()
+		if ok {
+			sess.end()
+		}
+	case DisconnectEvent:
+		// Any session channel still open ends with the connection.
+		var ended []*auditLoggerSession
+		s.mu.Lock()
+		for channel, sess := range s.sessions {
+			if sess.sessionID == e.Session.SessionID {
+				ended = append(ended, sess)
+				delete(s.sessions, channel)
+			}
+		}
+		s.mu.Unlock()
+		for _, sess := range ended {
+			sess.end()
+		}
+		if flusher, ok := s.logger.(SSHAuditFlusher); ok {
+			flusher.FlushSession(e.Session)
+		}
+	}
+}
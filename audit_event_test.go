@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSink is an EventSink keeping every event handed to it, optionally
+// holding up each one until release is closed.
+type testSink struct {
+	release chan struct{}
+
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *testSink) HandleEvent(e Event) {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+}
+
+// types returns the types of the events handed over so far.
+func (s *testSink) types() []EventType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var types []EventType
+	for _, e := range s.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestSessionAudit(t *testing.T) {
+	sess := SessionDetails{SessionID: "abc", User: "test", ClientAddr: "10.0.0.1:5000"}
+	tests := []struct {
+		name string
+		emit func(a *sessionAudit)
+		want []EventType
+	}{{
+		name: "connect and auth precede the first event",
+		emit: func(a *sessionAudit) {
+			a.emit(sess, ShellEvent{})
+			a.emit(sess, InputEvent{Data: "ls\r"})
+		},
+		want: []EventType{EventConnect, EventAuth, EventShell, EventInput, EventDisconnect},
+	}, {
+		name: "no events without any emitted",
+		emit: func(a *sessionAudit) {},
+	}, {
+		name: "events after disconnect are dropped",
+		emit: func(a *sessionAudit) {
+			a.emit(sess, ShellEvent{})
+			a.disconnect()
+			a.emit(sess, InputEvent{Data: "late"})
+		},
+		want: []EventType{EventConnect, EventAuth, EventShell, EventDisconnect},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &testSink{}
+			a := newSessionAudit(sink, func(int) {})
+			test.emit(a)
+			a.disconnect()
+
+			got := sink.types()
+			if len(got) != len(test.want) {
+				t.Fatalf("got events %v, want %v", got, test.want)
+			}
+			for i, e := range sink.events {
+				if e.Type != test.want[i] {
+					t.Errorf("event %d = %s, want %s", i, e.Type, test.want[i])
+				}
+				if e.Sequence != uint64(i+1) {
+					t.Errorf("event %d sequence %d", i, e.Sequence)
+				}
+				if e.Version != EventVersion || e.Session.SessionID != "abc" {
+					t.Errorf("event %d = %+v", i, e)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionAuditSlowSink(t *testing.T) {
+	sink := &testSink{release: make(chan struct{})}
+	a := newSessionAudit(sink, func(int) {})
+
+	emitted := make(chan struct{})
+	go func() {
+		defer close(emitted)
+		for i := 0; i < auditQueueSize/2; i++ {
+			a.emit(SessionDetails{}, InputEvent{Data: "a"})
+		}
+	}()
+	select {
+	case <-emitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emit held up by a stuck sink with room in the queue")
+	}
+
+	close(sink.release)
+	a.disconnect()
+	if got, want := len(sink.types()), auditQueueSize/2+3; got != want {
+		t.Errorf("sink handed %d events, want %d", got, want)
+	}
+}
+
+func TestSessionAuditConcurrentOrder(t *testing.T) {
+	sink := &testSink{}
+	a := newSessionAudit(sink, func(int) {})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				a.emit(SessionDetails{}, InputEvent{Data: "a"})
+			}
+		}()
+	}
+	wg.Wait()
+	a.disconnect()
+	for i, e := range sink.events {
+		if e.Sequence != uint64(i+1) {
+			t.Fatalf("event %d handed over with sequence %d", i, e.Sequence)
+		}
+	}
+}
+
+// sinkFunc is an EventSink calling itself with each event.
+type sinkFunc func(Event)
+
+func (f sinkFunc) HandleEvent(e Event) { f(e) }
+
+func TestEventJSON(t *testing.T) {
+	exitCode := 2
+	when := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []EventData{
+		ConnectEvent{ClientAddr: "10.0.0.1:5000", ClientVersion: "SSH-2.0-OpenSSH_9.6"},
+		AuthEvent{User: "test", Method: "none", Success: true},
+		PtyRequestEvent{Term: "xterm", Width: 80, Height: 24},
+		WindowChangeEvent{Width: 120, Height: 40},
+		ShellEvent{},
+		ExecEvent{Command: []string{"ls", "-l"}},
+		SubsystemEvent{Name: "sftp"},
+		PortForwardEvent{Direction: "local", Host: "db", Port: 5432},
+		InputEvent{Data: "ls\r"},
+		CommandEvent{Command: "ls", Uncertain: true},
+		OutputEvent{Stream: OutputStderr, Data: "oops", Truncated: true, Dropped: 3},
+		ShellCommandEvent{Command: "make", WorkingDirectory: "/src", ExitCode: &exitCode, Started: when, Duration: time.Second},
+		ExitStatusEvent{ExitCode: 130, Signal: "INT"},
+		DisconnectEvent{Duration: time.Minute},
+		TerminateEvent{Admin: "root", Reason: "incident"},
+		ShadowEvent{Admin: "root", Action: ShadowAttach},
+		AdminInputEvent{Admin: "root", Data: "uptime\r"},
+		PauseEvent{Admin: "root"},
+		ResumeEvent{Admin: "root", Reason: "done"},
+		CommandPolicyEvent{Command: "rm -rf /", Action: PolicyDeny, Rule: "no-rm"},
+		CheckpointEvent{KeyID: "k1", Signature: "c2ln"},
+	}
+	seen := map[EventType]bool{}
+	for _, data := range tests {
+		t.Run(string(data.EventType()), func(t *testing.T) {
+			seen[data.EventType()] = true
+			e := Event{
+				Version:  EventVersion,
+				Sequence: 7,
+				Type:     data.EventType(),
+				Time:     when,
+				Session:  SessionDetails{SessionID: "abc", User: "test"},
+				Data:     data,
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Event
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, e) {
+				t.Errorf("round trip of %s\ngot  %+v\nwant %+v", b, got, e)
+			}
+		})
+	}
+	for typ := range eventDataDecoders {
+		if !seen[typ] {
+			t.Errorf("no round trip test for %s events", typ)
+		}
+	}
+}
+
+func TestEventUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name, json, want string
+	}{
+		{"unknown type", `{"type":"bogus","data":{}}`, `unknown event type "bogus"`},
+		{"invalid data", `{"type":"input","data":{"data":1}}`, "invalid input event data"},
+		{"invalid json", `{"type":`, "unexpected end of JSON input"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var e Event
+			err := json.Unmarshal([]byte(test.json), &e)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+// testAuditLogger is an SSHAuditLogger implementing every optional interface,
+// recording what it was handed.
+type testAuditLogger struct {
+	mu sync.Mutex
+	// input is keyed by the channel each ReceivePTYInput call was for.
+	input    map[string][]string
+	output   []string
+	relayed  []time.Time
+	commands []string
+	execs    [][]string
+	flushed  []string
+	drained  string
+}
+
+func (l *testAuditLogger) ReceivePTYInput(inputChan <-chan []byte, sess SessionDetails) {
+	l.mu.Lock()
+	if l.input == nil {
+		l.input = map[string][]string{}
+	}
+	if _, ok := l.input[sess.Channel]; ok {
+		l.mu.Unlock()
+		panic("ReceivePTYInput called twice for channel " + sess.Channel)
+	}
+	l.input[sess.Channel] = []string{}
+	l.mu.Unlock()
+	for p := range inputChan {
+		l.mu.Lock()
+		l.input[sess.Channel] = append(l.input[sess.Channel], string(p))
+		l.mu.Unlock()
+	}
+}
+
+func (l *testAuditLogger) ReceiveCommandInput(sess SessionDetails) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.execs = append(l.execs, sess.ShellCommand)
+}
+
+func (l *testAuditLogger) ReceiveOutput(outputChan <-chan OutputChunk, sess SessionDetails) {
+	for chunk := range outputChan {
+		l.mu.Lock()
+		l.output = append(l.output, string(chunk.Stream)+":"+string(chunk.Data))
+		l.relayed = append(l.relayed, chunk.Timestamp)
+		l.mu.Unlock()
+	}
+}
+
+func (l *testAuditLogger) ReceiveShellCommands(commandChan <-chan ShellCommand, sess SessionDetails) {
+	for c := range commandChan {
+		l.mu.Lock()
+		l.commands = append(l.commands, c.Command)
+		l.mu.Unlock()
+	}
+}
+
+func (l *testAuditLogger) FlushSession(sess SessionDetails) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushed = append(l.flushed, sess.SessionID)
+	if sess.SessionID == "pty" {
+		// Every channel has been drained by the time a session is flushed.
+		l.drained = fmt.Sprintf("%d:%d:%d", len(l.input["pty"]), len(l.output), len(l.commands))
+	}
+}
+
+func TestAuditLoggerSink(t *testing.T) {
+	pty := SessionDetails{SessionID: "pty", Channel: "pty"}
+	pty2 := SessionDetails{SessionID: "pty", Channel: "pty-2"}
+	exec := SessionDetails{SessionID: "exec", Channel: "exec", ShellCommand: []string{"uptime"}}
+	relayed := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	logger := &testAuditLogger{}
+	sink := NewAuditLoggerSink(logger)
+	for _, e := range []Event{
+		{Session: pty, Data: ShellEvent{}},
+		{Session: pty, Data: InputEvent{Data: "l"}},
+		{Session: pty2, Data: InputEvent{Data: "id\r"}},
+		{Session: pty, Data: InputEvent{Data: "s\r"}},
+		{Session: pty2, Data: ExitStatusEvent{}},
+		{Session: exec, Data: ExecEvent{Command: exec.ShellCommand}},
+		{Session: pty, Data: OutputEvent{Stream: OutputStdout, Data: "file\r\n", Relayed: relayed}},
+		{Session: pty, Data: ShellCommandEvent{Command: "ls"}},
+		{Session: SessionDetails{SessionID: "exec"}, Data: DisconnectEvent{}},
+		{Session: SessionDetails{SessionID: "pty"}, Data: DisconnectEvent{}},
+	} {
+		e.Type = e.Data.EventType()
+		e.Time = relayed.Add(time.Minute)
+		sink.HandleEvent(e)
+	}
+
+	want := testAuditLogger{
+		input:    map[string][]string{"pty": {"l", "s\r"}, "pty-2": {"id\r"}},
+		output:   []string{"stdout:file\r\n"},
+		relayed:  []time.Time{relayed},
+		commands: []string{"ls"},
+		execs:    [][]string{{"uptime"}},
+		flushed:  []string{"exec", "pty"},
+		drained:  "2:1:1",
+	}
+	if !reflect.DeepEqual(logger.input, want.input) || !reflect.DeepEqual(logger.output, want.output) ||
+		!reflect.DeepEqual(logger.relayed, want.relayed) ||
+		!reflect.DeepEqual(logger.commands, want.commands) || !reflect.DeepEqual(logger.execs, want.execs) ||
+		!reflect.DeepEqual(logger.flushed, want.flushed) || logger.drained != want.drained {
+		t.Errorf("logger handed\n%+v\nwant\n%+v", logger, &want)
+	}
+}
+
+// testInputLogger is an SSHAuditLogger implementing none of the optional interfaces.
+type testInputLogger struct {
+	input []string
+}
+
+func (l *testInputLogger) ReceivePTYInput(inputChan <-chan []byte, sess SessionDetails) {
+	for p := range inputChan {
+		l.input = append(l.input, string(p))
+	}
+}
+
+func (l *testInputLogger) ReceiveCommandInput(sess SessionDetails) {}
+
+func TestAuditLoggerSinkOptionalInterfaces(t *testing.T) {
+	logger := &testInputLogger{}
+	sink := NewAuditLoggerSink(logger)
+	sess := SessionDetails{SessionID: "pty", Channel: "pty"}
+	for _, data := range []EventData{
+		OutputEvent{Data: "ignored"},
+		ShellCommandEvent{Command: "ignored"},
+		InputEvent{Data: "id\r"},
+		DisconnectEvent{},
+	} {
+		sink.HandleEvent(Event{Type: data.EventType(), Session: sess, Data: data})
+	}
+	if !reflect.DeepEqual(logger.input, []string{"id\r"}) {
+		t.Errorf("logger handed %q", logger.input)
+	}
+}
@@ -1,27 +1,26 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
-	"unicode"
-	"unicode/utf8"
 
 	"github.com/juju/zaputil/zapctx"
 )
 
 func NewSSHAuditLogger() *sshAuditLogger {
 	return &sshAuditLogger{
-		logs: make([]sshAuditLog, 0),
+		logs: make(map[string][]sshAuditLog),
 	}
 }
 
 type sshAuditLogger struct {
+	mu sync.Mutex
 
-	// A slice of logs to be written upon session closure
-	logs []sshAuditLog
+	// The logs of each session by SessionId, to be written upon session closure
+	logs map[string][]sshAuditLog
 }
 
 type sshAuditLog struct {
@@ -31,76 +30,105 @@ type sshAuditLog struct {
 	ClientsAddr   string
 	RawCommand    []byte
 	Command       string
+	Uncertain     bool // Set when Command could not be reconstructed exactly from RawCommand.
 	Timestamp     time.Time
 }
 
+type sshOutputLog struct {
+	SessionId string
+	User      string
+	Stream    OutputStream
+	Output    string
+	Truncated bool
+	Sampled   bool
+	Dropped   int
+	Timestamp time.Time
+}
+
+func (l *sshAuditLogger) ReceiveOutput(outputChan <-chan OutputChunk, sess SessionDetails) {
+	for chunk := range outputChan {
+		log := sshOutputLog{
+			SessionId: sess.SessionID,
+			User:      sess.User,
+			Stream:    chunk.Stream,
+			Output:    string(chunk.Data),
+			Truncated: chunk.Truncated,
+			Sampled:   chunk.Sampled,
+			Dropped:   chunk.Dropped,
+			Timestamp: chunk.Timestamp,
+		}
+		loggylog, _ := json.MarshalIndent(log, "", " ")
+		fmt.Println(string(loggylog))
+	}
+}
+
+type sshShellCommandLog struct {
+	SessionId        string
+	User             string
+	Command          string
+	WorkingDirectory string
+	ExitCode         *int
+	Duration         time.Duration
+	Timestamp        time.Time
+}
+
+func (l *sshAuditLogger) ReceiveShellCommands(commandChan <-chan ShellCommand, sess SessionDetails) {
+	for command := range commandChan {
+		log := sshShellCommandLog{
+			SessionId:        sess.SessionID,
+			User:             sess.User,
+			Command:          command.Command,
+			WorkingDirectory: command.WorkingDirectory,
+			ExitCode:         command.ExitCode,
+			Duration:         command.Duration,
+			Timestamp:        command.Started,
+		}
+		loggylog, _ := json.MarshalIndent(log, "", " ")
+		fmt.Println(string(loggylog))
+	}
+}
+
 func (l *sshAuditLogger) ReceiveCommandInput(sess SessionDetails) {
 	b, _ := json.MarshalIndent(sess, "", " ")
 	fmt.Println(string(b))
 }
 
 func (l *sshAuditLogger) ReceivePTYInput(inputChan <-chan []byte, sess SessionDetails) {
-	inputBuffer := &bytes.Buffer{}
+	editor := newLineEditor()
 	for input := range inputChan {
-		inputBuffer.Write(input)
-
-		if bytes.ContainsRune(input, '\r') {
+		for _, line := range editor.feed(input) {
 			zapctx.Debug(context.TODO(), "Log being sent")
-			l.sendLog(inputBuffer, sess)
+			l.sendLog(line, sess)
 		}
 	}
 }
 
-func (l *sshAuditLogger) sendLog(inputBuffer *bytes.Buffer, sess SessionDetails) {
-	rawCommand := inputBuffer.Bytes()
-	runes := bytes.Runes(rawCommand)
-	command := string(runes)
-
+func (l *sshAuditLogger) sendLog(line editedLine, sess SessionDetails) {
 	log := sshAuditLog{
 		SessionId:     sess.SessionID,
 		User:          sess.User,
 		ClientVersion: sess.ClientVersion,
 		ClientsAddr:   sess.ClientAddr,
-		RawCommand:    rawCommand,
-		Command:       command,
+		RawCommand:    line.Raw,
+		Command:       line.Command,
+		Uncertain:     line.Uncertain,
 		Timestamp:     time.Now(),
 	}
-	l.logs = append(l.logs, log)
+	l.mu.Lock()
+	l.logs[sess.SessionID] = append(l.logs[sess.SessionID], log)
+	l.mu.Unlock()
 	zapctx.Debug(context.TODO(), "Log created")
-	loggylog, _ := json.MarshalIndent(log, "", " ")
-	fmt.Println(string(loggylog))
-	inputBuffer.Reset()
 }
 
-// A basic attempt to remove backspace, del, ctrl+backspace and ctrl+c from
-// human readable outputs
-func handleRemovals(bytes []byte) string {
-	var result []rune
-	for i := 0; i < len(bytes); {
-		r, size := utf8.DecodeRune(bytes[i:])
-		switch r {
-		case '\b', 127: // Backspace or DEL
-			if len(result) > 0 {
-				result = result[:len(result)-1] // Remove the last rune
-			}
-		case 3: // Ctrl+C
-			return ""
-		case 23: // Ctrl+backspace
-			// Find the index of the first previous whitespace character
-			idx := len(result)
-			for idx > 0 {
-				r := result[idx-1]
-				if unicode.IsSpace(r) {
-					break
-				}
-				idx--
-			}
-			result = result[:idx] // Remove from cursor to previous whitespace
-		default:
-			result = append(result, r)
-		}
-		i += size
+// FlushSession writes the session's logs and forgets them.
+func (l *sshAuditLogger) FlushSession(sess SessionDetails) {
+	l.mu.Lock()
+	logs := l.logs[sess.SessionID]
+	delete(l.logs, sess.SessionID)
+	l.mu.Unlock()
+
+	for _, log := range logs {
+		loggylog, _ := json.MarshalIndent(log, "", " ")
+		fmt.Println(string(loggylog))
 	}
-	result = result[:len(result)-1] // Remove final \r (it'll always be there anyway as they're submitting a command)
-	return string(result)
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const usage = `usage: auditverify [-key public.pem] <file>...
+
+Verifies the hash chain and signed checkpoints of JSON Lines audit logs written
+through a HashChainSink, reporting each place the chain breaks. Rotated files
+are given in the order they were written, and may be gzipped. With -key, events
+not covered by a checkpoint and new chains started part way through are also
+reported, as they could have been written without the key.`
+
+// record mirrors the fields of the proxy's audit events the chain covers.
+type record struct {
+	Sequence uint64 `json:"seq"`
+	Type     string `json:"type"`
+	Session  struct {
+		SessionID string `json:"session_id"`
+	} `json:"session"`
+	Data            json.RawMessage `json:"data"`
+	GlobalSequence  uint64          `json:"global_seq"`
+	SessionPrevHash string          `json:"session_prev_hash"`
+	PrevHash        string          `json:"prev_hash"`
+	Hash            string          `json:"hash"`
+}
+
+// checkpoint mirrors the data of the proxy's checkpoint events.
+type checkpoint struct {
+	KeyID     string `json:"key_id"`
+	Signature string `json:"signature"`
+}
+
+// checkpointMessage mirrors the message the proxy signs for a checkpoint.
+func checkpointMessage(globalSeq uint64, prevHash string) []byte {
+	return []byte(fmt.Sprintf("ssh-proxy audit checkpoint %d %s", globalSeq, prevHash))
+}
+
+func main() {
+	key := flag.String("key", "", "PEM encoded ed25519 public key checkpoints are verified with")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	v := &verifier{sessions: map[string]record{}}
+	if *key != "" {
+		pub, err := loadPublicKey(*key)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "auditverify:", err)
+			os.Exit(1)
+		}
+		v.key = pub
+	}
+	for _, path := range flag.Args() {
+		if err := v.verifyFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, "auditverify:", err)
+			os.Exit(1)
+		}
+	}
+	v.finish()
+	if v.problems > 0 {
+		os.Exit(1)
+	}
+}
+
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is %T, not ed25519", key)
+	}
+	return edKey, nil
+}
+
+// verifier verifies a stream of records, which may span several files.
+type verifier struct {
+	key ed25519.PublicKey
+
+	// prev is the previous record, started is set once one has been read.
+	prev    record
+	started bool
+	// fromStart is set when the chain has been read from its first event.
+	fromStart bool
+	// sessions holds the latest record of each session seen since the
+	// chain started.
+	sessions map[string]record
+
+	events      int
+	checkpoints int
+	// unsigned counts the events since the last verified checkpoint.
+	unsigned int
+	problems int
+	// where is the location of the record being verified.
+	where string
+}
+
+func (v *verifier) report(format string, args ...any) {
+	v.problems++
+	fmt.Printf("%s: %s\n", v.where, fmt.Sprintf(format, args...))
+}
+
+func (v *verifier) verifyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if len(b) > 0 {
+			v.where = fmt.Sprintf("%s:%d", path, line)
+			v.verify(bytes.TrimRight(b, "\r\n"))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+}
+
+// verify verifies a single record.
+func (v *verifier) verify(line []byte) {
+	var r record
+	if err := json.Unmarshal(line, &r); err != nil {
+		v.report("not a valid event: %v", err)
+		return
+	}
+	v.where = fmt.Sprintf("%s: global_seq %d", v.where, r.GlobalSequence)
+	v.events++
+	v.unsigned++
+
+	if r.Hash == "" {
+		v.report("event has no hash, it was not written through a hash chain")
+	} else if hash, ok := recordHash(line, r.Hash); !ok {
+		v.report("hash is not the last field of the event, it was re-encoded")
+	} else if hash != r.Hash {
+		v.report("hash mismatch, the event was modified (hash %s, content hashes to %s)", r.Hash, hash)
+	}
+
+	switch {
+	case r.GlobalSequence == 1 && r.PrevHash == "":
+		// A new chain. A proxy saving its chain's state resumes it when
+		// restarted, so with a key a new chain part way through a log means
+		// the state was lost, or the events after it were spliced in.
+		if v.started && (v.key != nil || v.unsigned > 1) {
+			v.report("new chain started, the chain before it ends here (%d unsigned event(s) before it)", v.unsigned-1)
+		}
+		v.sessions = map[string]record{}
+		v.unsigned = 1
+		v.fromStart = true
+	case !v.started:
+		fmt.Printf("%s: chain starts mid-way, its earlier events cannot be verified\n", v.where)
+	case r.GlobalSequence != v.prev.GlobalSequence+1:
+		v.report("expected global_seq %d, %d event(s) missing or reordered", v.prev.GlobalSequence+1, int64(r.GlobalSequence)-int64(v.prev.GlobalSequence)-1)
+	case r.PrevHash != v.prev.Hash:
+		v.report("prev_hash does not match the previous event, events were removed, inserted or reordered")
+	}
+
+	if r.Type == "checkpoint" {
+		v.verifyCheckpoint(r)
+	} else {
+		v.verifySession(r)
+	}
+
+	v.prev = r
+	v.started = true
+}
+
+// recordHash returns the hash of a record's encoding without its hash field,
+// which must be the last field.
+func recordHash(line []byte, hash string) (string, bool) {
+	suffix := []byte(`,"hash":"` + hash + `"}`)
+	if !bytes.HasSuffix(line, suffix) {
+		return "", false
+	}
+	content := append(bytes.Clone(line[:len(line)-len(suffix)]), '}')
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), true
+}
+
+func (v *verifier) verifySession(r record) {
+	prev, ok := v.sessions[r.Session.SessionID]
+	switch {
+	case ok && r.SessionPrevHash != prev.Hash:
+		v.report("session %s: session_prev_hash does not match its previous event at global_seq %d, session events were removed or reordered", r.Session.SessionID, prev.GlobalSequence)
+	case ok && r.Sequence != prev.Sequence+1:
+		v.report("session %s: expected seq %d, got %d", r.Session.SessionID, prev.Sequence+1, r.Sequence)
+	case !ok && r.SessionPrevHash != "" && v.fromStart:
+		v.report("session %s: its earlier events are missing", r.Session.SessionID)
+	}
+	if r.Type == "disconnect" {
+		delete(v.sessions, r.Session.SessionID)
+		return
+	}
+	v.sessions[r.Session.SessionID] = r
+}
+
+func (v *verifier) verifyCheckpoint(r record) {
+	var c checkpoint
+	if err := json.Unmarshal(r.Data, &c); err != nil {
+		v.report("invalid checkpoint: %v", err)
+		return
+	}
+	if v.key == nil {
+		fmt.Printf("%s: checkpoint signed by key %s not verified, no -key given\n", v.where, c.KeyID)
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(v.key, checkpointMessage(r.GlobalSequence, r.PrevHash), signature) {
+		v.report("checkpoint signature is invalid (key %s), the chain before it was rewritten", c.KeyID)
+		return
+	}
+	v.checkpoints++
+	v.unsigned = 0
+}
+
+// finish reports the events after the last checkpoint, which could have been
+// truncated or added without the key, and prints a summary.
+func (v *verifier) finish() {
+	if v.unsigned > 0 && v.key != nil {
+		v.where = "end of log"
+		v.report("the last %d event(s) are not covered by a checkpoint", v.unsigned)
+	}
+	fmt.Printf("%d event(s), %d checkpoint(s) verified, %d problem(s)\n", v.events, v.checkpoints, v.problems)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testEvent is the part of an audit event the chain covers, with its fields
+// in the order the proxy encodes them.
+type testEvent struct {
+	Sequence uint64 `json:"seq"`
+	Type     string `json:"type"`
+	Session  struct {
+		SessionID string `json:"session_id"`
+	} `json:"session"`
+	Data            any    `json:"data"`
+	GlobalSequence  uint64 `json:"global_seq,omitempty"`
+	SessionPrevHash string `json:"session_prev_hash,omitempty"`
+	PrevHash        string `json:"prev_hash,omitempty"`
+}
+
+// chain encodes events, given as "<session> <type>" or "checkpoint", as a
+// hash chain the way a HashChainSink does, signing checkpoints with key.
+func chain(t *testing.T, key ed25519.PrivateKey, events ...string) []string {
+	t.Helper()
+	var lines []string
+	var head string
+	sessions := map[string]string{}
+	seqs := map[string]uint64{}
+	for i, event := range events {
+		var e testEvent
+		e.GlobalSequence = uint64(i + 1)
+		e.PrevHash = head
+		if event == "checkpoint" {
+			e.Type = "checkpoint"
+			message := fmt.Sprintf("ssh-proxy audit checkpoint %d %s", e.GlobalSequence, e.PrevHash)
+			e.Data = checkpoint{KeyID: "test", Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(message)))}
+		} else {
+			id, typ, _ := strings.Cut(event, " ")
+			seqs[id]++
+			e.Sequence = seqs[id]
+			e.Type = typ
+			e.Session.SessionID = id
+			e.SessionPrevHash = sessions[id]
+			e.Data = map[string]string{}
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(b)
+		hash := hex.EncodeToString(sum[:])
+		head = hash
+		if e.Type == "disconnect" {
+			delete(sessions, e.Session.SessionID)
+		} else if e.Type != "checkpoint" {
+			sessions[e.Session.SessionID] = hash
+		}
+		lines = append(lines, strings.TrimSuffix(string(b), "}")+`,"hash":"`+hash+`"}`)
+	}
+	return lines
+}
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerify(t *testing.T) {
+	key, otherKey := newTestKey(t), newTestKey(t)
+	events := []string{"a connect", "a input", "b connect", "a input", "checkpoint", "b input", "a disconnect", "checkpoint"}
+	intact := chain(t, key, events...)
+
+	tests := []struct {
+		name  string
+		lines []string
+		// wantProblems and wantCheckpoints are the problems reported and
+		// checkpoints verified, wantUnsigned the events after the last one.
+		wantProblems    int
+		wantCheckpoints int
+		wantUnsigned    int
+	}{{
+		name:            "intact",
+		lines:           intact,
+		wantCheckpoints: 2,
+	}, {
+		name:            "modified event",
+		lines:           replace(intact, 1, strings.Replace(intact[1], `"input"`, `"output"`, 1)),
+		wantProblems:    1,
+		wantCheckpoints: 2,
+	}, {
+		name: "removed event",
+		// The gap in global_seq, and the session's next event no longer
+		// following its previous one.
+		lines:           remove(intact, 3),
+		wantProblems:    2,
+		wantCheckpoints: 2,
+	}, {
+		name:            "reordered events",
+		lines:           replace(replace(intact, 1, intact[2]), 2, intact[1]),
+		wantProblems:    3,
+		wantCheckpoints: 2,
+	}, {
+		name:         "chain rewritten without the key",
+		lines:        chain(t, otherKey, events...),
+		wantProblems: 3,
+		wantUnsigned: 8,
+	}, {
+		name:            "truncated",
+		lines:           intact[:6],
+		wantProblems:    1,
+		wantCheckpoints: 1,
+		wantUnsigned:    1,
+	}, {
+		name:            "restarted after a checkpoint",
+		lines:           append(append([]string(nil), intact...), chain(t, key, "c connect", "checkpoint")...),
+		wantProblems:    1,
+		wantCheckpoints: 3,
+	}, {
+		name:            "restarted with unsigned events",
+		lines:           append(append([]string(nil), intact[:6]...), chain(t, key, "c connect", "checkpoint")...),
+		wantProblems:    1,
+		wantCheckpoints: 2,
+	}, {
+		name:         "checkpoints removed",
+		lines:        chain(t, key, "a connect", "a input", "b connect", "a input", "b input", "a disconnect"),
+		wantProblems: 1,
+		wantUnsigned: 6,
+	}, {
+		name:            "new chain spliced in after a checkpoint",
+		lines:           append(append([]string(nil), intact...), chain(t, otherKey, "c connect", "c input")...),
+		wantProblems:    2,
+		wantCheckpoints: 2,
+		wantUnsigned:    2,
+	}, {
+		name:            "started mid-way",
+		lines:           intact[5:],
+		wantCheckpoints: 1,
+	}, {
+		name:            "re-encoded event",
+		lines:           replace(intact, 0, strings.TrimSuffix(intact[0], "}")+" }"),
+		wantProblems:    1,
+		wantCheckpoints: 2,
+	}, {
+		name:            "invalid event",
+		lines:           replace(intact, 5, "not json"),
+		wantProblems:    2,
+		wantCheckpoints: 2,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := &verifier{key: key.Public().(ed25519.PublicKey), sessions: map[string]record{}}
+			for i, line := range test.lines {
+				v.where = fmt.Sprintf("line %d", i+1)
+				v.verify([]byte(line))
+			}
+			v.finish()
+			if v.problems != test.wantProblems {
+				t.Errorf("reported %d problems, want %d", v.problems, test.wantProblems)
+			}
+			if v.checkpoints != test.wantCheckpoints {
+				t.Errorf("verified %d checkpoints, want %d", v.checkpoints, test.wantCheckpoints)
+			}
+			if v.unsigned != test.wantUnsigned {
+				t.Errorf("%d events unsigned, want %d", v.unsigned, test.wantUnsigned)
+			}
+		})
+	}
+}
+
+func replace(lines []string, i int, line string) []string {
+	lines = append([]string(nil), lines...)
+	lines[i] = line
+	return lines
+}
+
+func remove(lines []string, i int) []string {
+	return append(append([]string(nil), lines[:i]...), lines[i+1:]...)
+}
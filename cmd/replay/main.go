@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moby/term"
+)
+
+const usage = `usage: replay <command> [flags]
+
+commands:
+  list   list recordings, optionally filtered by user, client address and time
+  play   play a recording back in the terminal
+  cat    dump a recording's output as plain text
+
+Run "replay <command> -h" for a command's flags.`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "list":
+		err = list(os.Args[2:])
+	case "play":
+		err = play(os.Args[2:])
+	case "cat":
+		err = cat(os.Args[2:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		os.Exit(1)
+	}
+}
+
+// recordingMetadata mirrors the metadata the proxy stores alongside each recording.
+type recordingMetadata struct {
+	Recording     string     `json:"recording"`
+	SessionID     string     `json:"session_id"`
+	User          string     `json:"user"`
+	ClientAddr    string     `json:"client_addr"`
+	ClientVersion string     `json:"client_version"`
+	Start         time.Time  `json:"start"`
+	End           *time.Time `json:"end,omitempty"`
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dir := fs.String("dir", "./recordings", "directory holding the recordings")
+	user := fs.String("user", "", "only list sessions of this user")
+	addr := fs.String("addr", "", "only list sessions from this client address, with or without a port")
+	since := fs.String("since", "", "only list sessions started at or after this RFC 3339 time")
+	until := fs.String("until", "", "only list sessions started before this RFC 3339 time")
+	fs.Parse(args)
+
+	var sinceT, untilT time.Time
+	var err error
+	if *since != "" {
+		if sinceT, err = time.Parse(time.RFC3339, *since); err != nil {
+			return fmt.Errorf("invalid -since: %w", err)
+		}
+	}
+	if *until != "" {
+		if untilT, err = time.Parse(time.RFC3339, *until); err != nil {
+			return fmt.Errorf("invalid -until: %w", err)
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(*dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	var metas []recordingMetadata
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var meta recordingMetadata
+		if err := json.Unmarshal(b, &meta); err != nil {
+			fmt.Fprintf(os.Stderr, "replay: skipping %s: %v\n", path, err)
+			continue
+		}
+		if *user != "" && meta.User != *user {
+			continue
+		}
+		if *addr != "" && !matchAddr(meta.ClientAddr, *addr) {
+			continue
+		}
+		if !sinceT.IsZero() && meta.Start.Before(sinceT) {
+			continue
+		}
+		if !untilT.IsZero() && !meta.Start.Before(untilT) {
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Start.Before(metas[j].Start)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RECORDING\tSESSION\tUSER\tCLIENT\tSTART\tDURATION")
+	for _, meta := range metas {
+		duration := "active"
+		if meta.End != nil {
+			duration = meta.End.Sub(meta.Start).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			meta.Recording,
+			meta.SessionID,
+			meta.User,
+			meta.ClientAddr,
+			meta.Start.Local().Format(time.DateTime),
+			duration,
+		)
+	}
+	return w.Flush()
+}
+
+// matchAddr reports whether the client address matches filter, filter may
+// omit the port to match any connection from the host.
+func matchAddr(clientAddr, filter string) bool {
+	if clientAddr == filter {
+		return true
+	}
+	host, _, err := net.SplitHostPort(clientAddr)
+	return err == nil && host == filter
+}
+
+// castEvent is a single asciicast v2 event.
+type castEvent struct {
+	Time float64
+	Code string
+	Data string
+}
+
+// readRecording reads the recording with the given name, as listed, or path.
+func readRecording(dir, name string) ([]castEvent, error) {
+	path := name
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Join(dir, name+".cast")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("%s: missing header", path)
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, fmt.Errorf("%s: invalid header: %w", path, err)
+	}
+	if header.Version != 2 {
+		return nil, fmt.Errorf("%s: unsupported asciicast version %d", path, header.Version)
+	}
+
+	var events []castEvent
+	for line := 2; scanner.Scan(); line++ {
+		var raw []any
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil || len(raw) != 3 {
+			return nil, fmt.Errorf("%s:%d: invalid event", path, line)
+		}
+		t, ok1 := raw[0].(float64)
+		code, ok2 := raw[1].(string)
+		data, ok3 := raw[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("%s:%d: invalid event", path, line)
+		}
+		events = append(events, castEvent{Time: t, Code: code, Data: data})
+	}
+	return events, scanner.Err()
+}
+
+// outputEvents returns the output events, with idle periods longer than
+// idleLimit shortened to idleLimit. A zero idleLimit keeps the original timing.
+func outputEvents(events []castEvent, idleLimit time.Duration) []castEvent {
+	var out []castEvent
+	var prev, shift float64
+	limit := idleLimit.Seconds()
+	for _, e := range events {
+		if e.Code != "o" {
+			continue
+		}
+		if limit > 0 && e.Time-prev > limit {
+			shift += e.Time - prev - limit
+		}
+		prev = e.Time
+		e.Time -= shift
+		out = append(out, e)
+	}
+	return out
+}
+
+func cat(args []string) error {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	dir := fs.String("dir", "./recordings", "directory holding the recordings")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: replay cat [flags] <recording|file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	events, err := readRecording(*dir, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	var text plainText
+	for _, e := range outputEvents(events, 0) {
+		text.write(w, e.Data)
+	}
+	return w.Flush()
+}
+
+// plainText strips terminal control sequences from output, leaving the text
+// that was printed. Sequences may span events, so state is kept between writes.
+type plainText struct {
+	state int
+}
+
+const (
+	textNormal = iota
+	textEscape
+	textCSI
+	textString
+	textStringEscape
+)
+
+func (t *plainText) write(w io.ByteWriter, s string) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch t.state {
+		case textNormal:
+			switch {
+			case c == 0x1b:
+				t.state = textEscape
+			case c == '\n' || c == '\t' || c >= 0x20 && c != 0x7f:
+				w.WriteByte(c)
+			}
+		case textEscape:
+			switch c {
+			case '[':
+				t.state = textCSI
+			case ']', 'P', '_', '^', 'X':
+				t.state = textString
+			default:
+				if c >= 0x20 && c <= 0x2f {
+					// Intermediate bytes, such as charset selection, are followed by a final byte.
+					continue
+				}
+				t.state = textNormal
+			}
+		case textCSI:
+			if c >= 0x40 && c <= 0x7e {
+				t.state = textNormal
+			}
+		case textString:
+			switch c {
+			case 0x07:
+				t.state = textNormal
+			case 0x1b:
+				t.state = textStringEscape
+			}
+		case textStringEscape:
+			if c == '\\' {
+				t.state = textNormal
+			} else {
+				t.state = textString
+			}
+		}
+	}
+}
+
+func play(args []string) error {
+	fs := flag.NewFlagSet("play", flag.ExitOnError)
+	dir := fs.String("dir", "./recordings", "directory holding the recordings")
+	speed := fs.Float64("speed", 1, "playback speed multiplier")
+	idleLimit := fs.Duration("idle-limit", 0, "shorten idle periods to at most this long, 0 keeps the original timing")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: replay play [flags] <recording|file>")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "\ncontrols: space pause/resume, left/right seek 5s, +/- change speed, q quit")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *speed <= 0 {
+		return errors.New("-speed must be positive")
+	}
+
+	events, err := readRecording(*dir, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	p := &player{
+		events: outputEvents(events, *idleLimit),
+		speed:  *speed,
+		out:    os.Stdout,
+	}
+
+	controls := make(chan playerControl)
+	fd := os.Stdin.Fd()
+	if term.IsTerminal(fd) {
+		oldState, err := term.SetRawTerminal(fd)
+		if err != nil {
+			return err
+		}
+		defer term.RestoreTerminal(fd, oldState)
+		go readControls(os.Stdin, controls)
+	}
+
+	p.run(controls)
+	return nil
+}
+
+type playerControl int
+
+const (
+	controlPause playerControl = iota
+	controlForward
+	controlBack
+	controlFaster
+	controlSlower
+	controlQuit
+)
+
+const seekStep = 5.0
+
+// readControls translates key presses into player controls.
+func readControls(r io.Reader, controls chan<- playerControl) {
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			close(controls)
+			return
+		}
+		keys := string(buf[:n])
+		switch {
+		case keys == " ":
+			controls <- controlPause
+		case keys == "\x1b[C":
+			controls <- controlForward
+		case keys == "\x1b[D":
+			controls <- controlBack
+		case keys == "+" || keys == "=":
+			controls <- controlFaster
+		case keys == "-":
+			controls <- controlSlower
+		case keys == "q" || keys == "\x03":
+			controls <- controlQuit
+		}
+	}
+}
+
+// player plays output events back against the wall clock.
+type player struct {
+	events []castEvent
+	speed  float64
+	out    io.Writer
+
+	// pos is the index of the next event to play.
+	pos int
+	// clock is the current position in the recording, in seconds.
+	clock  float64
+	paused bool
+}
+
+func (p *player) run(controls <-chan playerControl) {
+	for p.pos < len(p.events) {
+		var wait <-chan time.Time
+		started := time.Now()
+		if !p.paused {
+			next := p.events[p.pos]
+			delay := time.Duration((next.Time - p.clock) / p.speed * float64(time.Second))
+			wait = time.After(delay)
+		}
+
+		select {
+		case <-wait:
+			p.emit()
+		case c, ok := <-controls:
+			if !ok {
+				controls = nil
+				continue
+			}
+			if !p.paused {
+				p.clock = min(p.clock+time.Since(started).Seconds()*p.speed, p.events[p.pos].Time)
+			}
+			switch c {
+			case controlPause:
+				p.paused = !p.paused
+			case controlForward:
+				p.seek(p.clock + seekStep)
+			case controlBack:
+				p.seek(p.clock - seekStep)
+			case controlFaster:
+				p.speed *= 2
+			case controlSlower:
+				p.speed /= 2
+			case controlQuit:
+				return
+			}
+		}
+	}
+}
+
+// emit writes the next event.
+func (p *player) emit() {
+	e := p.events[p.pos]
+	io.WriteString(p.out, e.Data)
+	p.clock = e.Time
+	p.pos++
+}
+
+// seek moves playback to t, seconds into the recording. Seeking backwards
+// resets the terminal and replays everything up to t.
+func (p *player) seek(t float64) {
+	t = max(t, 0)
+	if t < p.clock {
+		io.WriteString(p.out, "\x1bc")
+		p.pos = 0
+	}
+	for p.pos < len(p.events) && p.events[p.pos].Time <= t {
+		p.emit()
+	}
+	p.clock = t
+}
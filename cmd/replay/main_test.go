@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchAddr(t *testing.T) {
+	tests := []struct {
+		clientAddr, filter string
+		want               bool
+	}{
+		{"10.0.0.1:5000", "10.0.0.1:5000", true},
+		{"10.0.0.1:5000", "10.0.0.1", true},
+		{"10.0.0.1:5000", "10.0.0.2", false},
+		{"10.0.0.1:5000", "10.0.0.1:5001", false},
+		{"[::1]:22", "::1", true},
+		{"not-an-addr", "not", false},
+	}
+	for _, test := range tests {
+		if got := matchAddr(test.clientAddr, test.filter); got != test.want {
+			t.Errorf("matchAddr(%q, %q) = %v, want %v", test.clientAddr, test.filter, got, test.want)
+		}
+	}
+}
+
+func TestReadRecording(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []castEvent
+		wantErr string
+	}{{
+		name:    "events",
+		content: "{\"version\":2,\"width\":80,\"height\":24}\n[0.5,\"o\",\"$ \"]\n[1,\"i\",\"ls\\r\"]\n",
+		want:    []castEvent{{Time: 0.5, Code: "o", Data: "$ "}, {Time: 1, Code: "i", Data: "ls\r"}},
+	}, {
+		name:    "missing header",
+		content: "",
+		wantErr: "missing header",
+	}, {
+		name:    "unsupported version",
+		content: "{\"version\":1}\n",
+		wantErr: "unsupported asciicast version 1",
+	}, {
+		name:    "invalid event",
+		content: "{\"version\":2}\n[0.5,\"o\"]\n",
+		wantErr: ":2: invalid event",
+	}, {
+		name:    "invalid event types",
+		content: "{\"version\":2}\n[\"0.5\",\"o\",\"x\"]\n",
+		wantErr: ":2: invalid event",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "abc-2.cast"), []byte(test.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"abc-2", filepath.Join(dir, "abc-2.cast")} {
+				got, err := readRecording(dir, name)
+				if test.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+						t.Errorf("readRecording(%q) error %v, want %q", name, err, test.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("readRecording(%q) = %v, want %v", name, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOutputEvents(t *testing.T) {
+	events := []castEvent{
+		{Time: 1, Code: "o", Data: "a"},
+		{Time: 2, Code: "i", Data: "x"},
+		{Time: 10, Code: "o", Data: "b"},
+		{Time: 10.5, Code: "r", Data: "80x24"},
+		{Time: 11, Code: "o", Data: "c"},
+	}
+	tests := []struct {
+		name      string
+		idleLimit time.Duration
+		want      []float64
+	}{
+		{"original timing", 0, []float64{1, 10, 11}},
+		{"idle shortened", 2 * time.Second, []float64{1, 3, 4}},
+		{"limit above every gap", time.Minute, []float64{1, 10, 11}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []float64
+			for _, e := range outputEvents(events, test.idleLimit) {
+				if e.Code != "o" {
+					t.Errorf("non-output event %v", e)
+				}
+				got = append(got, e.Time)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("event times %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"plain", []string{"hello\n"}, "hello\n"},
+		{"colours", []string{"\x1b[1;31mred\x1b[0m"}, "red"},
+		{"title bel", []string{"\x1b]0;title\x07text"}, "text"},
+		{"title st", []string{"\x1b]0;title\x1b\\text"}, "text"},
+		{"charset", []string{"\x1b(Bok"}, "ok"},
+		{"control characters", []string{"a\rb\x7fc\x08"}, "abc"},
+		{"split sequence", []string{"a\x1b[3", "1mb"}, "ab"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			var text plainText
+			for _, s := range test.writes {
+				text.write(&buf, s)
+			}
+			if buf.String() != test.want {
+				t.Errorf("got %q, want %q", buf.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestPlayerSeek(t *testing.T) {
+	events := []castEvent{
+		{Time: 1, Data: "a"},
+		{Time: 4, Data: "b"},
+		{Time: 9, Data: "c"},
+	}
+	tests := []struct {
+		name    string
+		clock   float64
+		pos     int
+		seek    float64
+		want    string
+		wantPos int
+	}{
+		{"forward", 0, 0, 5, "ab", 2},
+		{"forward past the end", 4, 2, 20, "c", 3},
+		{"back replays from the start", 9, 3, 2, "\x1bca", 1},
+		{"back before the start", 1, 1, -3, "\x1bc", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			p := &player{events: events, speed: 1, out: &out, clock: test.clock, pos: test.pos}
+			p.seek(test.seek)
+			if out.String() != test.want {
+				t.Errorf("wrote %q, want %q", out.String(), test.want)
+			}
+			if p.pos != test.wantPos {
+				t.Errorf("pos %d, want %d", p.pos, test.wantPos)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// commandGate enforces a CommandPolicy on the command lines typed in a PTY
+// session, by the user or by an admin in control of it. The key submitting
+// each line is held back until the policy has decided on the line, as
+// reconstructed by a lineEditor. The key submitting a denied line is dropped,
+// leaving the line at the prompt for the user to edit or cancel: no keys are
+// sent to erase it, as which keys would depends on the shell's key bindings.
+//
+// Lines are only gated while the shell reads them at its prompt. With shell
+// integration, input while the shell runs a command, such as a password
+// typed at sudo's prompt, is passed straight on. Without it, or until the
+// shell has sent its first marker, every line is gated, except lines typed
+// with echo disabled, which are neither evaluated nor audited so passwords are
+// not recorded with the policy's decisions.
+//
+// The gate only follows keystrokes, so it is bypassed by input the shell does
+// not take as a command line, such as a script written with an editor or, with
+// shell integration, input typed ahead while a command runs, and by a shell
+// whose markers or echo the user has changed. Lines are reconstructed as
+// readline edits them with its default emacs key bindings, so the line
+// evaluated may not be the line run by a shell in vi mode, which cannot be
+// told apart. Lines edited in ways the lineEditor knows it cannot follow are a
+// best effort unless the policy denies them.
+type commandGate struct {
+	policy   *CommandPolicy
+	live     *liveSession
+	redactor *Redactor
+	echo     *echoRedactor
+	shell    *shellIntegration
+
+	// mu serializes the input of the user and of an admin in control of the
+	// session, which edit the same line.
+	mu     sync.Mutex
+	editor *lineEditor
+	// start marks the echoRedactor's input since the last line was submitted.
+	start uint64
+}
+
+// newCommandGate returns the gate for a PTY session, whose input is echo
+// redacted by echo and whose output is parsed by shell, or nil if the policy
+// is not enforced on interactive sessions.
+func (m *MITMAuditingSSHServerWithHTTP) newCommandGate(live *liveSession, echo *echoRedactor, shell *shellIntegration) *commandGate {
+	if m.policy == nil || !m.policy.cfg.EnforceInteractive {
+		return nil
+	}
+	return &commandGate{
+		policy:   m.policy,
+		live:     live,
+		redactor: m.redactor,
+		echo:     echo,
+		shell:    shell,
+		editor:   newLineEditor(),
+		start:    echo.mark(),
+	}
+}
+
+// forward passes input on to write, holding back each key submitting a
+// command line until the policy allows the line. A nil gate passes input
+// straight on.
+func (g *commandGate) forward(input []byte, write func([]byte) error) error {
+	if g == nil {
+		return write(input)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	start := 0
+	for i, b := range input {
+		line, ok := g.editor.submits(b)
+		if !ok {
+			g.editor.feed(input[i : i+1])
+			continue
+		}
+		if err := write(input[start:i]); err != nil {
+			return err
+		}
+		start = i + 1
+
+		if !g.allow(line) {
+			// The editor follows what the shell receives, which still
+			// has the line being edited.
+			continue
+		}
+		submit := input[i : i+1]
+		g.editor.feed(submit)
+		if err := write(submit); err != nil {
+			return err
+		}
+		g.start = g.echo.mark()
+	}
+	return write(input[start:])
+}
+
+// allow reports whether line may be submitted, waiting on an admin's approval
+// if the policy requires it. The user is told in their terminal why a line is
+// held or denied.
+func (g *commandGate) allow(line editedLine) bool {
+	if strings.TrimSpace(line.Command) == "" && !line.Uncertain {
+		return true
+	}
+	if g.shell.running() {
+		return true
+	}
+	if g.echo.redactedSince(g.start) {
+		return true
+	}
+	audited := g.redactor.Redact(line.Command)
+	if line.Uncertain && g.policy.cfg.DenyUncertain {
+		return g.policy.apply(g.live, PolicyDecision{
+			Action:  PolicyDeny,
+			Message: "the command line was edited in a way the proxy cannot follow",
+		}, audited, g.live.notice)
+	}
+	_, ok := g.policy.check(g.live, line.Command, audited, g.live.notice)
+	return ok
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	gliderssh "github.com/gliderlabs/ssh"
+)
+
+// gateTarget is a target handler acting as a shell, with OSC 133 markers
+// around its prompt and commands if markers is set. The command "sudo" asks
+// for a password with echo disabled, and "cat" echoes a line of input, both
+// running until the next line is typed. Ctrl+C discards the line.
+func gateTarget(markers bool) gliderssh.Handler {
+	return func(s gliderssh.Session) {
+		mark := func(m string) string {
+			if !markers {
+				return ""
+			}
+			return "\x1b]133;" + m + "\x07"
+		}
+		prompt := mark("A") + "$ " + mark("B")
+		io.WriteString(s, prompt)
+
+		var line []byte
+		running, echo := false, true
+		buf := make([]byte, 1024)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, b := range buf[:n] {
+				if b == 0x03 {
+					line = line[:0]
+					io.WriteString(s, "^C\r\n"+prompt)
+					continue
+				}
+				if b != '\r' {
+					line = append(line, b)
+					if echo {
+						s.Write([]byte{b})
+					}
+					continue
+				}
+				switch {
+				case running:
+					running, echo = false, true
+					io.WriteString(s, "\r\n"+mark("D;0")+prompt)
+				case string(line) == "exit":
+					s.Exit(0)
+					return
+				case string(line) == "sudo":
+					running, echo = true, false
+					io.WriteString(s, "\r\n"+mark("C")+"[sudo] password: ")
+				case string(line) == "cat":
+					running = true
+					io.WriteString(s, "\r\n"+mark("C")+"> ")
+				default:
+					io.WriteString(s, "\r\n"+mark("C")+mark("D;0")+prompt)
+				}
+				line = line[:0]
+			}
+		}
+	}
+}
+
+func TestCommandGate(t *testing.T) {
+	type step struct {
+		typed string
+		// wait is output waited for once typed, such as the next prompt
+		// once a running command has returned to it.
+		wait string
+	}
+	tests := []struct {
+		name          string
+		markers       bool
+		denyUncertain bool
+		steps         []step
+		want          []CommandPolicyEvent
+		wantDenied    bool
+	}{{
+		name:  "allowed",
+		steps: []step{{typed: "ls\r"}},
+		want:  []CommandPolicyEvent{{Command: "ls", Action: PolicyAllow}},
+	}, {
+		name:  "denied",
+		steps: []step{{typed: "rm -rf /\r"}, {typed: "\x03"}},
+		want: []CommandPolicyEvent{{Command: "rm -rf /", Action: PolicyDeny, Rule: "no-rm-root",
+			Reason: "recursive removal of / is not allowed"}},
+		wantDenied: true,
+	}, {
+		name:  "typed with echo disabled",
+		steps: []step{{typed: "sudo\r", wait: "password: "}, {typed: "rm -rf /\r"}},
+		want:  []CommandPolicyEvent{{Command: "sudo", Action: PolicyAllow}},
+	}, {
+		name:          "history expansion",
+		denyUncertain: true,
+		steps:         []step{{typed: "!!\r"}, {typed: "\x03"}},
+		want: []CommandPolicyEvent{{Command: "!!", Action: PolicyDeny,
+			Reason: "the command line was edited in a way the proxy cannot follow"}},
+		wantDenied: true,
+	}, {
+		name:          "continued on the next line",
+		denyUncertain: true,
+		steps:         []step{{typed: "rm -rf \\\r"}, {typed: "\x03"}},
+		want: []CommandPolicyEvent{{Command: "rm -rf \\", Action: PolicyDeny,
+			Reason: "the command line was edited in a way the proxy cannot follow"}},
+		wantDenied: true,
+	}, {
+		name:    "denied at the prompt",
+		markers: true,
+		steps:   []step{{typed: "rm -rf /\r"}, {typed: "\x03"}},
+		want: []CommandPolicyEvent{{Command: "rm -rf /", Action: PolicyDeny, Rule: "no-rm-root",
+			Reason: "recursive removal of / is not allowed"}},
+		wantDenied: true,
+	}, {
+		name:  "submitted within a UTF-8 character",
+		steps: []step{{typed: "rm -rf / \xc3\r"}, {typed: "\x03"}},
+		want: []CommandPolicyEvent{{Command: "rm -rf / \ufffd", Action: PolicyDeny, Rule: "no-rm-root",
+			Reason: "recursive removal of / is not allowed"}},
+		wantDenied: true,
+	}, {
+		name:  "submitted within an escape sequence",
+		steps: []step{{typed: "rm -rf /\x1b[\r"}, {typed: "\x03"}},
+		want: []CommandPolicyEvent{{Command: "rm -rf /", Action: PolicyDeny, Rule: "no-rm-root",
+			Reason: "recursive removal of / is not allowed"}},
+		wantDenied: true,
+	}, {
+		name:  "submitted within a bracketed paste",
+		steps: []step{{typed: "\x1b[200~rm -rf /\r"}, {typed: "\x1b[201~\x03"}},
+		want: []CommandPolicyEvent{{Command: "rm -rf /", Action: PolicyDeny, Rule: "no-rm-root",
+			Reason: "recursive removal of / is not allowed"}},
+		wantDenied: true,
+	}, {
+		name:          "uncertain when submitted within an escape sequence",
+		denyUncertain: true,
+		steps:         []step{{typed: "ls\x1b[\r"}, {typed: "\x03"}},
+		want: []CommandPolicyEvent{{Command: "ls", Action: PolicyDeny,
+			Reason: "the command line was edited in a way the proxy cannot follow"}},
+		wantDenied: true,
+	}, {
+		name:    "input to a running command",
+		markers: true,
+		steps:   []step{{typed: "cat\r", wait: "> "}, {typed: "rm -rf /\r", wait: "$ "}},
+		want:    []CommandPolicyEvent{{Command: "cat", Action: PolicyAllow}},
+	}, {
+		name:    "password to a running command",
+		markers: true,
+		steps:   []step{{typed: "sudo\r", wait: "password: "}, {typed: "rm -rf /\r", wait: "$ "}},
+		want:    []CommandPolicyEvent{{Command: "sudo", Action: PolicyAllow}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testPolicyConfig
+			cfg.EnforceInteractive = true
+			cfg.DenyUncertain = test.denyUncertain
+			policy, err := NewCommandPolicy(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink := &testSink{}
+			p := newTestProxy(t, sink, gateTarget(test.markers), WithCommandPolicy(policy),
+				WithShellIntegration(false), WithEchoTimeout(500*time.Millisecond))
+			defer p.close()
+			client := p.dial(t)
+			defer client.Close()
+			sess, stdin, out := startShell(t, client)
+			waitFor(t, func() bool { return strings.Contains(out.String(), "$ ") })
+
+			for _, step := range test.steps {
+				before := len(out.String())
+				io.WriteString(stdin, step.typed)
+				if step.wait != "" {
+					waitFor(t, func() bool { return strings.Contains(out.String()[before:], step.wait) })
+				}
+			}
+			io.WriteString(stdin, "exit\r")
+			if err := sess.Wait(); err != nil {
+				t.Fatalf("shell exited with %v", err)
+			}
+
+			waitFor(t, func() bool {
+				events := eventData[CommandPolicyEvent](sink)
+				return len(events) > 0 && events[len(events)-1].Command == "exit"
+			})
+			got := eventData[CommandPolicyEvent](sink)
+			got = got[:len(got)-1]
+			if len(got) != len(test.want) {
+				t.Fatalf("policy events %+v, want %+v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("policy event %d = %+v, want %+v", i, got[i], test.want[i])
+				}
+			}
+			if denied := strings.Contains(out.String(), "*** Command denied by policy"); denied != test.wantDenied {
+				t.Errorf("denied %v, want %v, output %q", denied, test.wantDenied, out.String())
+			}
+		})
+	}
+}
+
+func TestCommandGateAdminInput(t *testing.T) {
+	cfg := testPolicyConfig
+	cfg.EnforceInteractive = true
+	policy, err := NewCommandPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &testSink{}
+	p := newTestProxy(t, sink, echoTarget, WithAdminAPI(testAdmins), WithCommandPolicy(policy))
+	defer p.close()
+	shell := startWatchedShell(t, p)
+	defer shell.exit()
+
+	admin := dialAdminWebSocket(t, p, "/admin/sessions/"+shell.id+"/control", "alice-token")
+	admin.readUpdate(t)
+	waitFor(t, func() bool { return strings.Contains(shell.out.String(), "alice has taken control") })
+
+	// The admin's line is not submitted, as the user's would not be, and is
+	// left to be cancelled.
+	admin.write(t, wsBinary, "rm -rf /\r")
+	waitFor(t, func() bool {
+		return strings.Contains(shell.out.String(), "*** Command denied by policy: recursive removal of / is not allowed ***")
+	})
+	before := len(shell.out.String())
+	admin.write(t, wsBinary, "\x03")
+	waitFor(t, func() bool { return strings.Contains(shell.out.String()[before:], "\x03") })
+	if strings.Contains(shell.out.String(), "rm -rf /\r") {
+		t.Errorf("denied line submitted, output %q", shell.out.String())
+	}
+	events := eventData[CommandPolicyEvent](sink)
+	if len(events) != 2 || events[1].Command != "rm -rf /" || events[1].Action != PolicyDeny {
+		t.Errorf("policy events %+v, want ready allowed and rm denied", events)
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anmitsu/go-shlex"
+	gliderssh "github.com/gliderlabs/ssh"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// PolicyAction is what a CommandPolicy decides to do with a command.
+type PolicyAction string
+
+const (
+	// PolicyAllow runs the command.
+	PolicyAllow PolicyAction = "allow"
+	// PolicyDeny refuses to run the command.
+	PolicyDeny PolicyAction = "deny"
+	// PolicyApprove holds the command until an admin approves or rejects it
+	// through the admin API.
+	PolicyApprove PolicyAction = "approve"
+)
+
+// rank orders actions from the least to the most restrictive.
+func (a PolicyAction) rank() int {
+	switch a {
+	case PolicyAllow:
+		return 0
+	case PolicyApprove:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// PolicyRule decides the action for the commands it matches. A rule matches a
+// command when each of its conditions does, an empty condition matching every
+// command. Patterns are shell patterns, as matched by path.Match.
+type PolicyRule struct {
+	// Name identifies the rule in audit events.
+	Name   string       `json:"name"`
+	Action PolicyAction `json:"action"`
+
+	// Users and Targets match the session's user and target, the latter as
+	// a SinkFilter's Targets do, see matchTarget.
+	Users   []string `json:"users,omitempty"`
+	Targets []string `json:"targets,omitempty"`
+	// Programs match the command's program, either its full path or its
+	// base name.
+	Programs []string `json:"programs,omitempty"`
+	// Args must each match at least one of the command's arguments, in any
+	// order.
+	Args []string `json:"args,omitempty"`
+	// Hours is the time of day the rule applies, such as "09:00-17:00". A
+	// range ending before it starts spans midnight, such as "18:00-08:00".
+	Hours string `json:"hours,omitempty"`
+
+	// Message is shown to the user when the rule denies a command.
+	Message string `json:"message,omitempty"`
+}
+
+// CommandPolicyConfig configures a CommandPolicy.
+type CommandPolicyConfig struct {
+	// Rules are evaluated in order, the first rule matching a command
+	// deciding its action.
+	Rules []PolicyRule `json:"rules"`
+	// Default is the action for commands no rule matches.
+	Default PolicyAction `json:"default"`
+	// Unevaluable is the action for command lines the policy cannot
+	// evaluate, as they run a command substitution or a program named by an
+	// expansion, such as "$(echo rm) -rf /" or "$cmd". It is deny if empty.
+	Unevaluable PolicyAction `json:"unevaluable,omitempty"`
+	// TimeZone is the IANA time zone of the rules' Hours, the local time
+	// zone if empty.
+	TimeZone string `json:"time_zone,omitempty"`
+	// ApprovalTimeout is how long a command waits for an admin to approve
+	// it before it is denied, 0 waiting for as long as the session lasts.
+	ApprovalTimeout time.Duration `json:"-"`
+
+	// EnforceInteractive enforces the policy on the command lines typed in
+	// PTY sessions as well, see commandGate.
+	EnforceInteractive bool `json:"enforce_interactive,omitempty"`
+	// DenyUncertain denies interactive command lines edited in ways the
+	// proxy cannot follow, such as with tab completion or by recalling
+	// history from before the session, rather than evaluating them as best
+	// reconstructed.
+	DenyUncertain bool `json:"deny_uncertain,omitempty"`
+}
+
+// DefaultCommandPolicyConfig returns the command policy configuration used
+// when nothing else is configured, which allows every command.
+func DefaultCommandPolicyConfig() CommandPolicyConfig {
+	return CommandPolicyConfig{
+		Default:         PolicyAllow,
+		ApprovalTimeout: 5 * time.Minute,
+	}
+}
+
+// LoadCommandPolicyConfig loads a command policy configuration from a JSON
+// file holding a CommandPolicyConfig, with the ApprovalTimeout as a duration
+// string such as "5m". Fields the file leaves out keep their
+// DefaultCommandPolicyConfig values.
+func LoadCommandPolicyConfig(path string) (CommandPolicyConfig, error) {
+	cfg := DefaultCommandPolicyConfig()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	file := struct {
+		*CommandPolicyConfig
+		ApprovalTimeout string `json:"approval_timeout"`
+	}{CommandPolicyConfig: &cfg}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return cfg, fmt.Errorf("invalid command policy %s: %w", path, err)
+	}
+	if file.ApprovalTimeout != "" {
+		cfg.ApprovalTimeout, err = time.ParseDuration(file.ApprovalTimeout)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid command policy %s: approval_timeout: %w", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// CommandPolicy decides whether the commands of exec sessions, and optionally
+// the command lines typed in PTY sessions, may run, based on the session's
+// user and target, the command's arguments and the time of day.
+//
+// A command line is split into the simple commands the shell would run, at
+// unquoted ";", "&", "|", newlines, parentheses and backticks, and each is
+// evaluated on its own, the most restrictive action winning. Commands run
+// through a wrapper, such as "sudo rm" or "xargs rm", are evaluated both as
+// the wrapper and as the command it runs. Command lines running a command
+// substitution or a program named by an expansion are decided by Unevaluable,
+// as what they run is only known once they run, and so are command lines
+// running xargs, which adds arguments read from its input to its command. Commands
+// within quoted strings, such as the script of "sh -c", are not seen, so
+// policies which must not be bypassed should deny by default and allow known
+// commands.
+type CommandPolicy struct {
+	cfg      CommandPolicyConfig
+	rules    []policyRule
+	location *time.Location
+}
+
+// policyRule is a PolicyRule with its Hours parsed, as minutes since midnight.
+type policyRule struct {
+	PolicyRule
+	hours    bool
+	from, to int
+}
+
+// PolicyDecision is a CommandPolicy's decision on a command.
+type PolicyDecision struct {
+	Action PolicyAction
+	// Rule is the name of the rule which decided the action, empty if it
+	// is the policy's default.
+	Rule string
+	// Message explains a denial to the user.
+	Message string
+}
+
+var (
+	// errCommandDenied is returned for a session whose command the command
+	// policy denied.
+	errCommandDenied = errors.New("command denied by policy")
+	// errNoPendingApproval is returned when approving or rejecting the
+	// command of a session which is not waiting on approval.
+	errNoPendingApproval = errors.New("session has no command waiting on approval")
+)
+
+// commandDeniedExitCode is the exit status of a session whose command the
+// command policy denied, as a shell's for a command it cannot execute.
+const commandDeniedExitCode = 126
+
+// hoursPattern matches a PolicyRule's Hours.
+var hoursPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):([0-5][0-9])-([01][0-9]|2[0-3]):([0-5][0-9])$`)
+
+// assignmentPattern matches the variable assignments which may precede a
+// simple command's program.
+var assignmentPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// NewCommandPolicy returns a CommandPolicy enforcing cfg.
+func NewCommandPolicy(cfg CommandPolicyConfig) (*CommandPolicy, error) {
+	p := &CommandPolicy{cfg: cfg, location: time.Local}
+	if err := validPolicyAction(cfg.Default); err != nil {
+		return nil, fmt.Errorf("invalid default action: %w", err)
+	}
+	if p.cfg.Unevaluable == "" {
+		p.cfg.Unevaluable = PolicyDeny
+	}
+	if err := validPolicyAction(p.cfg.Unevaluable); err != nil {
+		return nil, fmt.Errorf("invalid unevaluable action: %w", err)
+	}
+	if cfg.TimeZone != "" {
+		loc, err := time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone: %w", err)
+		}
+		p.location = loc
+	}
+	for i, rule := range cfg.Rules {
+		r, err := compilePolicyRule(rule)
+		if err != nil {
+			name := rule.Name
+			if name == "" {
+				name = fmt.Sprint("#", i+1)
+			}
+			return nil, fmt.Errorf("invalid rule %s: %w", name, err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func validPolicyAction(a PolicyAction) error {
+	switch a {
+	case PolicyAllow, PolicyDeny, PolicyApprove:
+		return nil
+	}
+	return fmt.Errorf("unknown action %q", a)
+}
+
+func compilePolicyRule(rule PolicyRule) (policyRule, error) {
+	r := policyRule{PolicyRule: rule}
+	if err := validPolicyAction(rule.Action); err != nil {
+		return r, err
+	}
+	for _, patterns := range [][]string{rule.Users, rule.Targets, rule.Programs, rule.Args} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return r, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	if rule.Hours != "" {
+		m := hoursPattern.FindStringSubmatch(rule.Hours)
+		if m == nil {
+			return r, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", rule.Hours)
+		}
+		// Atoi, unlike Sscan, does not take "08" as an invalid octal number.
+		minutes := func(h, m string) int {
+			hour, _ := strconv.Atoi(h)
+			minute, _ := strconv.Atoi(m)
+			return hour*60 + minute
+		}
+		r.hours = true
+		r.from, r.to = minutes(m[1], m[2]), minutes(m[3], m[4])
+		if r.from == r.to {
+			return r, fmt.Errorf("invalid hours %q, the range is empty", rule.Hours)
+		}
+	}
+	return r, nil
+}
+
+// Evaluate decides the action for command, a shell command line run by user
+// on target at the time now.
+func (p *CommandPolicy) Evaluate(user, target, command string, now time.Time) PolicyDecision {
+	commands, unevaluable, err := splitCommands(command)
+	if err != nil {
+		return PolicyDecision{
+			Action:  PolicyDeny,
+			Message: "the command cannot be parsed: " + err.Error(),
+		}
+	}
+	decision := PolicyDecision{Action: p.cfg.Default}
+	for i, argv := range commands {
+		d := p.evaluate(user, target, argv, now)
+		if i == 0 || d.Action.rank() > decision.Action.rank() {
+			decision = d
+		}
+	}
+	if unevaluable && (len(commands) == 0 || p.cfg.Unevaluable.rank() > decision.Action.rank()) {
+		decision = PolicyDecision{
+			Action:  p.cfg.Unevaluable,
+			Message: "the command runs a command substitution or an expanded program, which cannot be evaluated",
+		}
+	}
+	return decision
+}
+
+// evaluate decides the action for a simple command.
+func (p *CommandPolicy) evaluate(user, target string, argv []string, now time.Time) PolicyDecision {
+	t := now.In(p.location)
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range p.rules {
+		if r.matches(user, target, argv, minute) {
+			return PolicyDecision{Action: r.Action, Rule: r.Name, Message: r.Message}
+		}
+	}
+	return PolicyDecision{Action: p.cfg.Default}
+}
+
+func (r *policyRule) matches(user, target string, argv []string, minute int) bool {
+	if !matchAny(r.Users, user) || !matchAnyTarget(r.Targets, target) {
+		return false
+	}
+	if len(r.Programs) > 0 && !matchAny(r.Programs, argv[0]) && !matchAny(r.Programs, path.Base(argv[0])) {
+		return false
+	}
+	for _, pattern := range r.Args {
+		if !anyMatch(pattern, argv[1:]) {
+			return false
+		}
+	}
+	if r.hours {
+		if r.from < r.to {
+			return minute >= r.from && minute < r.to
+		}
+		return minute >= r.from || minute < r.to
+	}
+	return true
+}
+
+// anyMatch reports whether any of values matches pattern.
+func anyMatch(pattern string, values []string) bool {
+	for _, v := range values {
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCommands splits a shell command line into the argv of each simple
+// command within it, dropping any reserved words and variable assignments
+// preceding the program. A command run through a wrapper, such as sudo, is
+// split into the wrapper's argv followed by the wrapped command's. It also
+// reports whether the line is unevaluable, running a command substitution or
+// a program or arguments which are only known once the command runs.
+func splitCommands(line string) (commands [][]string, unevaluable bool, err error) {
+	var segment strings.Builder
+	flush := func() error {
+		argv, err := shlex.Split(segment.String(), true)
+		segment.Reset()
+		if err != nil {
+			return err
+		}
+		for {
+			for len(argv) > 0 && (shellReservedWords[argv[0]] || assignmentPattern.MatchString(argv[0])) {
+				argv = argv[1:]
+			}
+			if len(argv) == 0 {
+				return nil
+			}
+			if strings.ContainsAny(argv[0], "$*?[") {
+				unevaluable = true
+			}
+			commands = append(commands, argv)
+			wrapper, ok := commandWrappers[path.Base(argv[0])]
+			if !ok {
+				return nil
+			}
+			if wrapper.readsArgs {
+				unevaluable = true
+			}
+			argv = wrapper.wrapped(argv[1:])
+		}
+	}
+
+	var quote rune
+	escaped := false
+	var prev rune
+	for _, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != '\'' && (r == '`' || r == '(' && prev == '$'):
+			// A command substitution, whose output the shell runs or
+			// passes on as arguments.
+			unevaluable = true
+			if quote == 0 {
+				if err := flush(); err != nil {
+					return nil, false, err
+				}
+				prev = r
+				continue
+			}
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case strings.ContainsRune(";&|\n()", r):
+			if err := flush(); err != nil {
+				return nil, false, err
+			}
+			prev = r
+			continue
+		}
+		segment.WriteRune(r)
+		prev = r
+	}
+	if err := flush(); err != nil {
+		return nil, false, err
+	}
+	return commands, unevaluable, nil
+}
+
+// shellReservedWords are the reserved words which may precede a simple
+// command's program, such as in "if true; then rm -rf /; fi" or
+// "{ rm -rf /; }".
+var shellReservedWords = map[string]bool{
+	"!": true, "{": true, "}": true, "if": true, "then": true, "elif": true, "else": true,
+	"fi": true, "while": true, "until": true, "do": true, "done": true,
+}
+
+// commandWrapper describes a program which runs the command given in its
+// arguments, after its own options.
+type commandWrapper struct {
+	// options are the short options which take an argument, and
+	// longOptions the long ones.
+	options     string
+	longOptions []string
+	// operands is the number of arguments between the options and the
+	// command, such as timeout's duration.
+	operands int
+	// readsArgs is set for wrappers adding arguments read from their input
+	// to the command, which makes the command line unevaluable.
+	readsArgs bool
+}
+
+// commandWrappers are the wrappers whose commands are evaluated, by name.
+var commandWrappers = map[string]commandWrapper{
+	"builtin": {},
+	"command": {},
+	"doas":    {options: "uC"},
+	"env":     {options: "uCS", longOptions: []string{"unset", "chdir", "split-string"}},
+	"exec":    {options: "a"},
+	"ionice":  {options: "cnp", longOptions: []string{"class", "classdata", "pid"}},
+	"nice":    {options: "n", longOptions: []string{"adjustment"}},
+	"nohup":   {},
+	"setsid":  {},
+	"stdbuf":  {options: "ioe", longOptions: []string{"input", "output", "error"}},
+	"sudo": {options: "CDghpRrTtUu", longOptions: []string{"close-from", "chdir", "group", "host", "prompt",
+		"chroot", "role", "type", "command-timeout", "other-user", "user"}},
+	"time":    {options: "fo", longOptions: []string{"format", "output"}},
+	"timeout": {options: "ks", longOptions: []string{"kill-after", "signal"}, operands: 1},
+	"xargs": {options: "adEILnPs", longOptions: []string{"arg-file", "delimiter", "max-args",
+		"max-procs", "max-chars", "process-slot-var"}, readsArgs: true},
+}
+
+// wrapped returns the command the wrapper runs, given the wrapper's arguments.
+// The string given to env's -S is split into arguments as env does.
+func (w commandWrapper) wrapped(args []string) []string {
+	var split []string
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			args = args[1:]
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		args = args[1:]
+		if name, ok := strings.CutPrefix(arg, "--"); ok {
+			name, value, hasValue := strings.Cut(name, "=")
+			if !slices.Contains(w.longOptions, name) {
+				continue
+			}
+			if !hasValue && len(args) > 0 {
+				value, args = args[0], args[1:]
+			}
+			if name == "split-string" {
+				split = append(split, value)
+			}
+			continue
+		}
+		for i := 1; i < len(arg); i++ {
+			if !strings.ContainsRune(w.options, rune(arg[i])) {
+				continue
+			}
+			// The rest of the argument is the option's value, or else
+			// the next argument is.
+			value := arg[i+1:]
+			if value == "" && len(args) > 0 {
+				value, args = args[0], args[1:]
+			}
+			if arg[i] == 'S' {
+				split = append(split, value)
+			}
+			break
+		}
+	}
+	args = args[min(w.operands, len(args)):]
+	var argv []string
+	for _, s := range split {
+		words, err := shlex.Split(s, true)
+		if err != nil {
+			words = []string{s}
+		}
+		argv = append(argv, words...)
+	}
+	return append(argv, args...)
+}
+
+// enforceCommandPolicy decides whether the command of s, an exec session, may
+// run, waiting on an admin's approval if the policy requires it. A denied
+// command is explained to the user, and errCommandDenied returned.
+func (m *MITMAuditingSSHServerWithHTTP) enforceCommandPolicy(ctx context.Context, s gliderssh.Session, live *liveSession) error {
+	if m.policy == nil {
+		return nil
+	}
+	// The command is evaluated as the target's shell is given it, rather
+	// than as the client sent it.
+	command := strings.Join(s.Command(), " ")
+	audited := strings.Join(live.details.ShellCommand, " ")
+	decision, ok := m.policy.check(live, command, audited, func(msg string) {
+		fmt.Fprintf(s.Stderr(), "ssh-proxy: %s\n", msg)
+	})
+	if ok {
+		return nil
+	}
+	zapctx.Info(ctx, "command denied by policy",
+		zap.String("rule", decision.Rule),
+		zap.String("reason", decision.Message),
+	)
+	return errCommandDenied
+}
+
+// check decides whether command may run within live, waiting on an admin's
+// approval if the policy requires it, and audits the decision with the
+// command as audited. The user is told with tell why a command is held or
+// denied. It returns the final decision, reporting whether it allows the
+// command.
+func (p *CommandPolicy) check(live *liveSession, command, audited string, tell func(string)) (PolicyDecision, bool) {
+	decision := p.Evaluate(live.details.User, live.details.Target, command, time.Now())
+	return decision, p.apply(live, decision, audited, tell)
+}
+
+// apply audits decision on the command as audited, and applies it.
+func (p *CommandPolicy) apply(live *liveSession, decision PolicyDecision, audited string, tell func(string)) bool {
+	live.audit.emit(live.details, CommandPolicyEvent{
+		Command: audited,
+		Action:  decision.Action,
+		Rule:    decision.Rule,
+		Reason:  decision.Message,
+	})
+
+	switch decision.Action {
+	case PolicyAllow:
+		return true
+	case PolicyApprove:
+		wait := "until an administrator approves it"
+		if p.cfg.ApprovalTimeout > 0 {
+			wait = fmt.Sprintf("up to %s for an administrator to approve it", p.cfg.ApprovalTimeout)
+		}
+		tell("This command requires approval, waiting " + wait)
+		d := live.awaitApproval(audited, decision.Rule, p.cfg.ApprovalTimeout)
+		action := PolicyDeny
+		if d.approved {
+			action = PolicyAllow
+		}
+		live.audit.emit(live.details, CommandPolicyEvent{
+			Command: audited,
+			Action:  action,
+			Rule:    decision.Rule,
+			Admin:   d.admin,
+			Reason:  d.reason,
+		})
+		if d.approved {
+			tell("Command approved by " + d.admin)
+			return true
+		}
+		decision.Message = "not approved"
+		if d.admin != "" {
+			decision.Message = "rejected by " + d.admin
+		}
+		if d.reason != "" {
+			decision.Message += ": " + d.reason
+		}
+	}
+
+	message := "Command denied by policy"
+	if decision.Message != "" {
+		message += ": " + decision.Message
+	}
+	tell(message)
+	return false
+}
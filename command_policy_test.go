@@ -0,0 +1,225 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPolicyConfig is the example policy of the README.
+var testPolicyConfig = CommandPolicyConfig{
+	Default:  PolicyAllow,
+	TimeZone: "Europe/London",
+	Rules: []PolicyRule{
+		{Name: "no-rm-root", Action: PolicyDeny, Programs: []string{"rm"}, Args: []string{"-*r*", "/"},
+			Message: "recursive removal of / is not allowed"},
+		{Name: "no-mkfs", Action: PolicyDeny, Programs: []string{"mkfs*"}},
+		{Name: "prod-restarts", Action: PolicyApprove, Targets: []string{"*prod*"}, Programs: []string{"systemctl"}, Args: []string{"restart"}},
+		{Name: "contractors-out-of-hours", Action: PolicyDeny, Users: []string{"contractor-*"}, Hours: "18:00-08:00"},
+	},
+}
+
+func TestCommandPolicyEvaluate(t *testing.T) {
+	policy, err := NewCommandPolicy(testPolicyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// noon is midday in London, in summer time.
+	noon := time.Date(2024, 7, 1, 11, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		user       string
+		target     string
+		command    string
+		now        time.Time
+		wantAction PolicyAction
+		wantRule   string
+	}{
+		{name: "no rule matches", command: "ls -la", wantAction: PolicyAllow},
+		{name: "empty command", command: "", wantAction: PolicyAllow},
+		{name: "program and args", command: "rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "args in any order", command: "rm / -fr", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "args not all matching", command: "rm -rf /tmp", wantAction: PolicyAllow},
+		{name: "program by path", command: "/bin/rm -r /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "program pattern", command: "mkfs.ext4 /dev/sda1", wantAction: PolicyDeny, wantRule: "no-mkfs"},
+		{name: "assignments before the program", command: "LANG=C FOO=1 rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "quoted args", command: `rm "-rf" '/'`, wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "after a semicolon", command: "ls; rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "in a pipeline", command: "cat /dev/zero | mkfs /dev/sda1", wantAction: PolicyDeny, wantRule: "no-mkfs"},
+		{name: "in a subshell", command: "(cd /tmp && mkfs /dev/sda1)", wantAction: PolicyDeny, wantRule: "no-mkfs"},
+		{name: "in backticks", command: "echo `mkfs /dev/sda1`", wantAction: PolicyDeny, wantRule: "no-mkfs"},
+		{name: "backticks", command: "echo `date`", wantAction: PolicyDeny},
+		{name: "program from a command substitution", command: "$(echo rm) -rf /", wantAction: PolicyDeny},
+		{name: "command substitution within double quotes", command: `echo "$(rm -rf /)"`, wantAction: PolicyDeny},
+		{name: "command substitution within single quotes", command: `echo '$(rm -rf /)'`, wantAction: PolicyAllow},
+		{name: "program from a variable", command: "x=rm; $x -rf /", wantAction: PolicyDeny},
+		{name: "program from a pattern", command: "/bin/r? -rf /", wantAction: PolicyDeny},
+		{name: "in braces", command: "{ rm -rf /; }", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "after reserved words", command: "if true; then rm -rf /; fi", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through sudo", command: "sudo rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through sudo with options", command: "sudo -E -u root -- rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through sudo with joined options", command: "sudo -Euroot rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through env", command: "env rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through env with assignments", command: "env -i PATH=/bin rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through env -S", command: "env -S 'rm -rf /'", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through command", command: "command rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through exec", command: "exec rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through nice", command: "nice -n 10 rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through timeout", command: "timeout --signal=KILL 10 rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through nested wrappers", command: "sudo nohup nice rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "through xargs", command: "echo / | xargs rm -rf", wantAction: PolicyDeny},
+		{name: "wrapper running an allowed command", command: "sudo systemctl status nginx", wantAction: PolicyAllow},
+		{name: "separator within quotes", command: `echo "a; mkfs /dev/sda1"`, wantAction: PolicyAllow},
+		{name: "escaped separator", command: `echo a\; mkfs /dev/sda1`, wantAction: PolicyAllow},
+		{name: "hidden in sh -c", command: `sh -c 'rm -rf /'`, wantAction: PolicyAllow},
+		{name: "unparseable", command: `echo "unterminated`, wantAction: PolicyDeny},
+		{name: "approval on a matching target", target: "/ssh?host=db-prod-1", command: "systemctl restart nginx", wantAction: PolicyApprove, wantRule: "prod-restarts"},
+		{name: "no approval on other targets", target: "/ssh?host=db-dev-1", command: "systemctl restart nginx", wantAction: PolicyAllow},
+		{name: "deny outranks approval", target: "/ssh?host=db-prod-1", command: "systemctl restart nginx && rm -rf /", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{name: "approval outranks allow", target: "/ssh?host=db-prod-1", command: "ls && systemctl restart nginx", wantAction: PolicyApprove, wantRule: "prod-restarts"},
+		{name: "within hours", user: "contractor-bob", command: "ls", now: noon.Add(7 * time.Hour), wantAction: PolicyDeny, wantRule: "contractors-out-of-hours"},
+		{name: "outside hours", user: "contractor-bob", command: "ls", wantAction: PolicyAllow},
+		{name: "hours spanning midnight", user: "contractor-bob", command: "ls", now: noon.Add(-5 * time.Hour), wantAction: PolicyDeny, wantRule: "contractors-out-of-hours"},
+		{name: "hours end exclusive", user: "contractor-bob", command: "ls", now: noon.Add(-4 * time.Hour), wantAction: PolicyAllow},
+		{name: "hours in the policy's time zone", user: "contractor-bob", command: "ls", now: time.Date(2024, 7, 1, 17, 30, 0, 0, time.UTC), wantAction: PolicyDeny, wantRule: "contractors-out-of-hours"},
+		{name: "user not matching", user: "alice", command: "ls", now: noon.Add(7 * time.Hour), wantAction: PolicyAllow},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := test.now
+			if now.IsZero() {
+				now = noon
+			}
+			d := policy.Evaluate(test.user, test.target, test.command, now)
+			if d.Action != test.wantAction || d.Rule != test.wantRule {
+				t.Errorf("Evaluate() = %s by %q, want %s by %q", d.Action, d.Rule, test.wantAction, test.wantRule)
+			}
+		})
+	}
+}
+
+func TestCommandPolicyEvaluateMessage(t *testing.T) {
+	policy, err := NewCommandPolicy(testPolicyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := policy.Evaluate("alice", "", "rm -rf /", time.Now()); d.Message != "recursive removal of / is not allowed" {
+		t.Errorf("Message = %q, want the rule's", d.Message)
+	}
+	if d := policy.Evaluate("alice", "", `echo "unterminated`, time.Now()); !strings.HasPrefix(d.Message, "the command cannot be parsed: ") {
+		t.Errorf("Message = %q, want the command not parsed", d.Message)
+	}
+}
+
+func TestCommandPolicyUnevaluable(t *testing.T) {
+	cfg := testPolicyConfig
+	cfg.Unevaluable = PolicyApprove
+	policy, err := NewCommandPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		command    string
+		wantAction PolicyAction
+		wantRule   string
+	}{
+		{command: "$(echo rm) -rf /", wantAction: PolicyApprove},
+		// A rule outranking Unevaluable decides.
+		{command: "rm -rf / $(date)", wantAction: PolicyDeny, wantRule: "no-rm-root"},
+		{command: "ls", wantAction: PolicyAllow},
+	}
+	for _, test := range tests {
+		d := policy.Evaluate("alice", "/ssh", test.command, time.Now())
+		if d.Action != test.wantAction || d.Rule != test.wantRule {
+			t.Errorf("Evaluate(%q) = %s by %q, want %s by %q", test.command, d.Action, d.Rule, test.wantAction, test.wantRule)
+		}
+	}
+}
+
+func TestNewCommandPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     CommandPolicyConfig
+		wantErr string
+	}{
+		{name: "default", cfg: DefaultCommandPolicyConfig()},
+		{name: "no default action", cfg: CommandPolicyConfig{}, wantErr: `invalid default action: unknown action ""`},
+		{name: "unknown time zone", cfg: CommandPolicyConfig{Default: PolicyDeny, TimeZone: "Mars/Olympus"}, wantErr: "invalid time zone"},
+		{name: "unknown rule action", cfg: CommandPolicyConfig{Default: PolicyDeny, Rules: []PolicyRule{{Name: "r", Action: "block"}}},
+			wantErr: `invalid rule r: unknown action "block"`},
+		{name: "unknown unevaluable action", cfg: CommandPolicyConfig{Default: PolicyAllow, Unevaluable: "block"},
+			wantErr: `invalid unevaluable action: unknown action "block"`},
+		{name: "invalid pattern", cfg: CommandPolicyConfig{Default: PolicyDeny, Rules: []PolicyRule{{Action: PolicyAllow, Programs: []string{"[ls"}}}},
+			wantErr: `invalid rule #1: invalid pattern "[ls"`},
+		{name: "invalid hours", cfg: CommandPolicyConfig{Default: PolicyDeny, Rules: []PolicyRule{{Action: PolicyAllow, Hours: "9-17"}}},
+			wantErr: `invalid hours "9-17"`},
+		{name: "empty hours", cfg: CommandPolicyConfig{Default: PolicyDeny, Rules: []PolicyRule{{Action: PolicyAllow, Hours: "09:00-09:00"}}},
+			wantErr: "the range is empty"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewCommandPolicy(test.cfg)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("NewCommandPolicy() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("NewCommandPolicy() = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadCommandPolicyConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    func(cfg CommandPolicyConfig) bool
+		wantErr string
+	}{{
+		name: "defaults kept",
+		file: `{"rules": [{"name": "r", "action": "deny", "programs": ["rm"]}]}`,
+		want: func(cfg CommandPolicyConfig) bool {
+			return cfg.Default == PolicyAllow && cfg.ApprovalTimeout == 5*time.Minute && len(cfg.Rules) == 1
+		},
+	}, {
+		name: "approval timeout",
+		file: `{"default": "deny", "approval_timeout": "90s", "enforce_interactive": true}`,
+		want: func(cfg CommandPolicyConfig) bool {
+			return cfg.Default == PolicyDeny && cfg.ApprovalTimeout == 90*time.Second && cfg.EnforceInteractive
+		},
+	}, {
+		name:    "unknown field",
+		file:    `{"defualt": "deny"}`,
+		wantErr: `unknown field "defualt"`,
+	}, {
+		name:    "invalid approval timeout",
+		file:    `{"approval_timeout": "soon"}`,
+		wantErr: "approval_timeout",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.json")
+			if err := os.WriteFile(path, []byte(test.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadCommandPolicyConfig(path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("LoadCommandPolicyConfig() = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.want(cfg) {
+				t.Errorf("LoadCommandPolicyConfig() = %+v", cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// redactedMarker replaces input typed while the target had echo disabled.
+const redactedMarker = "[REDACTED]"
+
+// DefaultEchoTimeout is how long typed characters may take to be echoed back
+// by the target before they are treated as typed with echo disabled, unless
+// set with WithEchoTimeout.
+const DefaultEchoTimeout = time.Second
+
+// maxEchoBacklog bounds the output kept while waiting for input to be echoed.
+const maxEchoBacklog = 4096
+
+// echoRedactor sits between the client's input and the audit logger,
+// redacting input the target did not echo back, such as passwords typed at
+// sudo or database prompts.
+//
+// Input is held until the target echoes its printable characters, or until
+// the echo timeout passes without them being echoed, and is then released in order.
+// As full screen programs such as editors do not echo keystrokes literally,
+// input to them is redacted as well.
+type echoRedactor struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	timeout    time.Duration
+	emit       func([]byte)
+	maxPending int
+	done       chan struct{}
+
+	// pending is input not yet released, in the order it was typed.
+	pending []*pendingInput
+	// released is input ready to be emitted.
+	released [][]byte
+	// redacting is set while consecutive input is being redacted, so a run
+	// of no-echo input is replaced by a single marker.
+	redacting bool
+
+	// seq numbers the input taken, and lastRedacted is one more than the
+	// number of the last input redacted, 0 if none has been.
+	seq          uint64
+	lastRedacted uint64
+
+	// backlog holds printable output not yet matched as echo.
+	backlog []echoedByte
+	escape  int
+
+	closed bool
+}
+
+type pendingInput struct {
+	seq       uint64
+	data      []byte
+	printable []byte
+	typed     time.Time
+	resolved  bool
+	redact    bool
+	timer     *time.Timer
+}
+
+type echoedByte struct {
+	b byte
+	t time.Time
+}
+
+// newEchoRedactor returns an echoRedactor emitting released input to emit,
+// which is called from a single goroutine and may block. Input not echoed
+// within timeout is redacted. Once maxPending chunks of input are held, input
+// blocks until emit catches up.
+func newEchoRedactor(emit func([]byte), maxPending int, timeout time.Duration) *echoRedactor {
+	r := &echoRedactor{
+		timeout:    timeout,
+		emit:       emit,
+		maxPending: maxPending,
+		done:       make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	go r.run()
+	return r
+}
+
+// run emits released input until the redactor is closed and drained.
+func (r *echoRedactor) run() {
+	defer close(r.done)
+	r.mu.Lock()
+	for {
+		for len(r.released) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if len(r.released) == 0 {
+			r.mu.Unlock()
+			return
+		}
+		p := r.released[0]
+		r.released = r.released[1:]
+		r.cond.Broadcast()
+		r.mu.Unlock()
+		r.emit(p)
+		r.mu.Lock()
+	}
+}
+
+// input takes a chunk of input from the client, p is not retained.
+func (r *echoRedactor) input(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.pending)+len(r.released) >= r.maxPending && !r.closed {
+		r.cond.Wait()
+	}
+	if r.closed {
+		return
+	}
+
+	in := &pendingInput{
+		seq:       r.seq,
+		data:      append([]byte(nil), p...),
+		printable: printableInput(p),
+		typed:     time.Now(),
+	}
+	if len(in.printable) == 0 {
+		// Nothing to be echoed, it only has to wait for the input before it.
+		in.resolved = true
+	} else {
+		in.timer = time.AfterFunc(r.timeout, func() { r.expire(in) })
+	}
+	r.seq++
+	r.pending = append(r.pending, in)
+	r.match()
+	r.release()
+}
+
+// expire redacts in if it has not been echoed by now.
+func (r *echoRedactor) expire(in *pendingInput) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if in.resolved {
+		return
+	}
+	// Timers can fire out of order, so the input typed before in, which
+	// has timed out as well, is redacted first: it holds up matching, and in
+	// may yet have been echoed.
+	for _, prev := range r.pending {
+		if prev == in {
+			break
+		}
+		if !prev.resolved {
+			prev.resolved = true
+			prev.redact = true
+			prev.timer.Stop()
+		}
+	}
+	r.match()
+	if !in.resolved {
+		in.resolved = true
+		in.redact = true
+		r.match()
+	}
+	r.release()
+}
+
+// output takes output from the target, looking for echoed input.
+func (r *echoRedactor) output(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	now := time.Now()
+	for _, b := range p {
+		switch r.escape {
+		case oscGround:
+			switch {
+			case b == 0x1b:
+				r.escape = oscEscape
+			case b >= 0x20 && b != 0x7f && len(r.pending) > 0:
+				r.backlog = append(r.backlog, echoedByte{b: b, t: now})
+			}
+		case oscEscape:
+			switch b {
+			case '[':
+				r.escape = oscCSI
+			case ']':
+				r.escape = oscString
+			default:
+				r.escape = oscGround
+			}
+		case oscCSI:
+			if b >= 0x40 && b <= 0x7e {
+				r.escape = oscGround
+			}
+		case oscString:
+			switch b {
+			case 0x07:
+				r.escape = oscGround
+			case 0x1b:
+				r.escape = oscStringEscape
+			}
+		case oscStringEscape:
+			r.escape = oscGround
+		}
+	}
+	if len(r.backlog) > maxEchoBacklog {
+		r.backlog = r.backlog[len(r.backlog)-maxEchoBacklog:]
+	}
+	r.match()
+	r.release()
+}
+
+// match resolves the oldest unresolved input as echoed if its printable
+// characters appear contiguously in the output since it was typed. Output
+// matched as echo is consumed, so the same output cannot be matched twice.
+func (r *echoRedactor) match() {
+	for _, in := range r.pending {
+		if in.resolved {
+			continue
+		}
+
+		start := 0
+		for start < len(r.backlog) && r.backlog[start].t.Before(in.typed) {
+			start++
+		}
+		r.backlog = r.backlog[start:]
+
+		end := -1
+		for i := 0; i+len(in.printable) <= len(r.backlog); i++ {
+			j := 0
+			for j < len(in.printable) && r.backlog[i+j].b == in.printable[j] {
+				j++
+			}
+			if j == len(in.printable) {
+				end = i + j
+				break
+			}
+		}
+		if end < 0 {
+			return
+		}
+		r.backlog = r.backlog[end:]
+		in.resolved = true
+		in.timer.Stop()
+	}
+}
+
+// release moves resolved input at the front of pending to released.
+func (r *echoRedactor) release() {
+	n := 0
+	for _, in := range r.pending {
+		if !in.resolved {
+			break
+		}
+		if in.redact {
+			r.lastRedacted = in.seq + 1
+		}
+		r.released = append(r.released, r.redact(in))
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	r.pending = r.pending[n:]
+	if len(r.pending) == 0 {
+		r.backlog = r.backlog[:0]
+	}
+	r.cond.Broadcast()
+}
+
+// redact returns the input as it should be audited.
+func (r *echoRedactor) redact(in *pendingInput) []byte {
+	switch {
+	case in.redact:
+		out := []byte{}
+		if !r.redacting {
+			out = append(out, redactedMarker...)
+			r.redacting = true
+		}
+		return append(out, r.keptControls(in.data)...)
+	case len(in.printable) == 0 && r.redacting:
+		return r.keptControls(in.data)
+	default:
+		r.redacting = false
+		return in.data
+	}
+}
+
+// keptControls returns the controls within redacted input that are kept, so
+// that the input's lines are still submitted or cancelled. Submitting or
+// cancelling a line ends a run of redacted input.
+func (r *echoRedactor) keptControls(p []byte) []byte {
+	var out []byte
+	for _, b := range p {
+		switch b {
+		case '\r', '\n', 0x03, 0x04:
+			out = append(out, b)
+			r.redacting = false
+		}
+	}
+	return out
+}
+
+// mark returns a mark for the input taken from now on, see redactedSince.
+func (r *echoRedactor) mark() uint64 {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seq
+}
+
+// redactedSince waits for the input taken so far to be echoed or time out,
+// and reports whether any input taken since mark was redacted as typed with
+// echo disabled. A nil echoRedactor reports false.
+func (r *echoRedactor) redactedSince(mark uint64) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.pending) > 0 && !r.closed {
+		r.cond.Wait()
+	}
+	return r.lastRedacted > mark
+}
+
+// close releases any remaining input, redacting input that has not been
+// echoed, and waits for it all to be emitted.
+func (r *echoRedactor) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		<-r.done
+		return
+	}
+	for _, in := range r.pending {
+		if !in.resolved {
+			in.resolved = true
+			in.redact = true
+			in.timer.Stop()
+		}
+	}
+	r.release()
+	r.closed = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	<-r.done
+}
+
+// writer returns a writer that writes to dst, watching what was written for echoed input.
+func (r *echoRedactor) writer(dst io.Writer) io.Writer {
+	if r == nil {
+		return dst
+	}
+	return &echoWriter{redactor: r, dst: dst}
+}
+
+type echoWriter struct {
+	redactor *echoRedactor
+	dst      io.Writer
+}
+
+func (w *echoWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	w.redactor.output(p[:n])
+	return n, err
+}
+
+// printableInput returns the characters in p expected to be echoed back,
+// skipping control characters and the escape sequences sent by special keys.
+func printableInput(p []byte) []byte {
+	var out []byte
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		switch {
+		case b == 0x1b:
+			if i+1 < len(p) && (p[i+1] == '[' || p[i+1] == 'O') {
+				i += 2
+				for i < len(p) && (p[i] < 0x40 || p[i] > 0x7e) {
+					i++
+				}
+			} else {
+				i++
+			}
+		case b >= 0x20 && b != 0x7f:
+			out = append(out, b)
+		}
+	}
+	return out
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestEchoRedactor(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	type step struct {
+		input, output string
+		wait          bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  string
+	}{{
+		name:  "echoed",
+		steps: []step{{input: "ls"}, {output: "ls"}, {input: "\r"}},
+		want:  "ls\r",
+	}, {
+		name:  "echoed with colours",
+		steps: []step{{input: "l"}, {output: "\x1b[1ml\x1b[0m"}, {input: "s"}, {output: "s"}},
+		want:  "ls",
+	}, {
+		name:  "echoed before later input",
+		steps: []step{{input: "a"}, {input: "b"}, {output: "ab"}},
+		want:  "ab",
+	}, {
+		name:  "not echoed",
+		steps: []step{{input: "hunter2"}, {wait: true}, {input: "\r"}},
+		want:  redactedMarker + "\r",
+	}, {
+		name:  "a run of input is redacted once",
+		steps: []step{{input: "h"}, {input: "u"}, {input: "n"}, {wait: true}, {input: "\r"}},
+		want:  redactedMarker + "\r",
+	}, {
+		name:  "submitting ends a run",
+		steps: []step{{input: "a\r"}, {wait: true}, {input: "b\r"}, {wait: true}},
+		want:  redactedMarker + "\r" + redactedMarker + "\r",
+	}, {
+		name:  "echo resumes after a password",
+		steps: []step{{input: "secret"}, {wait: true}, {input: "\r"}, {input: "id"}, {output: "id"}},
+		want:  redactedMarker + "\rid",
+	}, {
+		name:  "echo from before the input is not matched",
+		steps: []step{{output: "pw"}, {input: "pw"}, {wait: true}},
+		want:  redactedMarker,
+	}, {
+		name:  "control input needs no echo",
+		steps: []step{{input: "\x03"}, {input: "\x1b[A"}},
+		want:  "\x03\x1b[A",
+	}, {
+		name:  "pending input is redacted on close",
+		steps: []step{{input: "pw"}},
+		want:  redactedMarker,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got bytes.Buffer
+			r := newEchoRedactor(func(p []byte) { got.Write(p) }, 64, timeout)
+			for _, s := range test.steps {
+				switch {
+				case s.input != "":
+					r.input([]byte(s.input))
+				case s.output != "":
+					if _, err := r.writer(io.Discard).Write([]byte(s.output)); err != nil {
+						t.Fatal(err)
+					}
+				case s.wait:
+					time.Sleep(3 * timeout)
+				}
+			}
+			r.close()
+			if got.String() != test.want {
+				t.Errorf("got %q, want %q", got.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestEchoRedactorTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    string
+	}{
+		{"echoed within the timeout", time.Minute, "slow"},
+		{"echoed after the timeout", time.Millisecond, redactedMarker},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got bytes.Buffer
+			r := newEchoRedactor(func(p []byte) { got.Write(p) }, 64, test.timeout)
+			r.input([]byte("slow"))
+			time.Sleep(20 * time.Millisecond)
+			r.writer(io.Discard).Write([]byte("slow"))
+			r.close()
+			if got.String() != test.want {
+				t.Errorf("got %q, want %q", got.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestEchoRedactorTimeoutOrder(t *testing.T) {
+	var got bytes.Buffer
+	r := newEchoRedactor(func(p []byte) { got.Write(p) }, 64, time.Minute)
+	r.input([]byte("hunter2"))
+	r.input([]byte("ls"))
+	r.writer(io.Discard).Write([]byte("ls"))
+
+	// The later input's timer fires first, the echoed input is not
+	// redacted with the input typed before it.
+	r.mu.Lock()
+	later := r.pending[1]
+	r.mu.Unlock()
+	r.expire(later)
+	r.close()
+	if want := redactedMarker + "ls"; got.String() != want {
+		t.Errorf("got %q, want %q", got.String(), want)
+	}
+}
+
+func TestEchoRedactorRedactedSince(t *testing.T) {
+	r := newEchoRedactor(func([]byte) {}, 64, 20*time.Millisecond)
+	defer r.close()
+	w := r.writer(io.Discard)
+
+	mark := r.mark()
+	r.input([]byte("ls"))
+	w.Write([]byte("ls"))
+	if r.redactedSince(mark) {
+		t.Error("echoed input reported as redacted")
+	}
+
+	mark = r.mark()
+	r.input([]byte("hunter2"))
+	if !r.redactedSince(mark) {
+		t.Error("input not echoed reported as echoed")
+	}
+
+	// Input redacted before the mark is not reported.
+	mark = r.mark()
+	r.input([]byte("\r"))
+	if r.redactedSince(mark) {
+		t.Error("input redacted before the mark reported")
+	}
+}
+
+func TestEchoRedactorNil(t *testing.T) {
+	var r *echoRedactor
+	var dst bytes.Buffer
+	if w := r.writer(&dst); w != &dst {
+		t.Errorf("nil echo redactor wrapped its writer")
+	}
+	r.close()
+}
+
+func TestPrintableInput(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"ls -l\r", "ls -l"},
+		{"\x1b[A\x1b[1;5C", ""},
+		{"a\x1bOPb", "ab"},
+		{"\x1bf", ""},
+		{"x\x7f\x03", "x"},
+		{"café", "café"},
+	}
+	for _, test := range tests {
+		if got := string(printableInput([]byte(test.in))); got != test.want {
+			t.Errorf("printableInput(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
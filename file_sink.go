@@ -0,0 +1,337 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// rotatedTimeFormat is the time of rotation in a rotated file's name.
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// FileSinkConfig configures a FileSink.
+type FileSinkConfig struct {
+	// Path is the file events are written to. Rotated files are renamed
+	// alongside it with the time of rotation added to their name, such as
+	// audit-20240101T120000.000000000.jsonl for audit.jsonl.
+	Path string
+
+	// SyncInterval is how often written events are fsynced to disk. When 0,
+	// every event is fsynced as it is written.
+	SyncInterval time.Duration
+
+	// MaxSize is the size in bytes the file is rotated at, 0 never rotates
+	// the file by size.
+	MaxSize int64
+
+	// MaxAge is how long the file is written to before it is rotated, 0 never
+	// rotates the file by age.
+	MaxAge time.Duration
+
+	// Compress gzips rotated files.
+	Compress bool
+
+	// Retention is how long rotated files are kept before they are deleted, 0
+	// keeps them forever.
+	Retention time.Duration
+
+	// Encoder encodes each line, JSON when nil. Only JSON logs can be
+	// checked by cmd/auditverify.
+	Encoder EventEncoder
+}
+
+// DefaultFileSinkConfig returns the file sink configuration for path used when
+// nothing else is configured.
+func DefaultFileSinkConfig(path string) FileSinkConfig {
+	return FileSinkConfig{
+		Path:         path,
+		SyncInterval: time.Second,
+		MaxSize:      100 << 20,
+		MaxAge:       24 * time.Hour,
+		Compress:     true,
+		Retention:    90 * 24 * time.Hour,
+	}
+}
+
+// FileSink is an EventSink writing each event as a line of compact JSON
+// (JSON Lines), or as encoded by its Encoder, to a file, rotating it by size
+// and age. It is safe for use by concurrent sessions.
+type FileSink struct {
+	cfg FileSinkConfig
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	dirty  bool
+	closed bool
+
+	stop chan struct{}
+	// rotations tracks the compression and pruning of rotated files.
+	rotations sync.WaitGroup
+}
+
+// NewFileSink returns a FileSink, creating or appending to the file at
+// cfg.Path.
+func NewFileSink(cfg FileSinkConfig) (*FileSink, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("file sink path is empty")
+	}
+	s := &FileSink{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.prune()
+	if cfg.SyncInterval > 0 {
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+// open opens the file at the configured path for appending.
+func (s *FileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.cfg.Path), 0o700); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(s.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	s.f = f
+	s.size = info.Size()
+	s.opened = time.Now()
+	if s.size > 0 {
+		// An existing file has been written to since it was created.
+		s.opened = info.ModTime()
+	}
+	return nil
+}
+
+// HandleEvent implements EventSink.
+func (s *FileSink) HandleEvent(e Event) {
+	if err := s.write([]Event{e}, s.cfg.SyncInterval <= 0); err != nil {
+		zapctx.Error(context.TODO(), "failed to write audit event", zap.Error(err))
+	}
+}
+
+// DeliverEvents implements EventDeliverer, returning once the events are
+// fsynced to disk.
+func (s *FileSink) DeliverEvents(events []Event) error {
+	return s.write(events, true)
+}
+
+// write writes events, fsyncing them if fsync is set.
+func (s *FileSink) write(events []Event, fsync bool) error {
+	var lines []byte
+	for _, e := range events {
+		line, err := encodeEvent(s.cfg.Encoder, e)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit event: %w", err)
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("file sink closed")
+	}
+	if s.shouldRotate(int64(len(lines))) {
+		if err := s.rotate(); err != nil {
+			zapctx.Error(context.TODO(), "failed to rotate audit log", zap.Error(err))
+		}
+	}
+
+	n, err := s.f.Write(lines)
+	s.size += int64(n)
+	s.dirty = true
+	if err != nil {
+		return err
+	}
+	if fsync {
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+		s.dirty = false
+	}
+	return nil
+}
+
+// shouldRotate reports whether the file must be rotated before n more bytes
+// are written to it.
+func (s *FileSink) shouldRotate(n int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.cfg.MaxSize > 0 && s.size+n > s.cfg.MaxSize {
+		return true
+	}
+	return s.cfg.MaxAge > 0 && time.Since(s.opened) >= s.cfg.MaxAge
+}
+
+// rotate renames the current file aside and opens a new one in its place.
+// Rotated files are compressed and old ones pruned in the background.
+func (s *FileSink) rotate() error {
+	s.syncLocked()
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(s.cfg.Path)
+	rotated := strings.TrimSuffix(s.cfg.Path, ext) + "-" + time.Now().UTC().Format(rotatedTimeFormat) + ext
+	renameErr := os.Rename(s.cfg.Path, rotated)
+	if err := s.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	s.rotations.Add(1)
+	go func() {
+		defer s.rotations.Done()
+		if s.cfg.Compress {
+			if err := compressFile(rotated); err != nil {
+				zapctx.Error(context.TODO(), "failed to compress audit log", zap.String("path", rotated), zap.Error(err))
+			}
+		}
+		s.prune()
+	}()
+	return nil
+}
+
+// compressFile gzips the file at path to path.gz, removing the original.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune deletes rotated files last written to before the retention window.
+func (s *FileSink) prune() {
+	if s.cfg.Retention <= 0 {
+		return
+	}
+	dir := filepath.Dir(s.cfg.Path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		zapctx.Error(context.TODO(), "failed to list audit logs", zap.Error(err))
+		return
+	}
+	cutoff := time.Now().Add(-s.cfg.Retention)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !s.rotated(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			zapctx.Error(context.TODO(), "failed to delete expired audit log", zap.String("name", name), zap.Error(err))
+		}
+	}
+}
+
+// rotated reports whether name is the name of a file rotated by the sink,
+// compressed or not, so files it did not write are never pruned.
+func (s *FileSink) rotated(name string) bool {
+	ext := filepath.Ext(s.cfg.Path)
+	prefix := filepath.Base(strings.TrimSuffix(s.cfg.Path, ext)) + "-"
+	stamp, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return false
+	}
+	stamp = strings.TrimSuffix(stamp, ".gz")
+	stamp, ok = strings.CutSuffix(stamp, ext)
+	if !ok {
+		return false
+	}
+	_, err := time.Parse(rotatedTimeFormat, stamp)
+	return err == nil
+}
+
+// syncLoop fsyncs written events every SyncInterval until the sink is closed.
+func (s *FileSink) syncLoop() {
+	ticker := time.NewTicker(s.cfg.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.syncLocked()
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *FileSink) syncLocked() {
+	if !s.dirty {
+		return
+	}
+	if err := s.f.Sync(); err != nil {
+		zapctx.Error(context.TODO(), "failed to sync audit log", zap.Error(err))
+		return
+	}
+	s.dirty = false
+}
+
+// Close syncs and closes the file, waiting for rotated files to be compressed.
+// Events handled after Close are dropped.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.syncLocked()
+	err := s.f.Close()
+	s.mu.Unlock()
+
+	s.rotations.Wait()
+	return err
+}
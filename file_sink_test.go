@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEventLines reads the events written to a JSON Lines file, gzipped or not.
+func readEventLines(t *testing.T, path string) []Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// testEvent returns an input event, encoded to the same size for any seq
+// below 10.
+func testEvent(seq uint64) Event {
+	return Event{
+		Version:  EventVersion,
+		Sequence: seq,
+		Type:     EventInput,
+		Time:     time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Session:  SessionDetails{SessionID: "abc"},
+		Data:     InputEvent{Data: strings.Repeat("x", 50)},
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       FileSinkConfig
+		events    int
+		pause     time.Duration
+		wantFiles int
+		wantExt   string
+	}{{
+		name:      "no rotation",
+		cfg:       FileSinkConfig{},
+		events:    10,
+		wantFiles: 1,
+	}, {
+		name:      "by size",
+		cfg:       FileSinkConfig{MaxSize: 900},
+		events:    10,
+		wantFiles: 4,
+		wantExt:   ".jsonl",
+	}, {
+		name:      "by size compressed",
+		cfg:       FileSinkConfig{MaxSize: 900, Compress: true},
+		events:    10,
+		wantFiles: 4,
+		wantExt:   ".jsonl.gz",
+	}, {
+		name:      "by age",
+		cfg:       FileSinkConfig{MaxAge: 20 * time.Millisecond},
+		events:    3,
+		pause:     30 * time.Millisecond,
+		wantFiles: 3,
+		wantExt:   ".jsonl",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := test.cfg
+			cfg.Path = filepath.Join(dir, "audit.jsonl")
+			sink, err := NewFileSink(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= test.events; i++ {
+				sink.HandleEvent(testEvent(uint64(i)))
+				time.Sleep(test.pause)
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != test.wantFiles {
+				t.Fatalf("got %d files, want %d", len(entries), test.wantFiles)
+			}
+			// Rotated files sort by rotation time, oldest first, and
+			// together with the current file hold every event in order.
+			var rotated []string
+			for _, entry := range entries {
+				if entry.Name() == "audit.jsonl" {
+					continue
+				}
+				if !strings.HasPrefix(entry.Name(), "audit-") || !strings.HasSuffix(entry.Name(), test.wantExt) {
+					t.Errorf("unexpected rotated file %s", entry.Name())
+				}
+				rotated = append(rotated, filepath.Join(dir, entry.Name()))
+			}
+			sort.Strings(rotated)
+			var events []Event
+			for _, path := range append(rotated, cfg.Path) {
+				fileEvents := readEventLines(t, path)
+				if len(fileEvents) == 0 {
+					t.Errorf("%s is empty", path)
+				}
+				events = append(events, fileEvents...)
+			}
+			if len(events) != test.events {
+				t.Fatalf("got %d events, want %d", len(events), test.events)
+			}
+			for i, e := range events {
+				if e.Sequence != uint64(i+1) {
+					t.Errorf("event %d has sequence %d", i, e.Sequence)
+				}
+			}
+			if cfg.MaxSize > 0 {
+				for _, path := range rotated {
+					if info, err := os.Stat(path); err == nil && !cfg.Compress && info.Size() > cfg.MaxSize {
+						t.Errorf("%s is %d bytes, over MaxSize", path, info.Size())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFileSinkRetention(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	files := map[string]struct{ old, kept bool }{
+		"audit-20240101T000000.000000000.jsonl":    {old: true},
+		"audit-20240101T000001.000000000.jsonl.gz": {old: true},
+		"audit-20240101T000002.000000000.jsonl":    {kept: true},
+		"other-20240101T000000.000000000.jsonl":    {old: true, kept: true},
+		"audit-20240101T000000.000000000.txt":      {old: true, kept: true},
+		// Files the sink did not write are kept, however old.
+		"audit-backup.jsonl":          {old: true, kept: true},
+		"audit-20240101.jsonl":        {old: true, kept: true},
+		"audit-notes.jsonl.gz":        {old: true, kept: true},
+		"audit-20240101T000000.jsonl": {old: true, kept: true},
+	}
+	for name, file := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if file.old {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sink, err := NewFileSink(FileSinkConfig{Path: filepath.Join(dir, "audit.jsonl"), Retention: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	for name, file := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != file.kept {
+			t.Errorf("%s kept %v, want %v", name, exists, file.kept)
+		}
+	}
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 1; i <= 2; i++ {
+		sink, err := NewFileSink(FileSinkConfig{Path: path, SyncInterval: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.HandleEvent(testEvent(uint64(i)))
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if events := readEventLines(t, path); len(events) != 2 {
+		t.Errorf("got %d events, want 2", len(events))
+	}
+}
+
+func TestFileSinkErrors(t *testing.T) {
+	if _, err := NewFileSink(FileSinkConfig{}); err == nil {
+		t.Error("empty path accepted")
+	}
+	sink, err := NewFileSink(FileSinkConfig{Path: filepath.Join(t.TempDir(), "audit.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.DeliverEvents([]Event{testEvent(1)}); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+	if err := sink.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+	if err := sink.DeliverEvents([]Event{testEvent(2)}); err == nil {
+		t.Error("events delivered after close")
+	}
+}
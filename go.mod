@@ -3,6 +3,7 @@ module github.com/ale8k/ssh-proxy-poc
 go 1.22.3
 
 require (
+	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be
 	github.com/gliderlabs/ssh v0.3.7
 	github.com/juju/zaputil v0.0.0-20190326175239-ef53049637ac
 	github.com/moby/term v0.5.0
@@ -12,7 +13,6 @@ require (
 
 require (
 	github.com/Azure/go-ansiterm v0.0.0-20210617225240-d185dfc1b5a1 // indirect
-	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be // indirect
 	github.com/creack/pty v1.1.21 // indirect
 	github.com/stretchr/testify v1.8.0 // indirect
 	go.uber.org/atomic v1.3.2 // indirect
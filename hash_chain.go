@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// HashChainConfig configures a HashChainSink.
+type HashChainConfig struct {
+	// SigningKey signs the checkpoints.
+	SigningKey ed25519.PrivateKey
+
+	// CheckpointEvery is the number of events between checkpoints, and
+	// CheckpointInterval the longest time between them. 0 disables either.
+	CheckpointEvery    int
+	CheckpointInterval time.Duration
+
+	// StatePath, when set, is a file the chain's latest hash and
+	// GlobalSequence are saved to after each event, such as
+	// "audit.jsonl.chain" next to the log. A sink created with the same
+	// StatePath resumes the chain from it rather than starting a new one, so
+	// a proxy restart does not look like a truncated log.
+	StatePath string
+}
+
+// DefaultHashChainConfig returns the hash chain configuration used when
+// nothing else is configured, signing checkpoints with key.
+func DefaultHashChainConfig(key ed25519.PrivateKey) HashChainConfig {
+	return HashChainConfig{
+		SigningKey:         key,
+		CheckpointEvery:    1000,
+		CheckpointInterval: time.Minute,
+	}
+}
+
+// LoadSigningKey loads an ed25519 private key from a PEM encoded PKCS #8
+// file, such as one created by "openssl genpkey -algorithm ed25519".
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is %T, not ed25519", key)
+	}
+	return edKey, nil
+}
+
+// HashChainSink is an EventSink making the events it passes on to another sink
+// tamper-evident. Each event is given the SHA-256 hash of its JSON encoding,
+// along with the hash of the event before it in its session and in the sink's
+// stream of events, so editing, removing or reordering events breaks the chain.
+// Checkpoint events periodically sign the stream's latest hash, so the chain
+// cannot be rewritten without the signing key, and truncating it loses the
+// events since the last checkpoint at most. cmd/auditverify checks the chain.
+//
+// The hash of an event covers its JSON encoding without the "hash" field, which
+// is encoded last, so events must be written out as encoding/json encodes them.
+type HashChainSink struct {
+	cfg   HashChainConfig
+	sink  EventSink
+	keyID string
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu sync.Mutex
+	// seq is the GlobalSequence and head the hash of the latest event.
+	seq  uint64
+	head string
+	// sessions holds the hash of the latest event of each session.
+	sessions        map[string]string
+	sinceCheckpoint int
+	closed          bool
+	// state is the open StatePath file, if any.
+	state *os.File
+}
+
+// NewHashChainSink returns a HashChainSink passing events on to sink.
+func NewHashChainSink(cfg HashChainConfig, sink EventSink) (*HashChainSink, error) {
+	if len(cfg.SigningKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("hash chain signing key is not an ed25519 private key")
+	}
+	s := &HashChainSink{
+		cfg:      cfg,
+		sink:     sink,
+		keyID:    checkpointKeyID(cfg.SigningKey.Public().(ed25519.PublicKey)),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		sessions: map[string]string{},
+	}
+	if cfg.StatePath != "" {
+		if err := s.resume(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CheckpointInterval > 0 {
+		go s.checkpointLoop()
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+// hashChainStateFormat is the format of the state file: the GlobalSequence
+// and hash of the latest event, padded to a fixed width so each save
+// overwrites the last in place.
+const hashChainStateFormat = "%020d %64s\n"
+
+// resume opens the state file and resumes the chain from it, if it has been
+// saved before.
+func (s *HashChainSink) resume() error {
+	f, err := os.OpenFile(s.cfg.StatePath, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open hash chain state: %w", err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to read hash chain state: %w", err)
+	}
+	if len(b) > 0 {
+		var seq uint64
+		var head string
+		_, err := fmt.Sscanf(string(b), hashChainStateFormat, &seq, &head)
+		if _, hexErr := hex.DecodeString(head); err != nil || hexErr != nil || len(head) != 2*sha256.Size {
+			f.Close()
+			return fmt.Errorf("hash chain state %s is corrupt, remove it to start a new chain", s.cfg.StatePath)
+		}
+		s.seq, s.head = seq, head
+	}
+	s.state = f
+	return nil
+}
+
+// save saves the chain's latest hash to the state file.
+func (s *HashChainSink) save() {
+	if s.state == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(io.NewOffsetWriter(s.state, 0), hashChainStateFormat, s.seq, s.head); err != nil {
+		zapctx.Error(context.TODO(), "failed to save hash chain state", zap.Error(err))
+	}
+}
+
+// checkpointKeyID identifies a checkpoint signing key by the first 8 bytes of
+// its SHA-256 hash.
+func checkpointKeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// checkpointMessage is what a checkpoint's signature signs, the checkpoint's
+// own GlobalSequence and the hash of the event before it.
+func checkpointMessage(globalSeq uint64, prevHash string) []byte {
+	return []byte(fmt.Sprintf("ssh-proxy audit checkpoint %d %s", globalSeq, prevHash))
+}
+
+// eventHash returns the hex SHA-256 hash of e's JSON encoding without its hash.
+func eventHash(e Event) (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// HandleEvent implements EventSink.
+func (s *HashChainSink) HandleEvent(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.chain(e)
+	if s.cfg.CheckpointEvery > 0 && s.sinceCheckpoint >= s.cfg.CheckpointEvery {
+		s.checkpoint()
+	}
+}
+
+// chain adds e to the chain and passes it on. The lock is held while the
+// event is passed on, so the sink receives events in chain order.
+func (s *HashChainSink) chain(e Event) {
+	s.seq++
+	e.GlobalSequence = s.seq
+	e.PrevHash = s.head
+	e.SessionPrevHash = ""
+	if e.Type != EventCheckpoint {
+		e.SessionPrevHash = s.sessions[e.Session.SessionID]
+	}
+	hash, err := eventHash(e)
+	if err != nil {
+		// An event which cannot be encoded cannot be written either, it
+		// is left out of the chain.
+		s.seq--
+		return
+	}
+	e.Hash = hash
+	s.head = hash
+	s.sinceCheckpoint++
+
+	switch e.Type {
+	case EventCheckpoint:
+		s.sinceCheckpoint = 0
+	case EventDisconnect:
+		delete(s.sessions, e.Session.SessionID)
+	default:
+		s.sessions[e.Session.SessionID] = hash
+	}
+	s.sink.HandleEvent(e)
+	s.save()
+}
+
+// checkpoint adds a signed checkpoint to the chain if any events have been
+// added since the last one.
+func (s *HashChainSink) checkpoint() {
+	if s.sinceCheckpoint == 0 {
+		return
+	}
+	signature := ed25519.Sign(s.cfg.SigningKey, checkpointMessage(s.seq+1, s.head))
+	s.chain(Event{
+		Version: EventVersion,
+		Type:    EventCheckpoint,
+		Time:    time.Now(),
+		Data: CheckpointEvent{
+			KeyID:     s.keyID,
+			Signature: base64.StdEncoding.EncodeToString(signature),
+		},
+	})
+}
+
+// Unwrap implements SinkWrapper, returning the sink events are passed on to.
+func (s *HashChainSink) Unwrap() EventSink {
+	return s.sink
+}
+
+// checkpointLoop adds a checkpoint every CheckpointInterval.
+func (s *HashChainSink) checkpointLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.checkpoint()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Close adds a final checkpoint, so the end of the chain is signed, and closes
+// the state file. Events handled after Close are dropped.
+func (s *HashChainSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.checkpoint()
+	s.closed = true
+	close(s.stop)
+	s.mu.Unlock()
+	<-s.done
+	if s.state != nil {
+		return s.state.Close()
+	}
+	return nil
+}
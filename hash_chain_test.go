@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSigningKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// chainEvent returns an event of the given type in session id.
+func chainEvent(id string, seq uint64, typ EventType) Event {
+	e := testEvent(seq)
+	e.Session.SessionID = id
+	e.Type = typ
+	switch typ {
+	case EventConnect:
+		e.Data = ConnectEvent{}
+	case EventDisconnect:
+		e.Data = DisconnectEvent{}
+	}
+	return e
+}
+
+func TestHashChainSink(t *testing.T) {
+	tests := []struct {
+		name            string
+		checkpointEvery int
+		events          []Event
+		// want is the type of each event passed on.
+		want []EventType
+	}{{
+		name:   "single session",
+		events: []Event{chainEvent("a", 1, EventConnect), chainEvent("a", 2, EventInput), chainEvent("a", 3, EventDisconnect)},
+		want:   []EventType{EventConnect, EventInput, EventDisconnect, EventCheckpoint},
+	}, {
+		name: "interleaved sessions",
+		events: []Event{
+			chainEvent("a", 1, EventConnect), chainEvent("b", 1, EventConnect),
+			chainEvent("a", 2, EventInput), chainEvent("b", 2, EventInput),
+		},
+		want: []EventType{EventConnect, EventConnect, EventInput, EventInput, EventCheckpoint},
+	}, {
+		name:            "checkpoint every 2 events",
+		checkpointEvery: 2,
+		events:          []Event{chainEvent("a", 1, EventConnect), chainEvent("a", 2, EventInput), chainEvent("a", 3, EventInput)},
+		want:            []EventType{EventConnect, EventInput, EventCheckpoint, EventInput, EventCheckpoint},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := newTestSigningKey(t)
+			cfg := DefaultHashChainConfig(key)
+			cfg.CheckpointEvery = test.checkpointEvery
+			cfg.CheckpointInterval = 0
+			sink := &testSink{}
+			chain, err := NewHashChainSink(cfg, sink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range test.events {
+				chain.HandleEvent(e)
+			}
+			chain.Close()
+			// Events after Close are dropped.
+			chain.HandleEvent(chainEvent("a", 99, EventInput))
+
+			if got := sink.types(); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Fatalf("passed on %v, want %v", got, test.want)
+			}
+			var prev string
+			sessions := map[string]string{}
+			for i, e := range sink.events {
+				if e.GlobalSequence != uint64(i+1) {
+					t.Errorf("event %d has global_seq %d", i, e.GlobalSequence)
+				}
+				if e.PrevHash != prev {
+					t.Errorf("event %d has prev_hash %q, want %q", i, e.PrevHash, prev)
+				}
+				if hash, err := eventHash(e); err != nil || hash != e.Hash {
+					t.Errorf("event %d has hash %q, want %q (%v)", i, e.Hash, hash, err)
+				}
+				prev = e.Hash
+
+				if e.Type == EventCheckpoint {
+					data := e.Data.(CheckpointEvent)
+					signature, _ := base64.StdEncoding.DecodeString(data.Signature)
+					message := fmt.Sprintf("ssh-proxy audit checkpoint %d %s", e.GlobalSequence, e.PrevHash)
+					if !ed25519.Verify(key.Public().(ed25519.PublicKey), []byte(message), signature) {
+						t.Errorf("checkpoint %d has an invalid signature", i)
+					}
+					if data.KeyID != checkpointKeyID(key.Public().(ed25519.PublicKey)) {
+						t.Errorf("checkpoint %d has key id %q", i, data.KeyID)
+					}
+					continue
+				}
+				if e.SessionPrevHash != sessions[e.Session.SessionID] {
+					t.Errorf("event %d has session_prev_hash %q, want %q", i, e.SessionPrevHash, sessions[e.Session.SessionID])
+				}
+				sessions[e.Session.SessionID] = e.Hash
+				if e.Type == EventDisconnect {
+					delete(sessions, e.Session.SessionID)
+				}
+			}
+		})
+	}
+}
+
+func TestHashChainSinkResume(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "audit.jsonl.chain")
+	cfg := DefaultHashChainConfig(newTestSigningKey(t))
+	cfg.CheckpointInterval = 0
+	cfg.StatePath = statePath
+	sink := &testSink{}
+	// The proxy's first run, and its restart.
+	for run := 0; run < 2; run++ {
+		chain, err := NewHashChainSink(cfg, sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.HandleEvent(chainEvent("a", 1, EventConnect))
+		chain.Close()
+	}
+
+	want := []EventType{EventConnect, EventCheckpoint, EventConnect, EventCheckpoint}
+	if got := sink.types(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("passed on %v, want %v", got, want)
+	}
+	var prev string
+	for i, e := range sink.events {
+		if e.GlobalSequence != uint64(i+1) || e.PrevHash != prev {
+			t.Errorf("event %d has global_seq %d and prev_hash %q, want %d and %q", i, e.GlobalSequence, e.PrevHash, i+1, prev)
+		}
+		prev = e.Hash
+	}
+
+	if err := os.WriteFile(statePath, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHashChainSink(cfg, sink); err == nil {
+		t.Error("NewHashChainSink() resumed from a corrupt state file")
+	}
+}
+
+// TestHashChainFormat checks events written out through a FileSink are in the
+// format cmd/auditverify verifies: the hash is the last field, and is the
+// SHA-256 of the line without it.
+func TestHashChainFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	fileSink, err := NewFileSink(FileSinkConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultHashChainConfig(newTestSigningKey(t))
+	cfg.CheckpointInterval = 0
+	chain, err := NewHashChainSink(cfg, fileSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.HandleEvent(chainEvent("a", 1, EventConnect))
+	chain.HandleEvent(chainEvent("a", 2, EventInput))
+	chain.Close()
+	fileSink.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		line := scanner.Bytes()
+		i := bytes.LastIndex(line, []byte(`,"hash":"`))
+		if i < 0 {
+			t.Fatalf("line %q has no hash", line)
+		}
+		hash := strings.TrimSuffix(string(line[i+len(`,"hash":"`):]), `"}`)
+		content := append(bytes.Clone(line[:i]), '}')
+		sum := sha256.Sum256(content)
+		if want := hex.EncodeToString(sum[:]); hash != want {
+			t.Errorf("line %q has hash %s, its content hashes to %s", line, hash, want)
+		}
+	}
+	if lines != 3 {
+		t.Errorf("wrote %d lines, want 3", lines)
+	}
+}
+
+func TestHashChainSinkUnwrap(t *testing.T) {
+	cfg := testSpoolConfig(t.TempDir())
+	cfg.MaxBytes = eventLineSize(t)
+	cfg.FailClosed = true
+	spool, err := NewSpool(cfg, &testDeliverer{stuck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	multi, err := NewMultiSink(MultiSinkTarget{Name: "spool", Sink: spool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer multi.Close()
+
+	chainCfg := DefaultHashChainConfig(newTestSigningKey(t))
+	chainCfg.CheckpointInterval = 0
+	chain, err := NewHashChainSink(chainCfg, multi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Close()
+	if err := admitSession(chain); err != nil {
+		t.Fatalf("AdmitSession() = %v before the spool is full", err)
+	}
+	if health := sinkHealth(chain); len(health) != 1 || health[0].Name != "spool" {
+		t.Errorf("Health() = %+v, want the multi sink's", health)
+	}
+
+	// Chained events are larger than the spool holds.
+	chain.HandleEvent(testEvent(1))
+	waitFor(t, func() bool { return admitSession(chain) == ErrSpoolFull })
+
+	// A sink which neither admits sessions nor reports its health.
+	plain, err := NewHashChainSink(chainCfg, &testSink{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if err := admitSession(plain); err != nil {
+		t.Errorf("AdmitSession() = %v, want nil", err)
+	}
+	if health := sinkHealth(plain); health != nil {
+		t.Errorf("Health() = %+v, want nil", health)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	edKey := newTestSigningKey(t)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr string
+	}{
+		{name: "ed25519", content: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER})},
+		{name: "not PEM", content: []byte("not a key"), wantErr: "no PEM data found"},
+		{name: "not PKCS #8", content: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("junk")}), wantErr: "invalid signing key"},
+		{name: "not ed25519", content: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecDER}), wantErr: "not ed25519"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key.pem")
+			if err := os.WriteFile(path, test.content, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			key, err := LoadSigningKey(path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("LoadSigningKey() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.Equal(edKey) {
+				t.Errorf("LoadSigningKey() returned a different key")
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// handleHealthz reports the proxy is alive, which it is while it can serve
+// HTTP at all.
+func (m *MITMAuditingSSHServerWithHTTP) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// handleReadyz reports whether the proxy can accept and audit new sessions,
+// responding 503 with the reasons it cannot.
+func (m *MITMAuditingSSHServerWithHTTP) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	problems := m.readinessProblems()
+	if len(problems) > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, problem := range problems {
+			fmt.Fprintln(w, problem)
+		}
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// readinessProblems returns why the proxy cannot accept new sessions: its host
+// key is yet to be loaded or its sink, or a sink it wraps, refuses new sessions,
+// such as a fail-closed Spool which is full or a MultiSink with an unhealthy
+// required sink.
+func (m *MITMAuditingSSHServerWithHTTP) readinessProblems() []string {
+	var problems []string
+	if m.loadedHostKey() == nil {
+		problems = append(problems, "host key not loaded")
+	}
+	if err := admitSession(m.sink); err != nil {
+		problems = append(problems, "audit sink refuses sessions: "+err.Error())
+	}
+	return problems
+}
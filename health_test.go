@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// fullSpool returns a fail-closed Spool which is full.
+func fullSpool(t *testing.T) *Spool {
+	t.Helper()
+	cfg := testSpoolConfig(t.TempDir())
+	cfg.MaxBytes = eventLineSize(t)
+	cfg.FailClosed = true
+	spool, err := NewSpool(cfg, &testDeliverer{stuck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { spool.Close() })
+	spool.HandleEvent(testEvent(1))
+	spool.HandleEvent(testEvent(2))
+	waitFor(t, func() bool { return spool.AdmitSession() == ErrSpoolFull })
+	return spool
+}
+
+// spoolLogger is an SSHAuditLogger which is also an EventSink, so an
+// auditLoggerSink wrapping it answers with the spool's admission.
+type spoolLogger struct {
+	SSHAuditLogger
+	*Spool
+}
+
+// connectStatus returns the status code of a CONNECT request to the proxy.
+func connectStatus(t *testing.T, p *testProxy) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", p.http.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "CONNECT /ssh HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	req, _ := http.NewRequest(http.MethodConnect, "/ssh", nil)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name string
+		sink func(t *testing.T) EventSink
+		// wantProblem is the reason the proxy is not ready, if any.
+		wantProblem string
+	}{{
+		name: "plain sink",
+		sink: func(t *testing.T) EventSink { return &testSink{} },
+	}, {
+		name:        "full spool",
+		sink:        func(t *testing.T) EventSink { return fullSpool(t) },
+		wantProblem: "audit sink refuses sessions: " + ErrSpoolFull.Error(),
+	}, {
+		name: "full spool behind a hash chain",
+		sink: func(t *testing.T) EventSink {
+			cfg := DefaultHashChainConfig(newTestSigningKey(t))
+			cfg.CheckpointInterval = 0
+			chain, err := NewHashChainSink(cfg, fullSpool(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return chain
+		},
+		wantProblem: "audit sink refuses sessions: " + ErrSpoolFull.Error(),
+	}, {
+		name: "full spool behind an audit logger",
+		sink: func(t *testing.T) EventSink {
+			return NewAuditLoggerSink(spoolLogger{Spool: fullSpool(t)})
+		},
+		wantProblem: "audit sink refuses sessions: " + ErrSpoolFull.Error(),
+	}, {
+		name: "unhealthy required sink behind a hash chain",
+		sink: func(t *testing.T) EventSink {
+			deliverer := &testDeliverer{stuck: true}
+			multi, err := NewMultiSink(MultiSinkTarget{Name: "webhook", Sink: deliverer, Required: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { multi.Close() })
+			multi.HandleEvent(testEvent(1))
+			waitFor(t, func() bool { return multi.Health()[0].Failed > 0 })
+			cfg := DefaultHashChainConfig(newTestSigningKey(t))
+			cfg.CheckpointInterval = 0
+			chain, err := NewHashChainSink(cfg, multi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return chain
+		},
+		wantProblem: `audit sink refuses sessions: required audit sink "webhook" is unhealthy: stuck`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProxy(t, test.sink(t), echoTarget)
+			defer p.close()
+
+			// The proxy is alive whether or not it is ready.
+			resp, err := http.Get(p.http.URL + "/healthz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "ok\n" {
+				t.Errorf("/healthz = %d %q, want 200 ok", resp.StatusCode, body)
+			}
+
+			resp, err = http.Get(p.http.URL + "/readyz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			wantStatus, wantBody := http.StatusOK, "ok\n"
+			if test.wantProblem != "" {
+				wantStatus, wantBody = http.StatusServiceUnavailable, test.wantProblem+"\n"
+			}
+			if resp.StatusCode != wantStatus || string(body) != wantBody {
+				t.Errorf("/readyz = %d %q, want %d %q", resp.StatusCode, body, wantStatus, wantBody)
+			}
+
+			// Sessions are refused at CONNECT while the proxy is not ready.
+			if got := connectStatus(t, p); got != wantStatus {
+				t.Errorf("CONNECT = %d, want %d", got, wantStatus)
+			}
+			wantRefused := 0.0
+			if test.wantProblem != "" {
+				wantRefused = 1
+			}
+			if got := scrapeMetrics(t, p)["ssh_proxy_sessions_refused_total"]; got != wantRefused {
+				t.Errorf("ssh_proxy_sessions_refused_total = %v, want %v", got, wantRefused)
+			}
+		})
+	}
+}
+
+func TestFindSink(t *testing.T) {
+	refusing := &refusingSink{err: ErrSpoolFull}
+	chain := func(t *testing.T, sink EventSink) EventSink {
+		cfg := DefaultHashChainConfig(newTestSigningKey(t))
+		cfg.CheckpointInterval = 0
+		chain, err := NewHashChainSink(cfg, sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { chain.Close() })
+		return chain
+	}
+	tests := []struct {
+		name    string
+		sink    func(t *testing.T) EventSink
+		wantErr error
+	}{{
+		name: "nil",
+		sink: func(t *testing.T) EventSink { return nil },
+	}, {
+		name: "neither admitting nor wrapping",
+		sink: func(t *testing.T) EventSink { return &testSink{} },
+	}, {
+		name:    "admitting",
+		sink:    func(t *testing.T) EventSink { return refusing },
+		wantErr: ErrSpoolFull,
+	}, {
+		name:    "wrapped twice",
+		sink:    func(t *testing.T) EventSink { return chain(t, chain(t, refusing)) },
+		wantErr: ErrSpoolFull,
+	}, {
+		name: "wrapping a sink neither admitting nor wrapping",
+		sink: func(t *testing.T) EventSink { return chain(t, &testSink{}) },
+	}, {
+		name: "audit logger which is not a sink",
+		sink: func(t *testing.T) EventSink { return NewAuditLoggerSink(nil) },
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := admitSession(test.sink(t)); err != test.wantErr {
+				t.Errorf("admitSession() = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSinkHealthUnwraps(t *testing.T) {
+	multi, err := NewMultiSink(MultiSinkTarget{Name: "file", Sink: &testSink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer multi.Close()
+	cfg := testSpoolConfig(t.TempDir())
+	spool, err := NewSpool(cfg, multi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	// The spool reports no health of its own, so the multi sink's is reported.
+	if health := sinkHealth(spool); len(health) != 1 || health[0].Name != "file" {
+		t.Errorf("sinkHealth() = %+v, want the multi sink's", health)
+	}
+	if health := sinkHealth(&testSink{}); health != nil {
+		t.Errorf("sinkHealth() = %+v, want nil", health)
+	}
+}
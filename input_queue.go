@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to a session's input when the audit
+// logger falls behind and the input queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDrop drops input rather than wait for the audit logger, and
+	// marks where and how much was dropped in the audited input. The
+	// session itself is never slowed down.
+	OverflowDrop OverflowPolicy = iota
+
+	// OverflowBlock holds the client's keystrokes back until the audit
+	// logger catches up, so no input reaches the target without being audited.
+	OverflowBlock
+
+	// OverflowKill terminates the session, so no input reaches the target
+	// without being audited and the user is not left with a frozen session.
+	OverflowKill
+)
+
+// String implements fmt.Stringer.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDrop:
+		return "drop"
+	case OverflowBlock:
+		return "block"
+	case OverflowKill:
+		return "kill"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// InputQueueConfig configures the queue of input between a PTY session and its audit logger.
+type InputQueueConfig struct {
+	// Size is the number of chunks of input queued for the audit logger.
+	Size int
+
+	// Overflow is what happens to input once the queue is full.
+	Overflow OverflowPolicy
+}
+
+// DefaultInputQueueConfig returns the input queue configuration used when none is configured.
+func DefaultInputQueueConfig() InputQueueConfig {
+	return InputQueueConfig{
+		Size:     1024,
+		Overflow: OverflowDrop,
+	}
+}
+
+// droppedMarker marks input dropped under OverflowDrop.
+const droppedMarker = "[DROPPED %d BYTES]"
+
+// inputQueue is a bounded queue of input delivered to the audit logger by
+// its own goroutine, so a slow logger never holds up the session's input
+// beyond what the overflow policy allows.
+type inputQueue struct {
+	cfg     InputQueueConfig
+	deliver func([]byte)
+	kill    func()
+	drop    func(n int)
+	queued  func(delta int)
+	done    chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	items   [][]byte
+	dropped int
+	killed  bool
+	closed  bool
+}
+
+// newInputQueue returns an inputQueue passing input to deliver, which may
+// block. kill is called once if the queue overflows under OverflowKill, drop
+// with the size of each input dropped as the queue overflows, and queued with
+// the change in the number of inputs queued.
+func newInputQueue(cfg InputQueueConfig, deliver func([]byte), kill func(), drop func(n int), queued func(delta int)) *inputQueue {
+	q := &inputQueue{
+		cfg:     cfg,
+		deliver: deliver,
+		kill:    kill,
+		drop:    drop,
+		queued:  queued,
+		done:    make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+func (q *inputQueue) run() {
+	defer close(q.done)
+	q.mu.Lock()
+	for {
+		for len(q.items) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		p := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.queued(-1)
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		q.deliver(p)
+		q.mu.Lock()
+	}
+}
+
+// push queues p, which must not be modified afterwards, applying the
+// overflow policy if the queue is full.
+func (q *inputQueue) push(p []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.cfg.Overflow == OverflowBlock {
+		for len(q.items) >= q.cfg.Size && !q.closed {
+			q.cond.Wait()
+		}
+	}
+	if q.closed || q.killed {
+		return
+	}
+
+	if len(q.items) >= q.cfg.Size {
+		switch q.cfg.Overflow {
+		case OverflowKill:
+			q.killed = true
+			go q.kill()
+		default:
+			q.dropped += len(p)
+		}
+		q.drop(len(p))
+		return
+	}
+	if q.dropped > 0 {
+		// The marker takes the place of the input it replaces, so it may
+		// take the queue one over its size.
+		q.append([]byte(fmt.Sprintf(droppedMarker, q.dropped)))
+		q.dropped = 0
+	}
+	q.append(p)
+	q.cond.Broadcast()
+}
+
+// append adds p to the queue.
+func (q *inputQueue) append(p []byte) {
+	q.items = append(q.items, p)
+	q.queued(1)
+}
+
+// close stops the queue accepting input, any input already queued is still
+// delivered. done is closed once it has been.
+func (q *inputQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	if q.dropped > 0 {
+		q.append([]byte(fmt.Sprintf(droppedMarker, q.dropped)))
+		q.dropped = 0
+	}
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gliderssh "github.com/gliderlabs/ssh"
+)
+
+func TestInputQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name        string
+		overflow    OverflowPolicy
+		want        string
+		wantKilled  bool
+		wantDropped int
+	}{{
+		name:        "drop marks the dropped input",
+		overflow:    OverflowDrop,
+		want:        "ab[DROPPED 2 BYTES]",
+		wantDropped: 2,
+	}, {
+		name:     "block holds input back",
+		overflow: OverflowBlock,
+		want:     "abcd",
+	}, {
+		name:     "kill terminates the session",
+		overflow: OverflowKill,
+		want:     "ab",
+		// The input overflowing the queue is dropped, the rest ignored.
+		wantKilled:  true,
+		wantDropped: 1,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := make(chan struct{})
+			var mu sync.Mutex
+			var delivered []string
+			killed := make(chan struct{})
+			dropped := 0
+			q := newInputQueue(InputQueueConfig{Size: 1, Overflow: test.overflow}, func(p []byte) {
+				<-release
+				mu.Lock()
+				defer mu.Unlock()
+				delivered = append(delivered, string(p))
+			}, func() {
+				close(killed)
+			}, func(n int) {
+				dropped += n
+			}, func(int) {})
+
+			// The first input is taken by the stuck logger and the second
+			// fills the queue, so the rest overflow.
+			q.push([]byte("a"))
+			waitFor(t, func() bool {
+				q.mu.Lock()
+				defer q.mu.Unlock()
+				return len(q.items) == 0
+			})
+			q.push([]byte("b"))
+			if test.overflow == OverflowBlock {
+				pushed := make(chan struct{})
+				go func() {
+					defer close(pushed)
+					q.push([]byte("c"))
+					q.push([]byte("d"))
+				}()
+				select {
+				case <-pushed:
+					t.Fatal("input not held back under OverflowBlock")
+				case <-time.After(50 * time.Millisecond):
+				}
+				close(release)
+				<-pushed
+			} else {
+				q.push([]byte("c"))
+				q.push([]byte("d"))
+				close(release)
+			}
+			q.close()
+			<-q.done
+
+			if got := strings.Join(delivered, ""); got != test.want {
+				t.Errorf("delivered %q, want %q", got, test.want)
+			}
+			if dropped != test.wantDropped {
+				t.Errorf("dropped %d bytes, want %d", dropped, test.wantDropped)
+			}
+			select {
+			case <-killed:
+				if !test.wantKilled {
+					t.Error("session killed")
+				}
+			case <-time.After(50 * time.Millisecond):
+				if test.wantKilled {
+					t.Error("session not killed")
+				}
+			}
+		})
+	}
+}
+
+func TestOverflowPolicyString(t *testing.T) {
+	for policy, want := range map[OverflowPolicy]string{
+		OverflowDrop:      "drop",
+		OverflowBlock:     "block",
+		OverflowKill:      "kill",
+		OverflowPolicy(9): "OverflowPolicy(9)",
+	} {
+		if got := policy.String(); got != want {
+			t.Errorf("%d.String() = %q, want %q", int(policy), got, want)
+		}
+	}
+}
+
+// waitFor waits for cond to hold, failing the test if it takes too long.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BenchmarkKeystrokeSlowSink measures the latency of a keystroke from the
+// client's session to the target's input, through forward, the echo redactor
+// and the input queue, with sinks of different speeds. The target echoes each
+// keystroke, so it is passed on to the sink.
+func BenchmarkKeystrokeSlowSink(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		delay time.Duration
+	}{
+		{"fast", 0},
+		{"slow", time.Millisecond},
+		{"stuck", time.Hour},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			m := &MITMAuditingSSHServerWithHTTP{metrics: newProxyMetrics()}
+			release := make(chan struct{})
+			a := newSessionAudit(sinkFunc(func(Event) {
+				select {
+				case <-time.After(bench.delay):
+				case <-release:
+				}
+			}), func(int) {})
+			cfg := DefaultInputQueueConfig()
+			queue := newInputQueue(cfg, func(p []byte) {
+				a.emit(SessionDetails{}, InputEvent{Data: string(p)})
+			}, func() {}, func(int) {}, func(int) {})
+			redactor := newEchoRedactor(queue.push, cfg.Size, time.Minute)
+			target := &echoingTarget{echo: redactor.writer(io.Discard), received: make(chan struct{})}
+
+			client, typed := io.Pipe()
+			live := &liveSession{closed: make(chan struct{})}
+			forwarded := make(chan struct{})
+			go func() {
+				defer close(forwarded)
+				m.forward(context.Background(), target, benchSession{r: client}, redactor, live, nil)
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				typed.Write([]byte("a"))
+				<-target.received
+			}
+			b.StopTimer()
+
+			typed.Close()
+			<-forwarded
+			close(release)
+			redactor.close()
+			queue.close()
+			<-queue.done
+			a.disconnect()
+		})
+	}
+}
+
+// benchSession is a client's session, reading its input from r.
+type benchSession struct {
+	gliderssh.Session
+	r io.Reader
+}
+
+func (s benchSession) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// echoingTarget is a target's input, echoing each write to echo and telling
+// received.
+type echoingTarget struct {
+	echo     io.Writer
+	received chan struct{}
+}
+
+func (t *echoingTarget) Write(p []byte) (int, error) {
+	t.echo.Write(p)
+	t.received <- struct{}{}
+	return len(p), nil
+}
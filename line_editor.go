@@ -0,0 +1,449 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// editedLine is a command line submitted by the client, as reconstructed by a lineEditor.
+type editedLine struct {
+	// Command is the reconstructed line, as the shell would have executed it.
+	Command string
+
+	// Raw is every byte received from the client while the line was edited,
+	// including the submitting carriage return.
+	Raw []byte
+
+	// Uncertain is set when the line was edited in a way the proxy cannot
+	// follow, such as tab completion, reverse search, recalling history from
+	// before this session or invalid UTF-8, when it was submitted within an
+	// escape sequence or a bracketed paste, or when the shell may run
+	// something other than Command, because of history expansion or a
+	// trailing backslash continuing it on the next line. Command is a best
+	// effort in that case.
+	Uncertain bool
+}
+
+// lineEditor models a readline-like (emacs mode) line editor from the
+// keystrokes sent by the client, so the command line the shell executed can be
+// audited rather than the raw keystrokes that produced it.
+//
+// Input may be fed in arbitrarily sized chunks, escape sequences and UTF-8
+// sequences split across chunks are carried over.
+type lineEditor struct {
+	line      []rune
+	cursor    int
+	raw       []byte
+	uncertain bool
+
+	// killed is the most recently killed text, inserted again on Ctrl+Y.
+	killed []rune
+
+	// history holds the lines submitted in this session, histIdx is the
+	// entry being shown, len(history) being the line being edited. A negative
+	// histIdx means the shell is showing history from before this session.
+	history []string
+	histIdx int
+	edited  []rune
+
+	// paste is set within a bracketed paste.
+	paste bool
+
+	state  int
+	params []byte
+	utf8   []byte
+}
+
+const (
+	editorGround = iota
+	editorEscape
+	editorCSI
+	editorSS3
+)
+
+func newLineEditor() *lineEditor {
+	return &lineEditor{}
+}
+
+// feed processes input from the client, returning any lines it submitted.
+func (e *lineEditor) feed(p []byte) []editedLine {
+	var lines []editedLine
+	for _, b := range p {
+		e.raw = append(e.raw, b)
+		if line, ok := e.feedByte(b); ok {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (e *lineEditor) feedByte(b byte) (editedLine, bool) {
+	if b == '\r' || b == '\n' {
+		e.settle()
+	}
+	switch e.state {
+	case editorEscape:
+		e.state = editorGround
+		switch b {
+		case '[':
+			e.state = editorCSI
+			e.params = e.params[:0]
+		case 'O':
+			e.state = editorSS3
+		default:
+			e.meta(b)
+		}
+		return editedLine{}, false
+	case editorCSI:
+		if b >= 0x40 && b <= 0x7e {
+			e.state = editorGround
+			e.csi(string(e.params), b)
+		} else {
+			e.params = append(e.params, b)
+		}
+		return editedLine{}, false
+	case editorSS3:
+		e.state = editorGround
+		e.csi("", b)
+		return editedLine{}, false
+	}
+
+	if len(e.utf8) > 0 && utf8.RuneStart(b) {
+		// The sequence was cut short, and can never be completed, so it is
+		// taken as invalid and b processed on its own.
+		e.settle()
+	}
+	if len(e.utf8) > 0 || b >= utf8.RuneSelf {
+		e.utf8 = append(e.utf8, b)
+		if !utf8.FullRune(e.utf8) {
+			return editedLine{}, false
+		}
+		r, _ := utf8.DecodeRune(e.utf8)
+		e.utf8 = e.utf8[:0]
+		e.insert(r)
+		return editedLine{}, false
+	}
+
+	if b == 0x1b {
+		e.state = editorEscape
+		return editedLine{}, false
+	}
+
+	if e.paste {
+		// Pasted text is inserted as is, without executing any newlines.
+		switch b {
+		case '\r':
+			e.insert('\n')
+		default:
+			e.insert(rune(b))
+		}
+		return editedLine{}, false
+	}
+
+	switch b {
+	case '\r', '\n':
+		return e.submit()
+	case 0x01: // Ctrl+A
+		e.cursor = 0
+	case 0x02: // Ctrl+B
+		e.left()
+	case 0x03: // Ctrl+C
+		e.reset()
+	case 0x04: // Ctrl+D
+		if e.cursor < len(e.line) {
+			e.line = append(e.line[:e.cursor], e.line[e.cursor+1:]...)
+		}
+	case 0x05: // Ctrl+E
+		e.cursor = len(e.line)
+	case 0x06: // Ctrl+F
+		e.right()
+	case 0x07, 0x0c: // Ctrl+G, Ctrl+L
+	case '\b', 0x7f: // Backspace, DEL
+		if e.cursor > 0 {
+			e.line = append(e.line[:e.cursor-1], e.line[e.cursor:]...)
+			e.cursor--
+		}
+	case 0x0b: // Ctrl+K
+		e.kill(e.cursor, len(e.line))
+	case 0x0e: // Ctrl+N
+		e.historyNext()
+	case 0x10: // Ctrl+P
+		e.historyPrev()
+	case 0x15: // Ctrl+U
+		e.kill(0, e.cursor)
+	case 0x17: // Ctrl+W
+		e.kill(e.spaceWordStart(), e.cursor)
+	case 0x19: // Ctrl+Y
+		e.yank()
+	default:
+		if b < 0x20 {
+			// Tab completion, reverse search, undo and the like change the
+			// line in ways only the shell knows.
+			e.uncertain = true
+			return editedLine{}, false
+		}
+		e.insert(rune(b))
+	}
+	return editedLine{}, false
+}
+
+// csi handles a control sequence, or an SS3 sequence when params is empty.
+func (e *lineEditor) csi(params string, final byte) {
+	switch final {
+	case 'A':
+		e.historyPrev()
+	case 'B':
+		e.historyNext()
+	case 'C':
+		if params == "1;5" || params == "1;3" {
+			e.cursor = e.wordEnd()
+		} else {
+			e.right()
+		}
+	case 'D':
+		if params == "1;5" || params == "1;3" {
+			e.cursor = e.wordStart()
+		} else {
+			e.left()
+		}
+	case 'H':
+		e.cursor = 0
+	case 'F':
+		e.cursor = len(e.line)
+	case '~':
+		switch params {
+		case "1", "7":
+			e.cursor = 0
+		case "4", "8":
+			e.cursor = len(e.line)
+		case "3":
+			if e.cursor < len(e.line) {
+				e.line = append(e.line[:e.cursor], e.line[e.cursor+1:]...)
+			}
+		case "200":
+			e.paste = true
+		case "201":
+			e.paste = false
+		case "2", "5", "6":
+			// Insert, Page Up and Page Down do not change the line.
+		default:
+			e.uncertain = true
+		}
+	default:
+		e.uncertain = true
+	}
+}
+
+// meta handles Alt+<b>, sent as ESC followed by b.
+func (e *lineEditor) meta(b byte) {
+	switch b {
+	case 'b', 'B':
+		e.cursor = e.wordStart()
+	case 'f', 'F':
+		e.cursor = e.wordEnd()
+	case 'd', 'D':
+		e.kill(e.cursor, e.wordEnd())
+	case '\b', 0x7f:
+		e.kill(e.wordStart(), e.cursor)
+	default:
+		e.uncertain = true
+	}
+}
+
+func (e *lineEditor) insert(r rune) {
+	e.line = append(e.line, 0)
+	copy(e.line[e.cursor+1:], e.line[e.cursor:])
+	e.line[e.cursor] = r
+	e.cursor++
+}
+
+func (e *lineEditor) left() {
+	if e.cursor > 0 {
+		e.cursor--
+	}
+}
+
+func (e *lineEditor) right() {
+	if e.cursor < len(e.line) {
+		e.cursor++
+	}
+}
+
+// kill removes line[from:to], keeping it to be yanked.
+func (e *lineEditor) kill(from, to int) {
+	if from >= to {
+		return
+	}
+	e.killed = append([]rune(nil), e.line[from:to]...)
+	e.line = append(e.line[:from], e.line[to:]...)
+	e.cursor = from
+}
+
+func (e *lineEditor) yank() {
+	for _, r := range e.killed {
+		e.insert(r)
+	}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wordStart returns the start of the word before the cursor, as for Alt+B.
+func (e *lineEditor) wordStart() int {
+	i := e.cursor
+	for i > 0 && !isWordRune(e.line[i-1]) {
+		i--
+	}
+	for i > 0 && isWordRune(e.line[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordEnd returns the end of the word after the cursor, as for Alt+F.
+func (e *lineEditor) wordEnd() int {
+	i := e.cursor
+	for i < len(e.line) && !isWordRune(e.line[i]) {
+		i++
+	}
+	for i < len(e.line) && isWordRune(e.line[i]) {
+		i++
+	}
+	return i
+}
+
+// spaceWordStart returns the start of the whitespace delimited word before
+// the cursor, as for Ctrl+W.
+func (e *lineEditor) spaceWordStart() int {
+	i := e.cursor
+	for i > 0 && unicode.IsSpace(e.line[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(e.line[i-1]) {
+		i--
+	}
+	return i
+}
+
+func (e *lineEditor) historyPrev() {
+	if e.histIdx == len(e.history) {
+		e.edited = append([]rune(nil), e.line...)
+	}
+	e.histIdx--
+	e.showHistory()
+}
+
+func (e *lineEditor) historyNext() {
+	if e.histIdx == len(e.history) {
+		return
+	}
+	e.histIdx++
+	e.showHistory()
+}
+
+// showHistory replaces the line with the history entry at histIdx.
+func (e *lineEditor) showHistory() {
+	switch {
+	case e.histIdx < 0:
+		// The shell's history from before this session is unknown.
+		e.uncertain = true
+		e.line = e.line[:0]
+	case e.histIdx == len(e.history):
+		e.line = append(e.line[:0], e.edited...)
+	default:
+		e.line = []rune(e.history[e.histIdx])
+	}
+	e.cursor = len(e.line)
+}
+
+// submits reports whether b, a carriage return or newline, may submit the
+// current line, returning the line it would submit without submitting it. Any
+// escape or UTF-8 sequence in progress is ended first, as b ends it. Within a
+// bracketed paste, where b is taken as part of the line, it is reported as
+// submitting an uncertain line, as the client alone says the paste started.
+func (e *lineEditor) submits(b byte) (editedLine, bool) {
+	if b != '\r' && b != '\n' {
+		return editedLine{}, false
+	}
+	e.settle()
+	return editedLine{
+		Command:   string(e.line),
+		Uncertain: e.uncertain || e.paste || unfollowable(string(e.line)),
+	}, true
+}
+
+// settle ends any escape or UTF-8 sequence in progress, discarding the escape
+// sequence and taking the UTF-8 sequence as invalid. Either leaves the line
+// uncertain, as what the shell makes of them is not known.
+func (e *lineEditor) settle() {
+	if e.state == editorGround && len(e.utf8) == 0 {
+		return
+	}
+	if len(e.utf8) > 0 {
+		e.utf8 = e.utf8[:0]
+		e.insert(utf8.RuneError)
+	}
+	e.state = editorGround
+	e.uncertain = true
+}
+
+// submit returns the current line and starts a new one. Empty lines are not returned.
+func (e *lineEditor) submit() (editedLine, bool) {
+	line := editedLine{
+		Command:   string(e.line),
+		Raw:       e.raw,
+		Uncertain: e.uncertain || unfollowable(string(e.line)),
+	}
+	e.reset()
+	if strings.TrimSpace(line.Command) == "" && !line.Uncertain {
+		return editedLine{}, false
+	}
+	if line.Command != "" {
+		e.history = append(e.history, line.Command)
+	}
+	e.histIdx = len(e.history)
+	return line, true
+}
+
+// reset discards the current line.
+func (e *lineEditor) reset() {
+	e.line = nil
+	e.cursor = 0
+	e.raw = nil
+	e.uncertain = false
+	e.histIdx = len(e.history)
+	e.edited = nil
+}
+
+// unfollowable reports whether the shell would run something other than line
+// as typed: bash expands history designators starting with ! anywhere outside
+// single quotes, and ^ quick substitution at the start of the line, and a line
+// ending in an unescaped backslash continues on the next line.
+func unfollowable(line string) bool {
+	if strings.HasPrefix(line, "^") {
+		return true
+	}
+	single, double, escaped := false, false, false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case escaped:
+			escaped = false
+		case single:
+			single = c != '\''
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			double = !double
+		case c == '\'' && !double:
+			single = true
+		case c == '!':
+			// Bash leaves ! alone when followed by a blank, = or (.
+			if i+1 < len(line) && !strings.ContainsRune(" \t\n=(", rune(line[i+1])) {
+				return true
+			}
+		}
+	}
+	return escaped
+}
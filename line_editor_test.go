@@ -0,0 +1,202 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLineEditor(t *testing.T) {
+	type line struct {
+		command   string
+		uncertain bool
+	}
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []line
+	}{{
+		name:   "typed",
+		chunks: []string{"ls -l\r"},
+		want:   []line{{command: "ls -l"}},
+	}, {
+		name:   "split across chunks",
+		chunks: []string{"ec", "ho hi", "\r"},
+		want:   []line{{command: "echo hi"}},
+	}, {
+		name:   "several lines in a chunk",
+		chunks: []string{"pwd\rid\n"},
+		want:   []line{{command: "pwd"}, {command: "id"}},
+	}, {
+		name:   "empty lines are skipped",
+		chunks: []string{"\r  \rls\r"},
+		want:   []line{{command: "ls"}},
+	}, {
+		name:   "backspace",
+		chunks: []string{"lss\x7f -a\bl\r"},
+		want:   []line{{command: "ls -l"}},
+	}, {
+		name:   "arrow keys move the cursor",
+		chunks: []string{"ech hi\x1b[D\x1b[D\x1b[Do\r"},
+		want:   []line{{command: "echo hi"}},
+	}, {
+		name:   "escape sequence split across chunks",
+		chunks: []string{"cat b\x1b", "[D", "a\r"},
+		want:   []line{{command: "cat ab"}},
+	}, {
+		name:   "ss3 arrow keys",
+		chunks: []string{"ab\x1bODc\r"},
+		want:   []line{{command: "acb"}},
+	}, {
+		name:   "home and end",
+		chunks: []string{"s\x01l\x05 /\r", "b\x1b[Ha\x1b[Fc\r"},
+		want:   []line{{command: "ls /"}, {command: "abc"}},
+	}, {
+		name:   "word movement",
+		chunks: []string{"one two\x1bbX\x1bf!\r"},
+		want:   []line{{command: "one Xtwo!"}},
+	}, {
+		name:   "ctrl+u kills to the start",
+		chunks: []string{"rm -rf /\x15ls\r"},
+		want:   []line{{command: "ls"}},
+	}, {
+		name:   "ctrl+k kills to the end and ctrl+y yanks",
+		chunks: []string{"echo ab\x02\x0b\x01\x19\r"},
+		want:   []line{{command: "becho a"}},
+	}, {
+		name:   "ctrl+w kills a word",
+		chunks: []string{"echo foo bar\x17baz\r"},
+		want:   []line{{command: "echo foo baz"}},
+	}, {
+		name:   "alt+d and alt+backspace",
+		chunks: []string{"one two three\x1b\x7f\x01\x1bdX\r"},
+		want:   []line{{command: "X two "}},
+	}, {
+		name:   "delete key",
+		chunks: []string{"abc\x01\x1b[3~\r"},
+		want:   []line{{command: "bc"}},
+	}, {
+		name:   "ctrl+c discards the line",
+		chunks: []string{"rm -rf /\x03ls\r"},
+		want:   []line{{command: "ls"}},
+	}, {
+		name:   "utf-8 split across chunks",
+		chunks: []string{"echo caf\xc3", "\xa9\r"},
+		want:   []line{{command: "echo café"}},
+	}, {
+		name:   "utf-8 cut short",
+		chunks: []string{"touch a\xc3\r", "echo \xe2\x82b\r"},
+		want:   []line{{command: "touch a\ufffd", uncertain: true}, {command: "echo \ufffdb", uncertain: true}},
+	}, {
+		name:   "submitted within an escape sequence",
+		chunks: []string{"ls\x1b[\r", "pwd\x1b\r", "id\x1bO\n"},
+		want:   []line{{command: "ls", uncertain: true}, {command: "pwd", uncertain: true}, {command: "id", uncertain: true}},
+	}, {
+		name:   "bracketed paste keeps newlines",
+		chunks: []string{"\x1b[200~echo a\recho b\x1b[201~\r"},
+		want:   []line{{command: "echo a\necho b"}},
+	}, {
+		name:   "history from this session",
+		chunks: []string{"ls\r", "pwd\r", "\x1b[A\x1b[A\r"},
+		want:   []line{{command: "ls"}, {command: "pwd"}, {command: "ls"}},
+	}, {
+		name:   "history and back to the edited line",
+		chunks: []string{"ls\r", "ec\x10\x0eho\r"},
+		want:   []line{{command: "ls"}, {command: "echo"}},
+	}, {
+		name:   "history from before this session",
+		chunks: []string{"\x1b[A\r"},
+		want:   []line{{uncertain: true}},
+	}, {
+		name:   "tab completion",
+		chunks: []string{"cat /etc/pas\t\r"},
+		want:   []line{{command: "cat /etc/pas", uncertain: true}},
+	}, {
+		name:   "reverse search",
+		chunks: []string{"\x12ssh\r"},
+		want:   []line{{command: "ssh", uncertain: true}},
+	}, {
+		name:   "unknown escape",
+		chunks: []string{"ls\x1b[Z\r"},
+		want:   []line{{command: "ls", uncertain: true}},
+	}, {
+		name:   "history expansion",
+		chunks: []string{"sudo !!\r", "echo \"!$\"\r", "^rm^ls\r"},
+		want:   []line{{command: "sudo !!", uncertain: true}, {command: `echo "!$"`, uncertain: true}, {command: "^rm^ls", uncertain: true}},
+	}, {
+		name:   "! not expanded",
+		chunks: []string{"echo hi! != 'a!b' \\!x\r"},
+		want:   []line{{command: `echo hi! != 'a!b' \!x`}},
+	}, {
+		name:   "continued on the next line",
+		chunks: []string{"rm -rf \\\r", "echo \\\\\r"},
+		want:   []line{{command: `rm -rf \`, uncertain: true}, {command: `echo \\`}},
+	}, {
+		name:   "uncertainty does not carry over",
+		chunks: []string{"a\t\r", "b\r"},
+		want:   []line{{command: "a", uncertain: true}, {command: "b"}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newLineEditor()
+			var got []line
+			for _, chunk := range test.chunks {
+				for _, l := range e.feed([]byte(chunk)) {
+					got = append(got, line{command: l.Command, uncertain: l.Uncertain})
+				}
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got lines %+v, want %+v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("line %d = %+v, want %+v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLineEditorRaw(t *testing.T) {
+	e := newLineEditor()
+	e.feed([]byte("l"))
+	lines := e.feed([]byte("s\x1b[D\r"))
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(lines))
+	}
+	if got, want := string(lines[0].Raw), "ls\x1b[D\r"; got != want {
+		t.Errorf("raw %q, want %q", got, want)
+	}
+}
+
+func TestLineEditorSubmits(t *testing.T) {
+	tests := []struct {
+		name          string
+		typed         string
+		b             byte
+		want          string
+		submits       bool
+		wantUncertain bool
+	}{
+		{"carriage return", "ls", '\r', "ls", true, false},
+		{"newline", "ls", '\n', "ls", true, false},
+		{"other byte", "ls", 'x', "", false, false},
+		{"within an escape sequence", "ls\x1b", '\r', "ls", true, true},
+		{"within a control sequence", "ls\x1b[", '\r', "ls", true, true},
+		{"within a UTF-8 character", "ls\xc3", '\r', "ls\ufffd", true, true},
+		{"within a bracketed paste", "\x1b[200~ls", '\r', "ls", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newLineEditor()
+			e.feed([]byte(test.typed))
+			line, ok := e.submits(test.b)
+			if ok != test.submits || line.Command != test.want || line.Uncertain != test.wantUncertain {
+				t.Errorf("submits(%q) = %q, %v, uncertain %v, want %q, %v, uncertain %v", test.b,
+					line.Command, ok, line.Uncertain, test.want, test.submits, test.wantUncertain)
+			}
+			// submits must not change the line being edited.
+			if got := string(e.line); ok && got != test.want {
+				t.Errorf("line changed to %q", got)
+			}
+		})
+	}
+}
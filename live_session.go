@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// SessionPty is the terminal of a PTY session.
+type SessionPty struct {
+	Term   string `json:"term"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// SessionInfo describes a session being proxied, as listed by the admin API.
+type SessionInfo struct {
+	// ID identifies the session in the admin API. It is the session's
+	// Channel, as its recording is named.
+	ID      string         `json:"id"`
+	Session SessionDetails `json:"session"`
+	// Type is "pty" or "exec".
+	Type    string    `json:"type"`
+	Started time.Time `json:"started"`
+
+	// BytesIn and BytesOut are the bytes relayed from the client to the
+	// target and back.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+
+	Pty *SessionPty `json:"pty,omitempty"`
+
+	// PendingApproval is the command the session is waiting on an admin to
+	// approve, if any.
+	PendingApproval *PendingApproval `json:"pending_approval,omitempty"`
+
+	// Paused is set while an admin has paused the session.
+	Paused bool `json:"paused,omitempty"`
+
+	// Terminated is set once an admin has terminated the session, which is
+	// listed until it has closed.
+	Terminated bool `json:"terminated,omitempty"`
+}
+
+// PendingApproval is a command held until an admin approves or rejects it.
+type PendingApproval struct {
+	Command string `json:"command"`
+	// Rule is the name of the policy rule requiring approval.
+	Rule      string    `json:"rule,omitempty"`
+	Requested time.Time `json:"requested"`
+}
+
+// liveSession is a session being proxied, which the admin API can inspect and
+// control.
+type liveSession struct {
+	id          string
+	details     SessionDetails
+	sessionType string
+	started     time.Time
+	session     gliderssh.Session
+	audit       *sessionAudit
+	// closed is closed once the client's connection has closed.
+	closed <-chan struct{}
+
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	mu         sync.Mutex
+	pty        *SessionPty
+	target     *ssh.Session
+	terminated bool
+	ended      bool
+	watchers   map[*sessionWatcher]struct{}
+	// stdin is the target's input, gated by gate, and controller the
+	// watcher in control of the session, if any.
+	stdin      io.Writer
+	gate       *commandGate
+	controller *sessionWatcher
+	// resumed is set while the session is paused, and closed once it is
+	// resumed.
+	resumed chan struct{}
+	// approval is the command waiting on an admin's approval, if any.
+	approval *commandApproval
+}
+
+// commandApproval is a command waiting on an admin's approval.
+type commandApproval struct {
+	PendingApproval
+	// decided receives the admin's decision.
+	decided chan approvalDecision
+}
+
+// approvalDecision is the outcome of a commandApproval.
+type approvalDecision struct {
+	approved bool
+	// admin is empty if the command was rejected without an admin, such as
+	// when the approval timed out.
+	admin  string
+	reason string
+}
+
+// shadowMessage is an update sent to the admins watching a session, either
+// output written to the client or the new size of its terminal.
+type shadowMessage struct {
+	output []byte
+	resize *SessionPty
+}
+
+// sessionWatcherBuffer is the number of updates buffered for an admin watching
+// a session, beyond which they are detached rather than hold up the session.
+const sessionWatcherBuffer = 256
+
+// sessionWatcher is an admin watching a session.
+type sessionWatcher struct {
+	admin string
+	// notify tells the user when the admin attaches and detaches.
+	notify bool
+	// messages is closed once the watcher is detached, and reason set to
+	// why.
+	messages chan shadowMessage
+	reason   string
+	// input audits the admin's keystrokes while they are in control.
+	input *lineRedactor
+}
+
+var (
+	// errSessionEnded is returned when taking control of, or sending input
+	// to, a session which has ended or been terminated.
+	errSessionEnded = errors.New("session ended")
+	// errNoSessionInput is returned when taking control of a session without
+	// input, such as an exec session.
+	errNoSessionInput = errors.New("session has no input to control")
+	// errSessionControlled is returned when taking control of a session
+	// another admin is in control of.
+	errSessionControlled = errors.New("session is controlled by another admin")
+	// errSessionPaused and errSessionNotPaused are returned when pausing a
+	// paused session, or resuming one which is not.
+	errSessionPaused    = errors.New("session is already paused")
+	errSessionNotPaused = errors.New("session is not paused")
+)
+
+// lockedWriter serializes writes to w, so the input of the user and of an
+// admin in control of the session is never interleaved mid-write.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func newLiveSession(s gliderssh.Session, audit *sessionAudit, details SessionDetails) *liveSession {
+	return &liveSession{
+		details:     details,
+		sessionType: sessionType(s),
+		started:     time.Now(),
+		session:     s,
+		audit:       audit,
+		closed:      s.Context().Done(),
+	}
+}
+
+// info returns the session's SessionInfo.
+func (l *liveSession) info() SessionInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info := SessionInfo{
+		ID:         l.id,
+		Session:    l.details,
+		Type:       l.sessionType,
+		Started:    l.started,
+		BytesIn:    l.bytesIn.Load(),
+		BytesOut:   l.bytesOut.Load(),
+		Paused:     l.resumed != nil,
+		Terminated: l.terminated,
+	}
+	if l.approval != nil {
+		approval := l.approval.PendingApproval
+		info.PendingApproval = &approval
+	}
+	if l.pty != nil {
+		pty := *l.pty
+		info.Pty = &pty
+	}
+	return info
+}
+
+// setPty records the session's terminal.
+func (l *liveSession) setPty(term string, width, height int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pty = &SessionPty{Term: term, Width: width, Height: height}
+}
+
+// resize records a change of the session's terminal size.
+func (l *liveSession) resize(width, height int) {
+	l.mu.Lock()
+	if l.pty == nil {
+		l.mu.Unlock()
+		return
+	}
+	l.pty.Width, l.pty.Height = width, height
+	pty := *l.pty
+	l.mu.Unlock()
+	l.broadcast(shadowMessage{resize: &pty})
+}
+
+// attach starts admin watching the session. It reports false if the session
+// has ended.
+func (l *liveSession) attach(admin string, notify bool) (*sessionWatcher, bool) {
+	w := &sessionWatcher{
+		admin:    admin,
+		notify:   notify,
+		messages: make(chan shadowMessage, sessionWatcherBuffer),
+	}
+	l.mu.Lock()
+	if l.ended {
+		l.mu.Unlock()
+		return nil, false
+	}
+	if l.watchers == nil {
+		l.watchers = map[*sessionWatcher]struct{}{}
+	}
+	l.watchers[w] = struct{}{}
+	l.mu.Unlock()
+
+	l.audit.emit(l.details, ShadowEvent{
+		Admin:  admin,
+		Action: ShadowAttach,
+	})
+	if notify {
+		l.notice(admin + " is watching this session")
+	}
+	return w, true
+}
+
+// detach stops w watching the session, releasing control of it and closing
+// its messages. It does nothing if w has already been detached.
+func (l *liveSession) detach(w *sessionWatcher, reason string) {
+	l.releaseControl(w, reason)
+
+	l.mu.Lock()
+	if _, ok := l.watchers[w]; !ok {
+		l.mu.Unlock()
+		return
+	}
+	delete(l.watchers, w)
+	w.reason = reason
+	close(w.messages)
+	l.mu.Unlock()
+
+	l.audit.emit(l.details, ShadowEvent{
+		Admin:  w.admin,
+		Action: ShadowDetach,
+		Reason: reason,
+	})
+	if w.notify {
+		l.notice(w.admin + " stopped watching this session")
+	}
+}
+
+// setStdin records the target's input, so an admin can take control of the
+// session, and the gate the user's input goes through, which the admin's goes
+// through too. Writes to stdin must be serialized, see lockedWriter.
+func (l *liveSession) setStdin(stdin io.Writer, gate *commandGate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stdin = stdin
+	l.gate = gate
+}
+
+// takeControl gives w, an attached watcher, control of the session, so its
+// input is sent to the target alongside the user's. Its input is redacted
+// with redactor and audited line by line.
+func (l *liveSession) takeControl(w *sessionWatcher, redactor *Redactor) error {
+	l.mu.Lock()
+	switch {
+	case l.ended:
+		l.mu.Unlock()
+		return errSessionEnded
+	case l.stdin == nil:
+		l.mu.Unlock()
+		return errNoSessionInput
+	case l.controller != nil:
+		l.mu.Unlock()
+		return errSessionControlled
+	}
+	l.controller = w
+	w.input = redactor.newLineRedactor(func(input []byte) {
+		l.audit.emit(l.details, AdminInputEvent{
+			Admin: w.admin,
+			Data:  string(input),
+		})
+	})
+	l.mu.Unlock()
+
+	l.audit.emit(l.details, ShadowEvent{
+		Admin:  w.admin,
+		Action: ShadowTakeControl,
+	})
+	l.notice(w.admin + " has taken control of this session, their keystrokes are sent alongside yours")
+	return nil
+}
+
+// releaseControl takes control of the session away from w, if it has it.
+func (l *liveSession) releaseControl(w *sessionWatcher, reason string) {
+	l.mu.Lock()
+	if l.controller != w {
+		l.mu.Unlock()
+		return
+	}
+	l.controller = nil
+	l.mu.Unlock()
+
+	w.input.flush()
+	l.audit.emit(l.details, ShadowEvent{
+		Admin:  w.admin,
+		Action: ShadowReleaseControl,
+		Reason: reason,
+	})
+	l.notice(w.admin + " has released control of this session")
+}
+
+// inject sends input from w, which must be in control of the session, to the
+// target through the session's command gate. Input held while the session is
+// paused is dropped if it is terminated. It returns the number of bytes sent,
+// which differs from len(input) if the gate erased a denied line.
+func (l *liveSession) inject(w *sessionWatcher, input []byte) (int, error) {
+	l.mu.Lock()
+	if l.controller != w {
+		l.mu.Unlock()
+		return 0, errors.New("not in control of the session")
+	}
+	stdin, gate := l.stdin, l.gate
+	l.mu.Unlock()
+
+	if !l.waitResumed() {
+		return 0, errSessionEnded
+	}
+	sent := 0
+	err := gate.forward(input, func(p []byte) error {
+		n, err := stdin.Write(p)
+		sent += n
+		l.bytesIn.Add(uint64(n))
+		w.input.write(p[:n])
+		return err
+	})
+	return sent, err
+}
+
+// notice shows msg in the user's terminal, and to the session's watchers.
+func (l *liveSession) notice(msg string) {
+	text := "\r\n*** " + msg + " ***\r\n"
+	io.WriteString(l.session.Stderr(), text)
+	l.writeOutput([]byte(text))
+}
+
+// broadcast sends msg to the session's watchers, detaching those which have
+// fallen behind.
+func (l *liveSession) broadcast(msg shadowMessage) {
+	var behind []*sessionWatcher
+	l.mu.Lock()
+	for w := range l.watchers {
+		select {
+		case w.messages <- msg:
+		default:
+			behind = append(behind, w)
+		}
+	}
+	l.mu.Unlock()
+	for _, w := range behind {
+		l.detach(w, "watcher fell behind")
+	}
+}
+
+// writeOutput sends output written to the client to the session's watchers.
+func (l *liveSession) writeOutput(p []byte) {
+	l.mu.Lock()
+	watched := len(l.watchers) > 0
+	l.mu.Unlock()
+	if watched {
+		l.broadcast(shadowMessage{output: bytes.Clone(p)})
+	}
+}
+
+// pause holds the session's input and output on behalf of admin, telling the
+// user why, until it is resumed or terminated.
+func (l *liveSession) pause(admin, reason string) error {
+	l.mu.Lock()
+	switch {
+	case l.ended || l.terminated:
+		l.mu.Unlock()
+		return errSessionEnded
+	case l.resumed != nil:
+		l.mu.Unlock()
+		return errSessionPaused
+	}
+	l.resumed = make(chan struct{})
+	l.mu.Unlock()
+
+	l.audit.emit(l.details, PauseEvent{
+		Admin:  admin,
+		Reason: reason,
+	})
+	message := "Session paused by an administrator, your input and its output are held"
+	if reason != "" {
+		message += ": " + reason
+	}
+	l.notice(message)
+	return nil
+}
+
+// resume releases the session's held input and output on behalf of admin.
+func (l *liveSession) resume(admin, reason string) error {
+	l.mu.Lock()
+	if l.resumed == nil {
+		l.mu.Unlock()
+		return errSessionNotPaused
+	}
+	l.unpauseLocked()
+	l.mu.Unlock()
+
+	l.audit.emit(l.details, ResumeEvent{
+		Admin:  admin,
+		Reason: reason,
+	})
+	l.notice("Session resumed by an administrator")
+	return nil
+}
+
+func (l *liveSession) unpauseLocked() {
+	if l.resumed != nil {
+		close(l.resumed)
+		l.resumed = nil
+	}
+}
+
+// waitResumed waits while the session is paused, returning once it is
+// resumed, terminated or the client's connection closes. It reports false if
+// the session was terminated or its connection closed, so input and output
+// held while it was paused must be dropped.
+func (l *liveSession) waitResumed() bool {
+	l.mu.Lock()
+	resumed := l.resumed
+	l.mu.Unlock()
+	if resumed != nil {
+		select {
+		case <-resumed:
+		case <-l.closed:
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.terminated {
+		return false
+	}
+	select {
+	case <-l.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// heldWriter holds writes to w while the session is paused, dropping them
+// once it is terminated.
+type heldWriter struct {
+	live *liveSession
+	w    io.Writer
+}
+
+func (h heldWriter) Write(p []byte) (int, error) {
+	if !h.live.waitResumed() {
+		return 0, errSessionEnded
+	}
+	return h.w.Write(p)
+}
+
+// end marks the session as ended, detaching its watchers.
+func (l *liveSession) end() {
+	l.mu.Lock()
+	l.ended = true
+	l.unpauseLocked()
+	watchers := make([]*sessionWatcher, 0, len(l.watchers))
+	for w := range l.watchers {
+		watchers = append(watchers, w)
+	}
+	l.mu.Unlock()
+	for _, w := range watchers {
+		l.detach(w, "session ended")
+	}
+}
+
+// setTarget records the target session, so terminating the session closes
+// it. It reports false if the session has already been terminated.
+func (l *liveSession) setTarget(target *ssh.Session) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.target = target
+	return !l.terminated
+}
+
+// terminate ends the session on behalf of admin, telling the user why. It
+// reports false if the session was already terminated.
+func (l *liveSession) terminate(admin, reason string) bool {
+	l.mu.Lock()
+	if l.terminated {
+		l.mu.Unlock()
+		return false
+	}
+	l.terminated = true
+	l.unpauseLocked()
+	l.decideApprovalLocked(approvalDecision{admin: admin, reason: "session terminated"})
+	target := l.target
+	l.mu.Unlock()
+
+	l.audit.emit(l.details, TerminateEvent{
+		Admin:  admin,
+		Reason: reason,
+	})
+	message := "Session terminated by an administrator"
+	if reason != "" {
+		message += ": " + reason
+	}
+	l.notice(message)
+	if target != nil {
+		target.Close()
+	}
+	l.session.Close()
+	return true
+}
+
+// awaitApproval holds command, which the policy rule named rule requires
+// approval for, until an admin approves or rejects it. It is rejected if the
+// session is terminated or its connection closes, or timeout passes first,
+// 0 waiting for as long as the session lasts.
+func (l *liveSession) awaitApproval(command, rule string, timeout time.Duration) approvalDecision {
+	a := &commandApproval{
+		PendingApproval: PendingApproval{
+			Command:   command,
+			Rule:      rule,
+			Requested: time.Now(),
+		},
+		decided: make(chan approvalDecision, 1),
+	}
+	l.mu.Lock()
+	if l.terminated || l.ended {
+		l.mu.Unlock()
+		return approvalDecision{reason: "session terminated"}
+	}
+	l.approval = a
+	l.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var d approvalDecision
+	select {
+	case d = <-a.decided:
+		return d
+	case <-expired:
+		d.reason = "approval timed out"
+	case <-l.closed:
+		d.reason = "client disconnected"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.approval != a {
+		// An admin decided in the meantime.
+		return <-a.decided
+	}
+	l.approval = nil
+	return d
+}
+
+// decideApproval approves or rejects the command the session is waiting on
+// approval of, on behalf of admin.
+func (l *liveSession) decideApproval(admin string, approved bool, reason string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.approval == nil {
+		return errNoPendingApproval
+	}
+	l.decideApprovalLocked(approvalDecision{approved: approved, admin: admin, reason: reason})
+	return nil
+}
+
+func (l *liveSession) decideApprovalLocked(d approvalDecision) {
+	if l.approval != nil {
+		l.approval.decided <- d
+		l.approval = nil
+	}
+}
+
+// sessionRegistry holds the sessions being proxied.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*liveSession
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: map[string]*liveSession{}}
+}
+
+// add registers l under its channel's name.
+func (r *sessionRegistry) add(l *liveSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l.id = l.details.Channel
+	r.sessions[l.id] = l
+}
+
+func (r *sessionRegistry) remove(l *liveSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, l.id)
+}
+
+// get returns the session with the given ID, or nil if there is none.
+func (r *sessionRegistry) get(id string) *liveSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// list returns the sessions, oldest first.
+func (r *sessionRegistry) list() []SessionInfo {
+	r.mu.Lock()
+	sessions := make([]*liveSession, 0, len(r.sessions))
+	for _, l := range r.sessions {
+		sessions = append(sessions, l)
+	}
+	r.mu.Unlock()
+
+	infos := make([]SessionInfo, len(sessions))
+	for i, l := range sessions {
+		infos[i] = l.info()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
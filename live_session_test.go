@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWaitResumed(t *testing.T) {
+	tests := []struct {
+		name   string
+		paused bool
+		// then is done to the session while waitResumed waits.
+		then func(l *liveSession, closed chan struct{})
+		want bool
+	}{{
+		name: "not paused",
+		want: true,
+	}, {
+		name:   "resumed",
+		paused: true,
+		then: func(l *liveSession, closed chan struct{}) {
+			l.mu.Lock()
+			l.unpauseLocked()
+			l.mu.Unlock()
+		},
+		want: true,
+	}, {
+		name:   "terminated while paused",
+		paused: true,
+		then: func(l *liveSession, closed chan struct{}) {
+			// As terminate does, without telling the user.
+			l.mu.Lock()
+			l.terminated = true
+			l.unpauseLocked()
+			l.mu.Unlock()
+		},
+		want: false,
+	}, {
+		name:   "connection closed while paused",
+		paused: true,
+		then:   func(l *liveSession, closed chan struct{}) { close(closed) },
+		want:   false,
+	}, {
+		name: "terminated",
+		then: func(l *liveSession, closed chan struct{}) {
+			l.mu.Lock()
+			l.terminated = true
+			l.mu.Unlock()
+		},
+		want: false,
+	}, {
+		name: "connection closed",
+		then: func(l *liveSession, closed chan struct{}) { close(closed) },
+		want: false,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			closed := make(chan struct{})
+			l := &liveSession{closed: closed}
+			if test.paused {
+				l.resumed = make(chan struct{})
+			}
+			result := make(chan bool, 1)
+			if !test.paused && test.then != nil {
+				test.then(l, closed)
+			}
+			go func() { result <- l.waitResumed() }()
+			if test.paused {
+				select {
+				case <-result:
+					t.Fatal("waitResumed() returned while paused")
+				case <-time.After(10 * time.Millisecond):
+				}
+				test.then(l, closed)
+			}
+			select {
+			case got := <-result:
+				if got != test.want {
+					t.Errorf("waitResumed() = %v, want %v", got, test.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("waitResumed() did not return")
+			}
+		})
+	}
+}
+
+func TestInjectDropsHeldInput(t *testing.T) {
+	tests := []struct {
+		name    string
+		end     func(l *liveSession, closed chan struct{})
+		wantErr error
+	}{{
+		name: "resumed",
+		end: func(l *liveSession, closed chan struct{}) {
+			l.mu.Lock()
+			l.unpauseLocked()
+			l.mu.Unlock()
+		},
+	}, {
+		name: "terminated",
+		end: func(l *liveSession, closed chan struct{}) {
+			l.mu.Lock()
+			l.terminated = true
+			l.unpauseLocked()
+			l.mu.Unlock()
+		},
+		wantErr: errSessionEnded,
+	}, {
+		name:    "connection closed",
+		end:     func(l *liveSession, closed chan struct{}) { close(closed) },
+		wantErr: errSessionEnded,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			closed := make(chan struct{})
+			stdin := &lockedBuffer{}
+			w := &sessionWatcher{admin: "alice", input: (&Redactor{}).newLineRedactor(func([]byte) {})}
+			l := &liveSession{closed: closed, stdin: stdin, controller: w, resumed: make(chan struct{})}
+
+			injected := make(chan error, 1)
+			go func() {
+				_, err := l.inject(w, []byte("ls\r"))
+				injected <- err
+			}()
+			time.Sleep(10 * time.Millisecond)
+			if stdin.String() != "" {
+				t.Fatal("input injected while paused")
+			}
+			test.end(l, closed)
+			if err := <-injected; err != test.wantErr {
+				t.Errorf("inject() = %v, want %v", err, test.wantErr)
+			}
+			want := "ls\r"
+			if test.wantErr != nil {
+				want = ""
+			}
+			if got := stdin.String(); got != want {
+				t.Errorf("target received %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -11,6 +12,9 @@ import (
 )
 
 func main() {
+	commandPolicy := flag.String("command-policy", "", "path to a JSON command policy file, see LoadCommandPolicyConfig")
+	flag.Parse()
+
 	config := zap.NewDevelopmentEncoderConfig()
 	config.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	config.EncodeTime = nil
@@ -22,8 +26,21 @@ func main() {
 	zapctx.Default = zap.New(core)
 	zapctx.LogLevel.SetLevel(zapcore.DebugLevel)
 
+	var opts []ServerOption
+	if *commandPolicy != "" {
+		cfg, err := LoadCommandPolicyConfig(*commandPolicy)
+		if err != nil {
+			log.Fatalf("failed to load command policy: %v", err)
+		}
+		policy, err := NewCommandPolicy(cfg)
+		if err != nil {
+			log.Fatalf("invalid command policy %s: %v", *commandPolicy, err)
+		}
+		opts = append(opts, WithCommandPolicy(policy))
+	}
+
 	auditLogger := NewSSHAuditLogger()
-	mitmServer := NewMITMAuditingSSHServerWithHTTP(auditLogger)
+	mitmServer := NewMITMAuditingSSHServerWithHTTP(auditLogger, opts...)
 
 	fmt.Println("starting ssh server on port 2222...")
 	log.Fatal(mitmServer.Start())
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricVec is a counter or gauge, with a series for each combination of its
+// label values.
+type metricVec struct {
+	name, help string
+	// kind is the metric's Prometheus type, "counter" or "gauge".
+	kind   string
+	labels []string
+
+	mu sync.Mutex
+	// series holds the value of each series, keyed by its encoded labels.
+	series map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return newMetricVec(name, help, "counter", labels)
+}
+
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return newMetricVec(name, help, "gauge", labels)
+}
+
+func newMetricVec(name, help, kind string, labels []string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, series: map[string]float64{}}
+	if len(labels) == 0 {
+		// A metric without labels has its single series from the start.
+		m.series[""] = 0
+	}
+	return m
+}
+
+// add adds v to the series of labelValues, given in the order of the
+// metric's labels.
+func (m *metricVec) add(v float64, labelValues ...string) {
+	key := encodeLabels(m.labels, labelValues)
+	m.mu.Lock()
+	m.series[key] += v
+	m.mu.Unlock()
+}
+
+// set sets the series of labelValues to v.
+func (m *metricVec) set(v float64, labelValues ...string) {
+	key := encodeLabels(m.labels, labelValues)
+	m.mu.Lock()
+	m.series[key] = v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeMetricHeader(w, m.name, m.help, m.kind)
+	for _, key := range sortedKeys(m.series) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, key, formatMetricValue(m.series[key]))
+	}
+}
+
+// histogramVec is a histogram, with a series for each combination of its
+// label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	// buckets are the upper bounds of the buckets, in increasing order.
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	// counts holds the number of observations in each bucket, and those
+	// above the last bucket.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// observe records v in the series of labelValues.
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := encodeLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatMetricValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+var (
+	metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	metricHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// encodeLabels encodes label pairs as they are written in the text
+// exposition format, such as {direction="in"}, or "" when there are none.
+func encodeLabels(names, values []string) string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("metric has %d labels, given %d values", len(names), len(values)))
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + metricLabelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label pair to encoded labels.
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + metricLabelEscaper.Replace(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + pair + "}"
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, metricHelpEscaper.Replace(help), name, kind)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+const (
+	// directionClientToTarget and directionTargetToClient label the bytes
+	// relayed in each direction.
+	directionClientToTarget = "client_to_target"
+	directionTargetToClient = "target_to_client"
+)
+
+// proxyMetrics are the metrics of a MITMAuditingSSHServerWithHTTP, served in
+// the Prometheus text exposition format.
+type proxyMetrics struct {
+	sessionsActive    *metricVec
+	sessionsTotal     *metricVec
+	sessionsRefused   *metricVec
+	sessionDuration   *histogramVec
+	dialDuration      *histogramVec
+	dialFailures      *metricVec
+	bytes             *metricVec
+	inputDroppedBytes *metricVec
+	inputQueueDepth   *metricVec
+	inputQueueDropped *metricVec
+	auditQueueDepth   *metricVec
+}
+
+func newProxyMetrics() *proxyMetrics {
+	m := &proxyMetrics{
+		sessionsActive: newGaugeVec(
+			"ssh_proxy_sessions_active",
+			"Number of sessions being proxied, by type.",
+			"type",
+		),
+		sessionsTotal: newCounterVec(
+			"ssh_proxy_sessions_total",
+			"Number of sessions proxied, by type.",
+			"type",
+		),
+		sessionsRefused: newCounterVec(
+			"ssh_proxy_sessions_refused_total",
+			"Number of CONNECT requests refused because the session could not be audited.",
+		),
+		sessionDuration: newHistogramVec(
+			"ssh_proxy_session_duration_seconds",
+			"Duration of proxied sessions, by type.",
+			[]float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 7200, 14400, 28800},
+			"type",
+		),
+		dialDuration: newHistogramVec(
+			"ssh_proxy_target_dial_duration_seconds",
+			"Time taken to connect to targets, including failed attempts.",
+			[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		),
+		dialFailures: newCounterVec(
+			"ssh_proxy_target_dial_failures_total",
+			"Number of failed attempts to connect to targets.",
+		),
+		bytes: newCounterVec(
+			"ssh_proxy_bytes_total",
+			"Bytes relayed between clients and targets, by direction.",
+			"direction",
+		),
+		inputDroppedBytes: newCounterVec(
+			"ssh_proxy_audit_input_dropped_bytes_total",
+			"Bytes of PTY input left unaudited because the audit input queue was full.",
+		),
+		inputQueueDepth: newGaugeVec(
+			"ssh_proxy_input_queue_depth",
+			"Number of chunks of PTY input queued for auditing, across sessions.",
+		),
+		inputQueueDropped: newCounterVec(
+			"ssh_proxy_input_queue_dropped_total",
+			"Number of chunks of PTY input dropped because the input queue was full, by overflow policy.",
+			"policy",
+		),
+		auditQueueDepth: newGaugeVec(
+			"ssh_proxy_audit_queue_depth",
+			"Number of audit events queued to be handed to the sink, across connections.",
+		),
+	}
+	// The series known up front start at 0, rather than appear on first use.
+	for _, sessionType := range []string{"pty", "exec"} {
+		m.sessionsActive.add(0, sessionType)
+		m.sessionsTotal.add(0, sessionType)
+	}
+	m.bytes.add(0, directionClientToTarget)
+	m.bytes.add(0, directionTargetToClient)
+	for _, policy := range []OverflowPolicy{OverflowDrop, OverflowKill} {
+		m.inputQueueDropped.add(0, policy.String())
+	}
+	return m
+}
+
+// handler returns the handler serving the metrics, along with those of the
+// sinks behind sink.
+func (m *proxyMetrics) handler(sink EventSink) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.sessionsActive.write(w)
+		m.sessionsTotal.write(w)
+		m.sessionsRefused.write(w)
+		m.sessionDuration.write(w)
+		m.dialDuration.write(w)
+		m.dialFailures.write(w)
+		m.bytes.write(w)
+		m.inputDroppedBytes.write(w)
+		m.inputQueueDepth.write(w)
+		m.inputQueueDropped.write(w)
+		m.auditQueueDepth.write(w)
+		if health := sinkHealth(sink); health != nil {
+			writeSinkMetrics(w, health)
+		}
+	})
+}
+
+// writeSinkMetrics writes the metrics of the sinks behind the proxy's sink.
+func writeSinkMetrics(w io.Writer, health []SinkHealth) {
+	queued := newGaugeVec("ssh_proxy_audit_sink_queue_depth", "Number of audit events queued for each sink.", "sink")
+	healthy := newGaugeVec("ssh_proxy_audit_sink_healthy", "Whether each audit sink is healthy.", "sink")
+	delivered := newCounterVec("ssh_proxy_audit_events_delivered_total", "Number of audit events delivered to each sink.", "sink")
+	dropped := newCounterVec("ssh_proxy_audit_events_dropped_total", "Number of audit events dropped because a sink's queue was full.", "sink")
+	failed := newCounterVec("ssh_proxy_audit_events_failed_total", "Number of audit events a sink failed to deliver.", "sink")
+	for _, h := range health {
+		queued.set(float64(h.Queued), h.Name)
+		healthy.set(0, h.Name)
+		if h.Healthy {
+			healthy.set(1, h.Name)
+		}
+		delivered.set(float64(h.Delivered), h.Name)
+		dropped.set(float64(h.Dropped), h.Name)
+		failed.set(float64(h.Failed), h.Name)
+	}
+	for _, metric := range []*metricVec{queued, healthy, delivered, dropped, failed} {
+		metric.write(w)
+	}
+}
+
+// sessionStarted records the start of a session of the given type, returning
+// a function recording its end.
+func (m *proxyMetrics) sessionStarted(sessionType string) func() {
+	start := time.Now()
+	m.sessionsTotal.add(1, sessionType)
+	m.sessionsActive.add(1, sessionType)
+	return func() {
+		m.sessionsActive.add(-1, sessionType)
+		m.sessionDuration.observe(time.Since(start).Seconds(), sessionType)
+	}
+}
+
+// countingWriter counts the bytes successfully written to w, passing them to
+// written if it is set.
+type countingWriter struct {
+	w       io.Writer
+	count   func(n int)
+	written func(p []byte)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if n > 0 {
+		c.count(n)
+		if c.written != nil {
+			c.written(p[:n])
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric func() interface{ write(io.Writer) }
+		want   string
+	}{{
+		name: "counter without labels",
+		metric: func() interface{ write(io.Writer) } {
+			m := newCounterVec("requests_total", "Number of requests.")
+			m.add(2)
+			m.add(1.5)
+			return m
+		},
+		want: "# HELP requests_total Number of requests.\n# TYPE requests_total counter\nrequests_total 3.5\n",
+	}, {
+		name: "gauge with escaped labels, sorted",
+		metric: func() interface{ write(io.Writer) } {
+			m := newGaugeVec("depth", "Queue\ndepth \\ by sink.", "sink")
+			m.set(3, `b"c`)
+			m.set(1, "a\\\n")
+			return m
+		},
+		want: "# HELP depth Queue\\ndepth \\\\ by sink.\n# TYPE depth gauge\n" +
+			"depth{sink=\"a\\\\\\n\"} 1\ndepth{sink=\"b\\\"c\"} 3\n",
+	}, {
+		name: "histogram",
+		metric: func() interface{ write(io.Writer) } {
+			h := newHistogramVec("duration_seconds", "Durations.", []float64{0.5, 1}, "type")
+			h.observe(0.25, "pty")
+			h.observe(1, "pty")
+			h.observe(2, "pty")
+			return h
+		},
+		want: "# HELP duration_seconds Durations.\n# TYPE duration_seconds histogram\n" +
+			"duration_seconds_bucket{type=\"pty\",le=\"0.5\"} 1\n" +
+			"duration_seconds_bucket{type=\"pty\",le=\"1\"} 2\n" +
+			"duration_seconds_bucket{type=\"pty\",le=\"+Inf\"} 3\n" +
+			"duration_seconds_sum{type=\"pty\"} 3.25\n" +
+			"duration_seconds_count{type=\"pty\"} 3\n",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var b bytes.Buffer
+			test.metric().write(&b)
+			if b.String() != test.want {
+				t.Errorf("wrote\n%s\nwant\n%s", b.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestFormatMetricValue(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{1e6, "1e+06"},
+		{0.005, "0.005"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+	}
+	for _, test := range tests {
+		if got := formatMetricValue(test.v); got != test.want {
+			t.Errorf("formatMetricValue(%v) = %q, want %q", test.v, got, test.want)
+		}
+	}
+}
+
+func TestWriteSinkMetrics(t *testing.T) {
+	var b bytes.Buffer
+	writeSinkMetrics(&b, []SinkHealth{
+		{Name: "file", Healthy: true, Queued: 2, Delivered: 10},
+		{Name: "siem", Healthy: false, Dropped: 3, Failed: 4},
+	})
+	for _, want := range []string{
+		`ssh_proxy_audit_sink_queue_depth{sink="file"} 2`,
+		`ssh_proxy_audit_sink_healthy{sink="file"} 1`,
+		`ssh_proxy_audit_sink_healthy{sink="siem"} 0`,
+		`ssh_proxy_audit_events_delivered_total{sink="file"} 10`,
+		`ssh_proxy_audit_events_dropped_total{sink="siem"} 3`,
+		`ssh_proxy_audit_events_failed_total{sink="siem"} 4`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("sink metrics do not contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+// scrapeMetrics returns the value of each series the proxy serves on /metrics.
+func scrapeMetrics(t *testing.T, p *testProxy) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(p.http.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	series := map[string]float64{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad metric line %q: %v", line, err)
+		}
+		series[line[:i]] = v
+	}
+	return series
+}
+
+func TestMetricsSinkHealth(t *testing.T) {
+	multi := func(t *testing.T) EventSink {
+		multi, err := NewMultiSink(MultiSinkTarget{Name: "file", Sink: &testSink{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { multi.Close() })
+		return multi
+	}
+	tests := []struct {
+		name string
+		sink func(t *testing.T) EventSink
+		want bool
+	}{{
+		name: "plain sink",
+		sink: func(t *testing.T) EventSink { return &testSink{} },
+	}, {
+		name: "multi sink",
+		sink: multi,
+		want: true,
+	}, {
+		name: "hash chain over a multi sink",
+		sink: func(t *testing.T) EventSink {
+			cfg := DefaultHashChainConfig(newTestSigningKey(t))
+			cfg.CheckpointInterval = 0
+			chain, err := NewHashChainSink(cfg, multi(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return chain
+		},
+		want: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProxy(t, test.sink(t), echoTarget)
+			defer p.close()
+			metrics := scrapeMetrics(t, p)
+			// The connections' audit queue is served whatever the sink.
+			if _, ok := metrics["ssh_proxy_audit_queue_depth"]; !ok {
+				t.Errorf("ssh_proxy_audit_queue_depth not served")
+			}
+			if _, ok := metrics[`ssh_proxy_audit_sink_healthy{sink="file"}`]; ok != test.want {
+				t.Errorf("sink health served %v, want %v", ok, test.want)
+			}
+		})
+	}
+}
+
+func TestMetricsQueues(t *testing.T) {
+	stuck := &testSink{release: make(chan struct{})}
+	p := newTestProxy(t, stuck, echoTarget,
+		WithInputQueue(InputQueueConfig{Size: 64, Overflow: OverflowDrop}),
+		WithEchoTimeout(10*time.Millisecond),
+	)
+	defer p.close()
+
+	metrics := scrapeMetrics(t, p)
+	for _, series := range []string{
+		"ssh_proxy_input_queue_depth",
+		"ssh_proxy_audit_queue_depth",
+		`ssh_proxy_input_queue_dropped_total{policy="drop"}`,
+		`ssh_proxy_input_queue_dropped_total{policy="kill"}`,
+	} {
+		if v, ok := metrics[series]; !ok || v != 0 {
+			t.Errorf("%s = %v (served %v), want 0", series, v, ok)
+		}
+	}
+
+	// With the sink stuck, the audit queue fills, then the input queue,
+	// which then drops input.
+	client := p.dial(t)
+	_, stdin, _ := startShell(t, client)
+	waitFor(t, func() bool {
+		stdin.Write(bytes.Repeat([]byte("a\r"), 64))
+		metrics := scrapeMetrics(t, p)
+		return metrics["ssh_proxy_audit_queue_depth"] == auditQueueSize &&
+			metrics["ssh_proxy_input_queue_depth"] > 0 &&
+			metrics[`ssh_proxy_input_queue_dropped_total{policy="drop"}`] > 0
+	})
+
+	// Both queues drain once the sink catches up.
+	close(stuck.release)
+	client.Close()
+	waitFor(t, func() bool {
+		metrics := scrapeMetrics(t, p)
+		return len(p.mitm.sessions.list()) == 0 &&
+			metrics["ssh_proxy_audit_queue_depth"] == 0 && metrics["ssh_proxy_input_queue_depth"] == 0
+	})
+	if v := scrapeMetrics(t, p)[`ssh_proxy_sessions_total{type="pty"}`]; v != 1 {
+		t.Errorf(`ssh_proxy_sessions_total{type="pty"} = %v, want 1`, v)
+	}
+}
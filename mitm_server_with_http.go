@@ -4,10 +4,14 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	gliderssh "github.com/gliderlabs/ssh"
 	"github.com/juju/zaputil/zapctx"
@@ -20,23 +24,33 @@ type SessionDetails struct {
 	// Command returns a shell parsed slice of arguments that were provided by the user.
 	// Shell parsing splits the command string according to POSIX shell rules,
 	// which considers quoting not just whitespace.
-	ShellCommand []string
+	ShellCommand []string `json:"shell_command"`
 
 	// Environ returns a copy of strings representing the environment set by the user
 	// for this session, in the form "key=value".
-	Environ []string
+	Environ []string `json:"environ"`
 
 	// ClientAddr is the remote client address.
-	ClientAddr string
+	ClientAddr string `json:"client_addr"`
 
 	// ClientVersion is the client's SSH client version.
-	ClientVersion string
+	ClientVersion string `json:"client_version"`
 
 	// User is the user the client is connecting as.
-	User string
+	User string `json:"user"`
 
 	// SessionID is a hash identifier for the session.
-	SessionID string
+	SessionID string `json:"session_id"`
+
+	// Target is the request URI of the HTTP CONNECT request the client
+	// reached the proxy with, which identifies the target.
+	Target string `json:"target"`
+
+	// Channel names the session channel within the connection: its
+	// SessionID for the first channel, followed by "-2", "-3" and so on for
+	// each further one. It is empty for events about the connection as a
+	// whole.
+	Channel string `json:"channel,omitempty"`
 }
 
 type TargetResolver interface {
@@ -68,6 +82,23 @@ type SSHAuditLogger interface {
 	ReceiveCommandInput(sess SessionDetails)
 }
 
+// SSHAuditFlusher may optionally be implemented by an SSHAuditLogger to be
+// told when a session has ended.
+type SSHAuditFlusher interface {
+	// FlushSession is called ONCE per SSH session, after every channel handed
+	// to the logger for the session has been closed and its Receive method
+	// has returned.
+	FlushSession(sess SessionDetails)
+}
+
+// errSessionTerminated is returned for a session terminated through the admin
+// API before its target session started.
+var errSessionTerminated = errors.New("session terminated")
+
+// sessionCloseTimeout is how long a client has to close its session once the
+// target has exited, before its connection is closed.
+const sessionCloseTimeout = 5 * time.Second
+
 func ensureHandlers(srv *gliderssh.Server) {
 	if srv.RequestHandlers == nil {
 		srv.RequestHandlers = map[string]gliderssh.RequestHandler{}
@@ -89,18 +120,122 @@ func ensureHandlers(srv *gliderssh.Server) {
 	}
 }
 
+// ServerOption configures optional behaviour of a MITMAuditingSSHServerWithHTTP.
+type ServerOption func(*MITMAuditingSSHServerWithHTTP)
+
+// WithOutputCapture sets the bounds on how much of each session's output is
+// captured for audit loggers implementing SSHOutputAuditor.
+func WithOutputCapture(cfg OutputCaptureConfig) ServerOption {
+	return func(m *MITMAuditingSSHServerWithHTTP) {
+		m.outputCapture = cfg
+	}
+}
+
+// WithSessionRecording records every PTY session as an asciicast v2 file
+// within dir, named by the session's ID.
+func WithSessionRecording(dir string) ServerOption {
+	return func(m *MITMAuditingSSHServerWithHTTP) {
+		m.recordingDir = dir
+	}
+}
+
+// WithShellIntegration parses the shell integration markers (OSC 133 and OSC 7)
+// in the output of PTY sessions, sending each command the shell runs to audit
+// loggers implementing SSHShellCommandAuditor. If inject is set, a snippet
+// enabling the markers is typed into the target's shell when it starts; only
+// bash is supported and the snippet is visible to the user as it is echoed.
+func WithShellIntegration(inject bool) ServerOption {
+	return func(m *MITMAuditingSSHServerWithHTTP) {
+		m.shellIntegration = true
+		m.injectShellIntegration = inject
+	}
+}
+
+// WithRedactor sets the Redactor used to redact secrets from commands,
+// environment variables, captured output and recordings before they are
+// audited. By default a Redactor with only the built-in patterns is used, a
+// nil Redactor disables redaction.
+func WithRedactor(r *Redactor) ServerOption {
+	return func(m *MITMAuditingSSHServerWithHTTP) {
+		m.redactor = r
+	}
+}
+
+// WithInputQueue configures the queue of input between each PTY session and
+// the audit logger, and what happens when the logger falls behind.
+func WithInputQueue(cfg InputQueueConfig) ServerOption {
+	return func(m *MITMAuditingSSHServerWithHTTP) {
+		m.inputQueue = cfg
+	}
+}
+
+// WithEchoTimeout sets how long PTY input may take to be echoed back by the
+// target before it is redacted as typed with echo disabled. A longer timeout
+// avoids redacting input to slow or distant targets, at the cost of holding
+// input back from the audit logger and recordings for longer; a password typed
+// at a prompt that echoes within the timeout is not redacted. By default
+// DefaultEchoTimeout is used.
+func WithEchoTimeout(d time.Duration) ServerOption {
+	return func(m *MITMAuditingSSHServerWithHTTP) {
+		m.echoTimeout = d
+	}
+}
+
+// WithCommandPolicy enforces p on the commands of exec sessions before they
+// are run on the target. By default every command is run.
+func WithCommandPolicy(p *CommandPolicy) ServerOption {
+	return func(m *MITMAuditingSSHServerWithHTTP) {
+		m.policy = p
+	}
+}
+
+// WithHostKey sets the host key the proxy presents to clients. By default an
+// RSA key is generated when the server is created, and the server is not
+// ready until it has been.
+func WithHostKey(key ssh.Signer) ServerOption {
+	return func(m *MITMAuditingSSHServerWithHTTP) {
+		m.hostKey = key
+	}
+}
+
 // NewMITMAuditingSSHServerWithHTTP returns a new MITMAuditingSSHServerWithHTTP, it takes
 // an SSHAuditLogger to allow logging of user's input from the client side.
-func NewMITMAuditingSSHServerWithHTTP(l SSHAuditLogger) *MITMAuditingSSHServerWithHTTP {
+func NewMITMAuditingSSHServerWithHTTP(l SSHAuditLogger, opts ...ServerOption) *MITMAuditingSSHServerWithHTTP {
+	return NewMITMAuditingSSHServerWithEventSink(NewAuditLoggerSink(l), opts...)
+}
+
+// NewMITMAuditingSSHServerWithEventSink returns a new MITMAuditingSSHServerWithHTTP,
+// handing every audit event of every session to sink.
+func NewMITMAuditingSSHServerWithEventSink(sink EventSink, opts ...ServerOption) *MITMAuditingSSHServerWithHTTP {
 	mux := http.NewServeMux()
+	redactor, _ := NewRedactor()
 	mitm := &MITMAuditingSSHServerWithHTTP{
 		srv: &http.Server{
 			Handler: mux,
 			Addr:    ":17070",
 		},
-		auditLogger: l,
+		sink:          sink,
+		outputCapture: DefaultOutputCaptureConfig(),
+		inputQueue:    DefaultInputQueueConfig(),
+		echoTimeout:   DefaultEchoTimeout,
+		redactor:      redactor,
+		metrics:       newProxyMetrics(),
+		sessions:      newSessionRegistry(),
+		dial:          getTargetConnection,
+	}
+	for _, opt := range opts {
+		opt(mitm)
+	}
+
+	if mitm.hostKey == nil {
+		go mitm.generateHostKey()
 	}
 
+	mux.Handle("/metrics", mitm.metrics.handler(mitm.sink))
+	mux.HandleFunc("/healthz", mitm.handleHealthz)
+	mux.HandleFunc("/readyz", mitm.handleReadyz)
+	mitm.registerAdminAPI(mux)
+
 	mux.HandleFunc("/ssh", func(w http.ResponseWriter, r *http.Request) {
 		// Check if the request is a CONNECT method
 		if r.Method != http.MethodConnect {
@@ -108,6 +243,19 @@ func NewMITMAuditingSSHServerWithHTTP(l SSHAuditLogger) *MITMAuditingSSHServerWi
 			return
 		}
 
+		if err := admitSession(mitm.sink); err != nil {
+			zapctx.Warn(r.Context(), "refusing session", zap.Error(err))
+			mitm.metrics.sessionsRefused.add(1)
+			http.Error(w, "Session cannot be audited: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		hostKey := mitm.loadedHostKey()
+		if hostKey == nil {
+			http.Error(w, "Host key not loaded", http.StatusServiceUnavailable)
+			return
+		}
+
 		hijacker, ok := w.(http.Hijacker)
 		if !ok {
 			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
@@ -126,14 +274,23 @@ func NewMITMAuditingSSHServerWithHTTP(l SSHAuditLogger) *MITMAuditingSSHServerWi
 		}
 		fmt.Println("finished connect")
 		gSrv := gliderssh.Server{}
-		// Get rid of the keys, not needed as we doing http -> ssh
-		pkey, _ := rsa.GenerateKey(rand.Reader, 4096)
-		key, _ := ssh.NewSignerFromKey(pkey)
-		gSrv.AddHostKey(key)
+		gSrv.AddHostKey(hostKey)
+
+		audit := newSessionAudit(mitm.sink, func(delta int) {
+			mitm.metrics.auditQueueDepth.add(float64(delta))
+		})
+
+		target := r.URL.RequestURI()
+		gSrv.ConnCallback = func(ctx gliderssh.Context, conn net.Conn) net.Conn {
+			ctx.SetValue(contextKeyTarget, target)
+			return conn
+		}
 
 		ensureHandlers(&gSrv)
-		gSrv.Handler = mitm.sshHandlerClosure(r)
+		mitm.auditRequests(&gSrv, audit)
+		gSrv.Handler = mitm.sshHandlerClosure(r, audit)
 		gSrv.HandleConn(clientConn)
+		audit.disconnect()
 	})
 
 	return mitm
@@ -142,8 +299,51 @@ func NewMITMAuditingSSHServerWithHTTP(l SSHAuditLogger) *MITMAuditingSSHServerWi
 // MITMAuditingSSHServerWithHTTP is a man-in-the-middle SSH server capable of
 // auditing users input.
 type MITMAuditingSSHServerWithHTTP struct {
-	srv         *http.Server
-	auditLogger SSHAuditLogger
+	srv           *http.Server
+	sink          EventSink
+	outputCapture OutputCaptureConfig
+	inputQueue    InputQueueConfig
+	echoTimeout   time.Duration
+	recordingDir  string
+	redactor      *Redactor
+	metrics       *proxyMetrics
+	admin         AdminConfig
+	sessions      *sessionRegistry
+	policy        *CommandPolicy
+
+	// dial connects to the target.
+	dial func() (*ssh.Client, error)
+
+	hostKeyMu sync.Mutex
+	hostKey   ssh.Signer
+
+	shellIntegration       bool
+	injectShellIntegration bool
+}
+
+// generateHostKey generates the host key presented to clients.
+func (m *MITMAuditingSSHServerWithHTTP) generateHostKey() {
+	pkey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		zapctx.Error(context.TODO(), "failed to generate host key", zap.Error(err))
+		return
+	}
+	key, err := ssh.NewSignerFromKey(pkey)
+	if err != nil {
+		zapctx.Error(context.TODO(), "failed to generate host key", zap.Error(err))
+		return
+	}
+	m.hostKeyMu.Lock()
+	m.hostKey = key
+	m.hostKeyMu.Unlock()
+}
+
+// loadedHostKey returns the host key presented to clients, or nil if it is
+// yet to be generated.
+func (m *MITMAuditingSSHServerWithHTTP) loadedHostKey() ssh.Signer {
+	m.hostKeyMu.Lock()
+	defer m.hostKeyMu.Unlock()
+	return m.hostKey
 }
 
 // Start starts the SSH server.
@@ -151,48 +351,264 @@ func (m *MITMAuditingSSHServerWithHTTP) Start() error {
 	return m.srv.ListenAndServe()
 }
 
+// auditRequests audits the requests the proxy does not pass on to the target,
+// subsystems and port forwarding, which are refused.
+func (m *MITMAuditingSSHServerWithHTTP) auditRequests(srv *gliderssh.Server, audit *sessionAudit) {
+	srv.SessionRequestCallback = func(s gliderssh.Session, requestType string) bool {
+		if requestType == "subsystem" {
+			_, ok := srv.SubsystemHandlers[s.Subsystem()]
+			audit.emit(m.auditSessionDetails(s), SubsystemEvent{
+				Name:     s.Subsystem(),
+				Accepted: ok,
+			})
+		}
+		return true
+	}
+
+	srv.LocalPortForwardingCallback = func(ctx gliderssh.Context, host string, port uint32) bool {
+		audit.emit(contextSessionDetails(ctx), PortForwardEvent{
+			Direction: "local",
+			Host:      host,
+			Port:      port,
+		})
+		return false
+	}
+	srv.ChannelHandlers["direct-tcpip"] = gliderssh.DirectTCPIPHandler
+
+	srv.ReversePortForwardingCallback = func(ctx gliderssh.Context, host string, port uint32) bool {
+		audit.emit(contextSessionDetails(ctx), PortForwardEvent{
+			Direction: "remote",
+			Host:      host,
+			Port:      port,
+		})
+		return false
+	}
+	forwardHandler := &gliderssh.ForwardedTCPHandler{}
+	srv.RequestHandlers["tcpip-forward"] = forwardHandler.HandleSSHRequest
+}
+
 // handleSSHTargetWindowChanges takes the internal SSH servers channel of window changes
-// and updates the target sessions window.
+// and updates the target sessions window until done is closed.
 //
 // This is expected to be run in a separate routine!
 func (m *MITMAuditingSSHServerWithHTTP) handleSSHTargetWindowChanges(
 	ptyWindowChangeCh <-chan gliderssh.Window,
 	targetSession *ssh.Session,
+	recorder *sessionRecorder,
+	live *liveSession,
+	initial gliderssh.Window,
+	done <-chan struct{},
 ) {
-	for change := range ptyWindowChangeCh {
-		targetSession.WindowChange(change.Height, change.Width)
+	last := initial
+	for {
+		select {
+		case <-done:
+			return
+		case change, ok := <-ptyWindowChangeCh:
+			if !ok {
+				return
+			}
+			if change == last {
+				continue
+			}
+			last = change
+			live.audit.emit(live.details, WindowChangeEvent{
+				Width:  change.Width,
+				Height: change.Height,
+			})
+			live.resize(change.Width, change.Height)
+			recorder.resize(change.Width, change.Height)
+			targetSession.WindowChange(change.Height, change.Width)
+		}
+	}
+}
+
+// startRecording starts recording the PTY session if a recording directory is
+// configured, otherwise it returns nil and the session is not recorded.
+func (m *MITMAuditingSSHServerWithHTTP) startRecording(ctx context.Context, sess SessionDetails, ptyReq gliderssh.Pty) *sessionRecorder {
+	if m.recordingDir == "" {
+		return nil
+	}
+	recorder, err := newSessionRecorder(m.recordingDir, sess, ptyReq, m.redactor)
+	if err != nil {
+		zapctx.Error(ctx, "failed to start session recording", zap.Error(err))
+		return nil
+	}
+	return recorder
+}
+
+// startOutputCapture starts capturing the session's output as output events.
+// The returned function stops capturing and waits for the captured output to
+// be emitted.
+func (m *MITMAuditingSSHServerWithHTTP) startOutputCapture(audit *sessionAudit, details SessionDetails) (*outputCapture, func()) {
+	capture := newOutputCapture(m.outputCapture, m.redactor)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for chunk := range capture.chunks() {
+			audit.emit(details, OutputEvent{
+				Stream:    chunk.Stream,
+				Data:      string(chunk.Data),
+				Relayed:   chunk.Timestamp,
+				Truncated: chunk.Truncated,
+				Sampled:   chunk.Sampled,
+				Dropped:   chunk.Dropped,
+			})
+		}
+	}()
+	return capture, func() {
+		capture.close()
+		<-done
+	}
+}
+
+// startShellIntegration starts parsing the session's output for shell
+// integration markers if enabled, emitting the commands found as events.
+// The returned function stops parsing and waits for the commands to be emitted.
+func (m *MITMAuditingSSHServerWithHTTP) startShellIntegration(audit *sessionAudit, details SessionDetails) (*shellIntegration, func()) {
+	if !m.shellIntegration {
+		return nil, func() {}
+	}
+	shell := newShellIntegration(m.redactor)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for command := range shell.commands() {
+			audit.emit(details, ShellCommandEvent{
+				Command:          command.Command,
+				WorkingDirectory: command.WorkingDirectory,
+				ExitCode:         command.ExitCode,
+				Started:          command.Started,
+				Duration:         command.Duration,
+			})
+		}
+	}()
+	return shell, func() {
+		shell.close()
+		<-done
 	}
 }
 
+// auditSessionDetails returns the session's details with secrets redacted, as
+// handed to the audit logger.
+func (m *MITMAuditingSSHServerWithHTTP) auditSessionDetails(s gliderssh.Session) SessionDetails {
+	return m.redactor.redactSession(m.createSessionDetails(s))
+}
+
 func (m *MITMAuditingSSHServerWithHTTP) createSessionDetails(s gliderssh.Session) SessionDetails {
+	details := contextSessionDetails(s.Context())
+	details.Channel = channelName(s)
+	details.ShellCommand = s.Command()
+	details.Environ = s.Environ()
+	return details
+}
+
+// contextSessionDetails returns the details of the connection a context belongs to.
+func contextSessionDetails(ctx gliderssh.Context) SessionDetails {
+	target, _ := ctx.Value(contextKeyTarget).(string)
 	return SessionDetails{
-		ShellCommand:  s.Command(),
-		Environ:       s.Environ(),
-		ClientAddr:    s.RemoteAddr().String(),
-		ClientVersion: s.Context().ClientVersion(),
-		User:          s.User(),
-		SessionID:     s.Context().SessionID(),
+		ClientAddr:    ctx.RemoteAddr().String(),
+		ClientVersion: ctx.ClientVersion(),
+		User:          ctx.User(),
+		SessionID:     ctx.SessionID(),
+		Target:        target,
+	}
+}
+
+type contextKey string
+
+// contextKeyTarget holds the connection's SessionDetails.Target.
+const contextKeyTarget contextKey = "target"
+
+// contextKeyChannels holds the names given to the connection's session
+// channels, see channelName.
+const contextKeyChannels contextKey = "channels"
+
+// channelsMu guards the channel names of every connection.
+var channelsMu sync.Mutex
+
+// channelName returns the SessionDetails.Channel of the session channel s,
+// naming the channels of a connection in the order they are first seen.
+func channelName(s gliderssh.Session) string {
+	channelsMu.Lock()
+	defer channelsMu.Unlock()
+	ctx := s.Context()
+	names, _ := ctx.Value(contextKeyChannels).(map[gliderssh.Session]string)
+	if names == nil {
+		names = map[gliderssh.Session]string{}
+		ctx.SetValue(contextKeyChannels, names)
+	}
+	name, ok := names[s]
+	if !ok {
+		name = ctx.SessionID()
+		if n := len(names) + 1; n > 1 {
+			name = fmt.Sprintf("%s-%d", name, n)
+		}
+		names[s] = name
+	}
+	return name
+}
+
+// exitStatus returns the exit status of a target session from the error its
+// Wait or Run returned.
+func exitStatus(err error) ExitStatusEvent {
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		return ExitStatusEvent{ExitCode: 0}
+	case errors.Is(err, errCommandDenied):
+		return ExitStatusEvent{ExitCode: commandDeniedExitCode}
+	case errors.As(err, &exitErr):
+		return ExitStatusEvent{
+			ExitCode: exitErr.ExitStatus(),
+			Signal:   exitErr.Signal(),
+		}
+	default:
+		return ExitStatusEvent{ExitCode: 255}
 	}
 }
 
 // forward takes a stdinPipe from the target SSH server and does two things:
 //
 // 1. Forwards the MITM's client's input into the target session.
-// 2. Forwards the MITM's client's input into the provided input channel for auditing and interception purposes.
-func (m *MITMAuditingSSHServerWithHTTP) forward(ctx context.Context, stdinPipe io.WriteCloser, sess gliderssh.Session, inputChan chan<- []byte) {
-	buf := make([]byte, 10)
+// 2. Forwards the MITM's client's input into the provided echo redactor for auditing and interception purposes.
+//
+// The input is counted as relayed to the target for live's SessionInfo and the metrics.
+// If gate is set, the command lines submitted are held back until the command policy allows them.
+//
+// The echo redactor copies the input and never waits on the audit logger, so
+// keystrokes are only held up when the input queue's overflow policy says so.
+func (m *MITMAuditingSSHServerWithHTTP) forward(ctx context.Context, stdinPipe io.Writer, sess gliderssh.Session, redactor *echoRedactor, live *liveSession, gate *commandGate) {
+	buf := make([]byte, 32*1024)
+	write := func(input []byte) error {
+		if len(input) == 0 {
+			return nil
+		}
+		redactor.input(input)
+		written, err := stdinPipe.Write(input)
+		live.bytesIn.Add(uint64(written))
+		m.metrics.bytes.add(float64(written), directionClientToTarget)
+		return err
+	}
 
 	for {
 		n, err := sess.Read(buf)
+		if errors.Is(err, io.EOF) {
+			zapctx.Debug(ctx, "mitm session closed")
+			return
+		}
 		if err != nil {
 			zapctx.Error(ctx, "error reading from mitm session", zap.Error(err))
 			return
 		}
 		if n > 0 {
-			input := buf[:n]
-			inputChan <- input
-
-			if _, err := stdinPipe.Write([]byte(input)); err != nil {
+			// Input is held while the session is paused, and dropped if
+			// it is terminated.
+			if !live.waitResumed() {
+				zapctx.Debug(ctx, "dropping input held while the session was paused")
+				return
+			}
+			if err := gate.forward(buf[:n], write); err != nil {
 				zapctx.Error(ctx, "error writing stdin pipe", zap.Error(err))
 				return
 			}
@@ -201,117 +617,313 @@ func (m *MITMAuditingSSHServerWithHTTP) forward(ctx context.Context, stdinPipe i
 	}
 }
 
-func (m *MITMAuditingSSHServerWithHTTP) sshHandlerClosure(r *http.Request) func(s gliderssh.Session) {
+func (m *MITMAuditingSSHServerWithHTTP) sshHandlerClosure(r *http.Request, audit *sessionAudit) func(s gliderssh.Session) {
 	return func(s gliderssh.Session) {
 		ctx := s.Context()
 
 		zapctx.Debug(ctx, "thing", zap.String("url", r.URL.String()))
 
-		var ptyReq gliderssh.Pty
-		var ptyWindowChangeCh <-chan gliderssh.Window
-		var isPty bool
-		if len(s.Command()) == 0 {
-			ptyReq, ptyWindowChangeCh, isPty = s.Pty()
-		}
+		details := m.auditSessionDetails(s)
+		live := newLiveSession(s, audit, details)
+		m.sessions.add(live)
+		defer m.sessions.remove(live)
+		sessionEnded := m.metrics.sessionStarted(live.sessionType)
+		defer sessionEnded()
+
+		var readers sync.WaitGroup
+		err := m.proxySession(ctx, s, live, &readers)
+		// Watchers are detached, and their detaching audited, before the
+		// client is told the session exited and may close the connection.
+		live.end()
+		status := exitStatus(err)
+		audit.emit(details, status)
+		s.Exit(status.ExitCode)
+
+		// Exiting closes the session, which ends the goroutines reading from
+		// it, unless the client never acknowledges the close.
+		m.waitReaders(ctx, &readers)
+	}
+}
 
-		targetConn, err := getTargetConnection()
-		if err != nil {
-			zapctx.Error(
-				ctx,
-				"get target connection and settings failed",
-				zap.Error(err),
-			)
-			return
+// sessionType returns the type a session is counted as in metrics, "pty" for
+// interactive sessions and "exec" for commands.
+func sessionType(s gliderssh.Session) string {
+	if _, _, isPty := s.Pty(); isPty && len(s.Command()) == 0 {
+		return "pty"
+	}
+	return "exec"
+}
+
+// clientWriter returns a writer to the client, counting the bytes written as
+// relayed from the target for live's SessionInfo and the metrics, and sending
+// them to the admins watching the session. Writes are held while the session
+// is paused.
+func (m *MITMAuditingSSHServerWithHTTP) clientWriter(live *liveSession, w io.Writer) io.Writer {
+	return &countingWriter{w: heldWriter{live: live, w: w}, count: func(n int) {
+		live.bytesOut.Add(uint64(n))
+		m.metrics.bytes.add(float64(n), directionTargetToClient)
+	}, written: live.writeOutput}
+}
+
+// dialTarget connects to the target, recording how long it took.
+func (m *MITMAuditingSSHServerWithHTTP) dialTarget() (*ssh.Client, error) {
+	start := time.Now()
+	conn, err := m.dial()
+	m.metrics.dialDuration.observe(time.Since(start).Seconds())
+	if err != nil {
+		m.metrics.dialFailures.add(1)
+	}
+	return conn, err
+}
+
+// waitReaders waits for the goroutines reading from a session to return, closing
+// the client's connection if they have not within sessionCloseTimeout.
+func (m *MITMAuditingSSHServerWithHTTP) waitReaders(ctx gliderssh.Context, readers *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(sessionCloseTimeout):
+	}
+	zapctx.Warn(ctx, "client did not close session, closing connection")
+	if conn, ok := ctx.Value(gliderssh.ContextKeyConn).(ssh.Conn); ok {
+		conn.Close()
+	}
+	<-done
+}
+
+// proxySession proxies a session to the target, returning once the target
+// session has exited and all of its audit events have been emitted. The
+// goroutines it leaves reading from s are added to readers, they return once
+// s is closed.
+func (m *MITMAuditingSSHServerWithHTTP) proxySession(
+	ctx context.Context,
+	s gliderssh.Session,
+	live *liveSession,
+	readers *sync.WaitGroup,
+) error {
+	audit, details := live.audit, live.details
+
+	var ptyReq gliderssh.Pty
+	var ptyWindowChangeCh <-chan gliderssh.Window
+	var isPty bool
+	if len(s.Command()) == 0 {
+		ptyReq, ptyWindowChangeCh, isPty = s.Pty()
+	}
+
+	if !isPty {
+		if err := m.enforceCommandPolicy(ctx, s, live); err != nil {
+			return err
 		}
-		defer targetConn.Close()
+	}
 
-		targetSession, err := targetConn.NewSession()
-		if err != nil {
+	targetConn, err := m.dialTarget()
+	if err != nil {
+		zapctx.Error(
+			ctx,
+			"get target connection and settings failed",
+			zap.Error(err),
+		)
+		return err
+	}
+	defer targetConn.Close()
+
+	targetSession, err := targetConn.NewSession()
+	if err != nil {
+		zapctx.Error(
+			ctx,
+			"failed to create target session",
+			zap.Error(err),
+		)
+		return err
+	}
+	defer targetSession.Close()
+	if !live.setTarget(targetSession) {
+		return errSessionTerminated
+	}
+	// A client disconnecting mid-session ends the target session, which
+	// would otherwise be left waiting for input that never comes.
+	stopDisconnect := context.AfterFunc(ctx, func() {
+		targetSession.Close()
+	})
+	defer stopDisconnect()
+
+	capture, stopCapture := m.startOutputCapture(audit, details)
+	defer stopCapture()
+
+	if !isPty {
+		command := s.Command()
+		audit.emit(details, ExecEvent{Command: details.ShellCommand})
+		zapctx.Debug(ctx, "executing command on target SSH server", zap.Any("command", command))
+		targetSession.Stdout = capture.writer(OutputStdout, m.clientWriter(live, s))
+		targetSession.Stderr = capture.writer(OutputStderr, m.clientWriter(live, s.Stderr()))
+		if err := targetSession.Run(strings.Join(command, " ")); err != nil {
 			zapctx.Error(
 				ctx,
-				"failed to create target session",
+				"failed to execute command",
 				zap.Error(err),
 			)
-			return
+			return err
 		}
-		defer targetSession.Close()
-
-		if isPty {
-			modes := ssh.TerminalModes{
-				ssh.ECHO:          1,     // disable echoing
-				ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-				ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
-			}
-			if err := targetSession.RequestPty(ptyReq.Term, ptyReq.Window.Height, ptyReq.Window.Width, modes); err != nil {
-				zapctx.Error(
-					ctx,
-					"target session request pty failed",
-					zap.Error(err),
-				)
-				return
-			}
-
-			zapctx.Debug(ctx, "piping")
-			zapctx.Debug(ctx, "starting stdin pipe...")
-			stdinPipe, err := targetSession.StdinPipe()
-			if err != nil {
-				zapctx.Error(
-					ctx,
-					"failed to get target session stdin pipe",
-					zap.Error(err),
-				)
-				return
-			}
-			inputChan := make(chan []byte)
-
-			zapctx.Debug(ctx, "starting input forwarding...")
-			go m.forward(ctx, stdinPipe, s, inputChan)
-
-			// Audit Logger interception.
-			go m.auditLogger.ReceivePTYInput(inputChan, m.createSessionDetails(s))
+		return nil
+	}
 
-			targetSession.Stdout = s
-			targetSession.Stderr = s.Stderr()
+	audit.emit(details, PtyRequestEvent{
+		Term:   ptyReq.Term,
+		Width:  ptyReq.Window.Width,
+		Height: ptyReq.Window.Height,
+	})
+	live.setPty(ptyReq.Term, ptyReq.Window.Width, ptyReq.Window.Height)
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,     // disable echoing
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+	if err := targetSession.RequestPty(ptyReq.Term, ptyReq.Window.Height, ptyReq.Window.Width, modes); err != nil {
+		zapctx.Error(
+			ctx,
+			"target session request pty failed",
+			zap.Error(err),
+		)
+		return err
+	}
 
-			zapctx.Debug(ctx, "getting login shell...")
-			if err := targetSession.Shell(); err != nil {
-				zapctx.Error(
-					ctx,
-					"failed to start login shell",
-					zap.Error(err),
-				)
-				return
+	zapctx.Debug(ctx, "piping")
+	zapctx.Debug(ctx, "starting stdin pipe...")
+	targetStdin, err := targetSession.StdinPipe()
+	if err != nil {
+		zapctx.Error(
+			ctx,
+			"failed to get target session stdin pipe",
+			zap.Error(err),
+		)
+		return err
+	}
+	// An admin in control of the session writes to its input alongside
+	// the user.
+	stdinPipe := &lockedWriter{w: targetStdin}
+
+	recorder := m.startRecording(ctx, details, ptyReq)
+	defer recorder.close()
+
+	// The input is audited from a bounded queue, so a slow sink only holds
+	// up the session as far as the overflow policy allows.
+	editor := newLineEditor()
+	queue := newInputQueue(
+		m.inputQueue,
+		func(input []byte) {
+			audit.emit(details, InputEvent{Data: string(input)})
+			for _, line := range editor.feed(input) {
+				audit.emit(details, CommandEvent{
+					Command:   line.Command,
+					Uncertain: line.Uncertain,
+				})
 			}
+		},
+		func() {
+			zapctx.Warn(ctx, "audit logger fell behind, terminating session")
+			io.WriteString(s.Stderr(), "\r\nsession terminated: input could not be audited\r\n")
+			targetSession.Close()
+			s.Close()
+		},
+		func(n int) {
+			m.metrics.inputDroppedBytes.add(float64(n))
+			m.metrics.inputQueueDropped.add(1, m.inputQueue.Overflow.String())
+		},
+		func(delta int) {
+			m.metrics.inputQueueDepth.add(float64(delta))
+		},
+	)
+	defer func() {
+		queue.close()
+		<-queue.done
+	}()
+
+	// Input lines are redacted of secrets as a whole before they are
+	// recorded and audited.
+	lines := m.redactor.newLineRedactor(func(input []byte) {
+		recorder.input(input)
+		queue.push(input)
+	})
+	defer lines.flush()
+
+	// Input is only recorded and audited once the target has echoed it,
+	// so passwords typed with echo disabled never reach either.
+	redactor := newEchoRedactor(lines.write, m.inputQueue.Size, m.echoTimeout)
+	defer redactor.close()
+
+	shell, stopShellIntegration := m.startShellIntegration(audit, details)
+	defer stopShellIntegration()
+
+	gate := m.newCommandGate(live, redactor, shell)
+	live.setStdin(stdinPipe, gate)
+
+	zapctx.Debug(ctx, "starting input forwarding...")
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		m.forward(ctx, stdinPipe, s, redactor, live, gate)
+	}()
+
+	stdout := m.clientWriter(live, s)
+	stderr := m.clientWriter(live, s.Stderr())
+	targetSession.Stdout = redactor.writer(recorder.writer(shell.writer(capture.writer(OutputStdout, stdout))))
+	targetSession.Stderr = redactor.writer(recorder.writer(capture.writer(OutputStderr, stderr)))
+
+	audit.emit(details, ShellEvent{})
+	zapctx.Debug(ctx, "getting login shell...")
+	if err := targetSession.Shell(); err != nil {
+		zapctx.Error(
+			ctx,
+			"failed to start login shell",
+			zap.Error(err),
+		)
+		return err
+	}
 
-			go m.handleSSHTargetWindowChanges(
-				ptyWindowChangeCh,
-				targetSession,
-			)
+	if m.injectShellIntegration {
+		if _, err := io.WriteString(stdinPipe, shellIntegrationSnippet); err != nil {
+			zapctx.Error(ctx, "failed to inject shell integration", zap.Error(err))
+		}
+	}
 
-			zapctx.Debug(ctx, "waiting for remote session to exit")
-			if err := targetSession.Wait(); err != nil {
-				zapctx.Error(
-					ctx,
-					"remote session exit failed",
-					zap.Error(err),
-				)
-				return
-			}
-			zapctx.Debug(ctx, "remote session exited")
-		} else {
-			command := s.Command()
-			m.auditLogger.ReceiveCommandInput(m.createSessionDetails(s))
-			zapctx.Debug(ctx, "executing command on target SSH server", zap.Any("command", command))
-			out, err := targetSession.CombinedOutput(strings.Join(command, " "))
-			if err != nil {
-				zapctx.Error(
-					ctx,
-					"failed to execute command",
-					zap.Error(err),
-				)
-				return
-			}
-			io.WriteString(s, string(out))
+	exited := make(chan struct{})
+	windowsDone := make(chan struct{})
+	defer func() {
+		close(exited)
+		<-windowsDone
+	}()
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		m.handleSSHTargetWindowChanges(
+			ptyWindowChangeCh,
+			targetSession,
+			recorder,
+			live,
+			ptyReq.Window,
+			exited,
+		)
+		close(windowsDone)
+		// The session blocks on window changes until they are read, so they
+		// are drained until it closes the channel.
+		for range ptyWindowChangeCh {
 		}
+	}()
+
+	zapctx.Debug(ctx, "waiting for remote session to exit")
+	if err := targetSession.Wait(); err != nil {
+		zapctx.Error(
+			ctx,
+			"remote session exit failed",
+			zap.Error(err),
+		)
+		return err
 	}
+	zapctx.Debug(ctx, "remote session exited")
+	return nil
 }
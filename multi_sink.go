@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// SinkFilter selects the events passed to a sink. Each non-empty field must
+// match for an event to be passed on. Events belonging to no session, such as
+// checkpoints, are not filtered by user or target.
+type SinkFilter struct {
+	// Types are the event types passed on.
+	Types []EventType
+
+	// Users are path.Match patterns the session's user must match one of,
+	// and Targets patterns its target must match one of, see matchTarget.
+	Users   []string
+	Targets []string
+}
+
+// match reports whether e passes the filter.
+func (f SinkFilter) match(e Event) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, e.Type) {
+		return false
+	}
+	if e.Session.SessionID == "" {
+		return true
+	}
+	return matchAny(f.Users, e.Session.User) && matchAnyTarget(f.Targets, e.Session.Target)
+}
+
+// matchAny reports whether s matches any of patterns, or patterns is empty.
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAnyTarget reports whether target matches any of patterns, or patterns
+// is empty, see matchTarget.
+func matchAnyTarget(patterns []string, target string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchTarget(pattern, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTarget reports whether target, a CONNECT request URI such as
+// "/ssh?host=db-prod-1", matches pattern. Patterns are path.Match patterns,
+// except that '*' and '?' match '/' too, so "*prod*" matches the whole URI.
+func matchTarget(pattern, target string) bool {
+	// path.Match treats only '/' specially, so it is swapped for a byte
+	// which neither patterns nor request URIs hold.
+	ok, _ := path.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(target, "/", "\x00"))
+	return ok
+}
+
+// MultiSinkTarget is a sink events are fanned out to by a MultiSink.
+type MultiSinkTarget struct {
+	// Name identifies the sink in logs and its health.
+	Name string
+
+	Sink   EventSink
+	Filter SinkFilter
+
+	// QueueSize is the number of events queued for the sink, beyond which
+	// its events are dropped. When 0, defaultSinkQueueSize is used.
+	QueueSize int
+
+	// Required marks the proxy as not ready for new sessions while the sink
+	// is unhealthy.
+	Required bool
+}
+
+// SinkHealth is the health of an audit sink, such as each sink of a MultiSink.
+type SinkHealth struct {
+	Name     string
+	Required bool
+
+	// Healthy is unset once the sink drops or fails to deliver an event, and
+	// set again once it delivers events with room in its queue.
+	Healthy bool
+
+	Queued    int
+	Delivered uint64
+	Dropped   uint64
+	Failed    uint64
+
+	LastError     string
+	LastErrorTime time.Time
+	LastDelivered time.Time
+}
+
+// sinkHealthReporter is implemented by sinks reporting their health, such as
+// SyslogSink, or that of the sinks behind them, such as MultiSink.
+type sinkHealthReporter interface {
+	Health() []SinkHealth
+}
+
+// sinkHealth returns the health reported by sink, or the first sink it wraps
+// reporting its health.
+func sinkHealth(sink EventSink) []SinkHealth {
+	if reporter, ok := findSink[sinkHealthReporter](sink); ok {
+		return reporter.Health()
+	}
+	return nil
+}
+
+// defaultSinkQueueSize is the queue size of sinks not given one.
+const defaultSinkQueueSize = 10000
+
+// maxMultiSinkBatch is the most queued events handed to an EventDeliverer at once.
+const maxMultiSinkBatch = 100
+
+// MultiSink is an EventSink fanning events out to several sinks, such as a
+// local file, a SIEM and a webhook. Each sink has its own queue and goroutine,
+// so a slow or broken sink never holds up the others or the session.
+type MultiSink struct {
+	sinks []*multiSinkTarget
+}
+
+type multiSinkTarget struct {
+	MultiSinkTarget
+	queue chan Event
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	health SinkHealth
+}
+
+// NewMultiSink returns a MultiSink fanning events out to targets.
+func NewMultiSink(targets ...MultiSinkTarget) (*MultiSink, error) {
+	m := &MultiSink{}
+	for _, target := range targets {
+		if target.Sink == nil {
+			return nil, fmt.Errorf("multi sink target %q has no sink", target.Name)
+		}
+		if target.QueueSize <= 0 {
+			target.QueueSize = defaultSinkQueueSize
+		}
+		t := &multiSinkTarget{
+			MultiSinkTarget: target,
+			queue:           make(chan Event, target.QueueSize),
+			done:            make(chan struct{}),
+			health:          SinkHealth{Name: target.Name, Required: target.Required, Healthy: true},
+		}
+		m.sinks = append(m.sinks, t)
+		go t.run()
+	}
+	return m, nil
+}
+
+// HandleEvent implements EventSink.
+func (m *MultiSink) HandleEvent(e Event) {
+	for _, t := range m.sinks {
+		if t.Filter.match(e) {
+			t.push(e)
+		}
+	}
+}
+
+// AdmitSession implements SessionAdmitter, refusing a session if any of its
+// sinks refuses it or a required sink is unhealthy.
+func (m *MultiSink) AdmitSession() error {
+	for _, t := range m.sinks {
+		if err := admitSession(t.Sink); err != nil {
+			return err
+		}
+	}
+	for _, h := range m.Health() {
+		if h.Required && !h.Healthy {
+			if h.LastError != "" {
+				return fmt.Errorf("required audit sink %q is unhealthy: %s", h.Name, h.LastError)
+			}
+			return fmt.Errorf("required audit sink %q is unhealthy", h.Name)
+		}
+	}
+	return nil
+}
+
+// Health returns the health of each sink, in the order they were given. A
+// sink reporting its own health, such as a SyslogSink reconnecting to its
+// collector, is unhealthy while it reports itself so.
+func (m *MultiSink) Health() []SinkHealth {
+	health := make([]SinkHealth, len(m.sinks))
+	for i, t := range m.sinks {
+		t.mu.Lock()
+		health[i] = t.health
+		health[i].Queued = len(t.queue)
+		t.mu.Unlock()
+
+		for _, h := range sinkHealth(t.Sink) {
+			if h.Healthy {
+				continue
+			}
+			health[i].Healthy = false
+			if h.LastErrorTime.After(health[i].LastErrorTime) {
+				health[i].LastError = h.LastError
+				health[i].LastErrorTime = h.LastErrorTime
+			}
+		}
+	}
+	return health
+}
+
+// Close stops accepting events and waits for each sink to be handed the
+// events queued for it.
+func (m *MultiSink) Close() error {
+	for _, t := range m.sinks {
+		t.mu.Lock()
+		if !t.closed {
+			t.closed = true
+			close(t.queue)
+		}
+		t.mu.Unlock()
+	}
+	for _, t := range m.sinks {
+		<-t.done
+	}
+	return nil
+}
+
+// push queues e, dropping it if the queue is full.
+func (t *multiSinkTarget) push(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- e:
+	default:
+		if t.health.Healthy {
+			zapctx.Warn(context.TODO(), "audit sink fell behind, dropping events", zap.String("sink", t.Name))
+		}
+		t.health.Healthy = false
+		t.health.Dropped++
+	}
+}
+
+// run hands queued events to the sink until the queue is closed and drained.
+func (t *multiSinkTarget) run() {
+	defer close(t.done)
+	deliverer, _ := t.Sink.(EventDeliverer)
+	for e := range t.queue {
+		if deliverer == nil {
+			t.Sink.HandleEvent(e)
+			t.delivered(1, nil)
+			continue
+		}
+
+		batch := []Event{e}
+	fill:
+		for len(batch) < maxMultiSinkBatch {
+			select {
+			case e, ok := <-t.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+		t.delivered(len(batch), deliverer.DeliverEvents(batch))
+	}
+}
+
+// delivered records the outcome of handing n events to the sink.
+func (t *multiSinkTarget) delivered(n int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		if t.health.Healthy {
+			zapctx.Error(context.TODO(), "audit sink failed to deliver events", zap.String("sink", t.Name), zap.Error(err))
+		}
+		t.health.Healthy = false
+		t.health.Failed += uint64(n)
+		t.health.LastError = err.Error()
+		t.health.LastErrorTime = time.Now()
+		return
+	}
+	t.health.Delivered += uint64(n)
+	t.health.LastDelivered = time.Now()
+	if !t.health.Healthy && len(t.queue) < cap(t.queue) {
+		zapctx.Info(context.TODO(), "audit sink recovered", zap.String("sink", t.Name))
+		t.health.Healthy = true
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSinkFilter(t *testing.T) {
+	session := func(user, target string) SessionDetails {
+		return SessionDetails{SessionID: "abc", User: user, Target: target}
+	}
+	tests := []struct {
+		name    string
+		filter  SinkFilter
+		typ     EventType
+		session SessionDetails
+		want    bool
+	}{
+		{name: "empty filter", typ: EventInput, session: session("alice", "/ssh"), want: true},
+		{name: "type matches", filter: SinkFilter{Types: []EventType{EventCommand, EventExec}}, typ: EventExec, want: true},
+		{name: "type does not match", filter: SinkFilter{Types: []EventType{EventCommand}}, typ: EventInput, want: false},
+		{name: "user matches", filter: SinkFilter{Users: []string{"bob", "alice"}}, typ: EventInput, session: session("alice", ""), want: true},
+		{name: "user pattern", filter: SinkFilter{Users: []string{"admin-*"}}, typ: EventInput, session: session("admin-alice", ""), want: true},
+		{name: "user does not match", filter: SinkFilter{Users: []string{"admin-*"}}, typ: EventInput, session: session("alice", ""), want: false},
+		{name: "target pattern", filter: SinkFilter{Targets: []string{"*prod*"}}, typ: EventInput, session: session("alice", "/ssh?host=db-prod-1"), want: true},
+		{name: "target path pattern", filter: SinkFilter{Targets: []string{"/ssh?host=db-*"}}, typ: EventInput, session: session("alice", "/ssh?host=db-prod-1"), want: true},
+		{name: "target does not match", filter: SinkFilter{Targets: []string{"*prod*"}}, typ: EventInput, session: session("alice", "/ssh?host=db-dev-1"), want: false},
+		{name: "every field must match", filter: SinkFilter{Users: []string{"alice"}, Targets: []string{"*prod*"}}, typ: EventInput, session: session("alice", "/ssh?host=db-dev-1"), want: false},
+		{name: "no session", filter: SinkFilter{Users: []string{"alice"}, Targets: []string{"*prod*"}}, typ: EventCheckpoint, want: true},
+		{name: "no session filtered by type", filter: SinkFilter{Types: []EventType{EventInput}}, typ: EventCheckpoint, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := Event{Type: test.typ, Session: test.session}
+			if got := test.filter.match(e); got != test.want {
+				t.Errorf("match() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMultiSinkFanOut(t *testing.T) {
+	all, commands, deliverer := &testSink{}, &testSink{}, &testDeliverer{}
+	multi, err := NewMultiSink(
+		MultiSinkTarget{Name: "all", Sink: all},
+		MultiSinkTarget{Name: "commands", Sink: commands, Filter: SinkFilter{Types: []EventType{EventCommand}}},
+		MultiSinkTarget{Name: "deliverer", Sink: deliverer},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []EventType{EventConnect, EventInput, EventCommand, EventInput, EventCommand}
+	for i, typ := range types {
+		e := testEvent(uint64(i + 1))
+		e.Type = typ
+		multi.HandleEvent(e)
+	}
+	// Close waits for every queued event to be handed over.
+	multi.Close()
+
+	if got := all.types(); fmt.Sprint(got) != fmt.Sprint(types) {
+		t.Errorf("all received %v, want %v", got, types)
+	}
+	if got := commands.types(); fmt.Sprint(got) != fmt.Sprint([]EventType{EventCommand, EventCommand}) {
+		t.Errorf("commands received %v", got)
+	}
+	checkSequences(t, deliverer.delivered(), 1, uint64(len(types)))
+
+	for _, h := range multi.Health() {
+		want := uint64(len(types))
+		if h.Name == "commands" {
+			want = 2
+		}
+		if !h.Healthy || h.Delivered != want || h.Queued != 0 || h.LastDelivered.IsZero() {
+			t.Errorf("health = %+v, want %d delivered", h, want)
+		}
+	}
+}
+
+func TestMultiSinkIsolation(t *testing.T) {
+	stuck, other := &testSink{release: make(chan struct{})}, &testSink{}
+	multi, err := NewMultiSink(
+		MultiSinkTarget{Name: "stuck", Sink: stuck, QueueSize: 2},
+		MultiSinkTarget{Name: "other", Sink: other},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer multi.Close()
+
+	// The stuck sink holds one event and queues two, dropping the rest,
+	// while the other sink receives them all.
+	for i := 1; i <= 10; i++ {
+		multi.HandleEvent(testEvent(uint64(i)))
+	}
+	waitFor(t, func() bool { return len(other.types()) == 10 })
+	health := multi.Health()
+	if h := health[0]; h.Healthy || h.Dropped == 0 || h.Queued == 0 {
+		t.Errorf("stuck sink health = %+v, want unhealthy with dropped events", h)
+	}
+	if h := health[1]; !h.Healthy || h.Dropped != 0 {
+		t.Errorf("other sink health = %+v, want healthy", h)
+	}
+
+	// The stuck sink recovers once it delivers events with room in its queue.
+	close(stuck.release)
+	waitFor(t, func() bool { return multi.Health()[0].Healthy })
+	h := multi.Health()[0]
+	if got := uint64(len(stuck.types())); got+h.Dropped != 10 {
+		t.Errorf("stuck sink received %d and dropped %d events, want 10 in all", got, h.Dropped)
+	}
+}
+
+func TestMultiSinkDeliveryFailure(t *testing.T) {
+	deliverer := &testDeliverer{failures: 1}
+	multi, err := NewMultiSink(MultiSinkTarget{Name: "webhook", Sink: deliverer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer multi.Close()
+
+	multi.HandleEvent(testEvent(1))
+	waitFor(t, func() bool { return multi.Health()[0].Failed == 1 })
+	h := multi.Health()[0]
+	if h.Healthy || h.LastError != "failed" || h.LastErrorTime.IsZero() {
+		t.Errorf("health = %+v, want unhealthy with the last error", h)
+	}
+
+	multi.HandleEvent(testEvent(2))
+	waitFor(t, func() bool { return multi.Health()[0].Healthy })
+	if h := multi.Health()[0]; h.Delivered != 1 || h.LastError != "failed" {
+		t.Errorf("health = %+v, want 1 delivered keeping the last error", h)
+	}
+}
+
+// refusingSink is an EventSink refusing sessions with err.
+type refusingSink struct {
+	testSink
+	err error
+}
+
+func (s *refusingSink) AdmitSession() error {
+	return s.err
+}
+
+func TestMultiSinkAdmitSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		admitErr error
+		failing  bool
+		required bool
+		wantErr  string
+	}{
+		{name: "admitted"},
+		{name: "refused by a sink", admitErr: ErrSpoolFull, wantErr: ErrSpoolFull.Error()},
+		{name: "optional sink unhealthy", failing: true},
+		{name: "required sink unhealthy", failing: true, required: true, wantErr: `required audit sink "webhook" is unhealthy: stuck`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deliverer := &testDeliverer{stuck: test.failing}
+			multi, err := NewMultiSink(
+				MultiSinkTarget{Name: "spool", Sink: &refusingSink{err: test.admitErr}},
+				MultiSinkTarget{Name: "webhook", Sink: deliverer, Required: test.required},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer multi.Close()
+
+			multi.HandleEvent(testEvent(1))
+			waitFor(t, func() bool {
+				h := multi.Health()[1]
+				return h.Delivered+h.Failed == 1
+			})
+			err = multi.AdmitSession()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("AdmitSession() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("AdmitSession() = %v, want %q", err, test.wantErr)
+			}
+			if test.admitErr != nil && !errors.Is(err, test.admitErr) {
+				t.Errorf("AdmitSession() = %v, want %v", err, test.admitErr)
+			}
+		})
+	}
+}
+
+func TestNewMultiSink(t *testing.T) {
+	if _, err := NewMultiSink(MultiSinkTarget{Name: "file"}); err == nil || !strings.Contains(err.Error(), `"file" has no sink`) {
+		t.Errorf("NewMultiSink() error = %v, want no sink", err)
+	}
+	multi, err := NewMultiSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A MultiSink without sinks discards events.
+	multi.HandleEvent(testEvent(1))
+	if err := multi.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// OutputStream identifies which of the target's output streams a chunk was written to.
+type OutputStream string
+
+const (
+	// OutputStdout is the target session's standard output. For PTY sessions
+	// this carries everything the target writes, as a PTY merges both streams.
+	OutputStdout OutputStream = "stdout"
+	// OutputStderr is the target session's standard error.
+	OutputStderr OutputStream = "stderr"
+)
+
+// OutputChunk is a single write made by the target to one of its output streams.
+type OutputChunk struct {
+	// Stream is the stream the target wrote to.
+	Stream OutputStream
+
+	// Data is a copy of the bytes written, possibly truncated.
+	Data []byte
+
+	// Timestamp is when the proxy relayed the chunk to the client.
+	Timestamp time.Time
+
+	// Truncated is set when Data is shorter than what the target wrote.
+	Truncated bool
+
+	// Sampled is set once the session has used up its capture budget and
+	// only a sample of chunks is being captured.
+	Sampled bool
+
+	// Dropped is the number of chunks that were not captured between the
+	// previous captured chunk and this one.
+	Dropped int
+}
+
+// SSHOutputAuditor may optionally be implemented by an SSHAuditLogger to also
+// receive the output the target writes back to the client.
+type SSHOutputAuditor interface {
+	// ReceiveOutput takes an outputChan, which sends the target's output as it
+	// is relayed to the client. It is called ONCE per SSH session, for both PTY
+	// and command sessions, and outputChan is closed once the session ends.
+	//
+	// Capture is bounded by the server's OutputCaptureConfig, so implementations
+	// should expect truncated, sampled and dropped chunks on large outputs.
+	ReceiveOutput(outputChan <-chan OutputChunk, sess SessionDetails)
+}
+
+// OutputCaptureConfig bounds how much of a session's output is captured for auditing.
+// Output relayed to the client is never affected.
+type OutputCaptureConfig struct {
+	// MaxBytes is the number of bytes captured in full per session, after
+	// which capture switches to sampling.
+	MaxBytes int64
+
+	// MaxChunkSize truncates any single captured chunk to this many bytes.
+	MaxChunkSize int
+
+	// SampleEvery captures only every SampleEvery-th chunk once MaxBytes has
+	// been reached. Zero stops capturing entirely at that point.
+	SampleEvery int
+
+	// SampleChunkSize truncates sampled chunks to this many bytes.
+	SampleChunkSize int
+
+	// BufferSize is the number of chunks queued for the auditor, chunks are
+	// dropped rather than slowing down the session when the queue is full.
+	BufferSize int
+}
+
+// DefaultOutputCaptureConfig returns the capture bounds used when none are configured.
+func DefaultOutputCaptureConfig() OutputCaptureConfig {
+	return OutputCaptureConfig{
+		MaxBytes:        1 << 20,
+		MaxChunkSize:    32 << 10,
+		SampleEvery:     100,
+		SampleChunkSize: 256,
+		BufferSize:      256,
+	}
+}
+
+// outputCapture tees a session's output streams into a bounded channel of chunks.
+//
+// When redacting, output is captured a line at a time so secrets printed
+// across several writes are redacted whole, each chunk then being a line.
+type outputCapture struct {
+	cfg   OutputCaptureConfig
+	lines map[OutputStream]*lineRedactor
+
+	mu       sync.Mutex
+	ch       chan OutputChunk
+	closed   bool
+	captured int64
+	seen     int
+	dropped  int
+}
+
+func newOutputCapture(cfg OutputCaptureConfig, redactor *Redactor) *outputCapture {
+	c := &outputCapture{
+		cfg: cfg,
+		ch:  make(chan OutputChunk, cfg.BufferSize),
+	}
+	if redactor != nil {
+		c.lines = map[OutputStream]*lineRedactor{}
+		for _, stream := range []OutputStream{OutputStdout, OutputStderr} {
+			c.lines[stream] = redactor.newLineRedactor(func(p []byte) {
+				c.capture(stream, p)
+			})
+		}
+	}
+	return c
+}
+
+// chunks returns the channel captured chunks are sent on.
+func (c *outputCapture) chunks() <-chan OutputChunk {
+	return c.ch
+}
+
+// writer returns a writer that writes to dst, capturing what was written as stream.
+// A nil capture returns dst as is.
+func (c *outputCapture) writer(stream OutputStream, dst io.Writer) io.Writer {
+	if c == nil {
+		return dst
+	}
+	return &captureWriter{capture: c, stream: stream, dst: dst}
+}
+
+// write takes p written to stream, capturing it once its line ends when redacting.
+func (c *outputCapture) write(stream OutputStream, p []byte) {
+	if lines, ok := c.lines[stream]; ok {
+		lines.write(p)
+		return
+	}
+	c.capture(stream, p)
+}
+
+// capture records p written to stream, it never blocks.
+func (c *outputCapture) capture(stream OutputStream, p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || len(p) == 0 {
+		return
+	}
+	c.seen++
+
+	chunk := OutputChunk{
+		Stream:    stream,
+		Timestamp: time.Now(),
+	}
+	limit := c.cfg.MaxChunkSize
+	if c.captured >= c.cfg.MaxBytes {
+		if c.cfg.SampleEvery <= 0 || c.seen%c.cfg.SampleEvery != 0 {
+			c.dropped++
+			return
+		}
+		chunk.Sampled = true
+		limit = c.cfg.SampleChunkSize
+	}
+	if limit > 0 && len(p) > limit {
+		p = p[:limit]
+		chunk.Truncated = true
+	}
+	chunk.Data = append([]byte(nil), p...)
+	chunk.Dropped = c.dropped
+
+	select {
+	case c.ch <- chunk:
+		c.captured += int64(len(chunk.Data))
+		c.dropped = 0
+	default:
+		c.dropped++
+	}
+}
+
+// close captures any partial lines and closes the chunk channel, any later
+// writes are no longer captured.
+func (c *outputCapture) close() {
+	if c == nil {
+		return
+	}
+	for _, lines := range c.lines {
+		lines.flush()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+}
+
+type captureWriter struct {
+	capture *outputCapture
+	stream  OutputStream
+	dst     io.Writer
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	w.capture.write(w.stream, p[:n])
+	return n, err
+}
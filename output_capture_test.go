@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOutputCaptureBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    OutputCaptureConfig
+		writes []string
+		want   []OutputChunk
+	}{{
+		name:   "captured in full",
+		cfg:    OutputCaptureConfig{MaxBytes: 100, MaxChunkSize: 10, SampleEvery: 2, SampleChunkSize: 2, BufferSize: 10},
+		writes: []string{"hello", "world"},
+		want: []OutputChunk{
+			{Data: []byte("hello")},
+			{Data: []byte("world")},
+		},
+	}, {
+		name:   "chunks truncated",
+		cfg:    OutputCaptureConfig{MaxBytes: 100, MaxChunkSize: 3, SampleEvery: 2, SampleChunkSize: 2, BufferSize: 10},
+		writes: []string{"hello"},
+		want: []OutputChunk{
+			{Data: []byte("hel"), Truncated: true},
+		},
+	}, {
+		name:   "sampled past the budget",
+		cfg:    OutputCaptureConfig{MaxBytes: 5, MaxChunkSize: 10, SampleEvery: 2, SampleChunkSize: 2, BufferSize: 10},
+		writes: []string{"hello", "aaa", "bbb", "ccc", "ddd"},
+		want: []OutputChunk{
+			{Data: []byte("hello")},
+			{Data: []byte("aa"), Truncated: true, Sampled: true},
+			{Data: []byte("cc"), Truncated: true, Sampled: true, Dropped: 1},
+		},
+	}, {
+		name:   "stopped past the budget",
+		cfg:    OutputCaptureConfig{MaxBytes: 5, MaxChunkSize: 10, SampleEvery: 0, BufferSize: 10},
+		writes: []string{"hello", "aaa", "bbb"},
+		want: []OutputChunk{
+			{Data: []byte("hello")},
+		},
+	}, {
+		name:   "dropped when the buffer is full",
+		cfg:    OutputCaptureConfig{MaxBytes: 100, MaxChunkSize: 10, SampleEvery: 2, SampleChunkSize: 2, BufferSize: 1},
+		writes: []string{"one", "two", "three"},
+		want: []OutputChunk{
+			{Data: []byte("one")},
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			capture := newOutputCapture(test.cfg, nil)
+			var dst bytes.Buffer
+			w := capture.writer(OutputStdout, &dst)
+			for _, s := range test.writes {
+				if _, err := w.Write([]byte(s)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			capture.close()
+
+			if got, want := dst.String(), strings.Join(test.writes, ""); got != want {
+				t.Errorf("relayed %q, want %q", got, want)
+			}
+			var got []OutputChunk
+			for chunk := range capture.chunks() {
+				if chunk.Stream != OutputStdout {
+					t.Errorf("chunk stream %q, want %q", chunk.Stream, OutputStdout)
+				}
+				got = append(got, chunk)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d chunks, want %d: %+v", len(got), len(test.want), got)
+			}
+			for i := range got {
+				g, w := got[i], test.want[i]
+				if !bytes.Equal(g.Data, w.Data) || g.Truncated != w.Truncated || g.Sampled != w.Sampled || g.Dropped != w.Dropped {
+					t.Errorf("chunk %d = %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestOutputCaptureNil(t *testing.T) {
+	var capture *outputCapture
+	var dst bytes.Buffer
+	if w := capture.writer(OutputStderr, &dst); w != &dst {
+		t.Errorf("nil capture wrapped its writer")
+	}
+	capture.close()
+}
+
+func TestOutputCaptureAfterClose(t *testing.T) {
+	capture := newOutputCapture(DefaultOutputCaptureConfig(), nil)
+	capture.close()
+	capture.close()
+	if _, err := capture.writer(OutputStdout, &bytes.Buffer{}).Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-capture.chunks(); ok {
+		t.Errorf("output captured after close")
+	}
+}
+
+func TestOutputCaptureRedaction(t *testing.T) {
+	redactor, err := NewRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		stream OutputStream
+		writes []string
+		want   []string
+	}{{
+		name:   "secret split across writes",
+		stream: OutputStdout,
+		writes: []string{"AWS_SECRET_ACCESS_KEY=ab", "cd\nok\n"},
+		want:   []string{"AWS_SECRET_ACCESS_KEY=[REDACTED]\n", "ok\n"},
+	}, {
+		name:   "unfinished line is captured on close",
+		stream: OutputStderr,
+		writes: []string{"Authorization: Bearer ", "xyz"},
+		want:   []string{"Authorization: Bearer [REDACTED]"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			capture := newOutputCapture(DefaultOutputCaptureConfig(), redactor)
+			var dst bytes.Buffer
+			w := capture.writer(test.stream, &dst)
+			for _, s := range test.writes {
+				w.Write([]byte(s))
+			}
+			capture.close()
+
+			if got, want := dst.String(), strings.Join(test.writes, ""); got != want {
+				t.Errorf("relayed %q, want %q", got, want)
+			}
+			var got []string
+			for chunk := range capture.chunks() {
+				if chunk.Stream != test.stream {
+					t.Errorf("chunk stream %q, want %q", chunk.Stream, test.stream)
+				}
+				got = append(got, string(chunk.Data))
+			}
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("captured %q, want %q", got, test.want)
+			}
+		})
+	}
+}
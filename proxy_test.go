@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// testProxy is a proxy in front of an in-process target, both listening on
+// the loopback interface.
+type testProxy struct {
+	mitm   *MITMAuditingSSHServerWithHTTP
+	http   *httptest.Server
+	target *gliderssh.Server
+}
+
+// newTestProxy starts a proxy handing events to sink, in front of a target
+// handling sessions with handler.
+func newTestProxy(t *testing.T, sink EventSink, handler gliderssh.Handler, opts ...ServerOption) *testProxy {
+	t.Helper()
+	signer := newTestSigner(t)
+
+	target := &gliderssh.Server{Handler: handler}
+	target.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go target.Serve(ln)
+
+	mitm := NewMITMAuditingSSHServerWithEventSink(sink, append([]ServerOption{WithHostKey(signer)}, opts...)...)
+	mitm.dial = func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+			User:            "test",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+	return &testProxy{
+		mitm:   mitm,
+		http:   httptest.NewServer(mitm.srv.Handler),
+		target: target,
+	}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// dial connects a client to the proxy through an HTTP CONNECT request.
+func (p *testProxy) dial(t *testing.T) *ssh.Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", p.http.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "CONNECT /ssh HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	// The response is read a byte at a time, so nothing the proxy sends
+	// after it is buffered away from the SSH handshake.
+	var resp []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(resp, []byte("\r\n\r\n")) {
+		if _, err := conn.Read(b); err != nil {
+			t.Fatalf("CONNECT failed: %q %v", resp, err)
+		}
+		resp = append(resp, b[0])
+	}
+	if !bytes.HasPrefix(resp, []byte("HTTP/1.1 200")) {
+		t.Fatalf("CONNECT failed: %q", resp)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, "proxy", &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.NewClient(c, chans, reqs)
+}
+
+func (p *testProxy) close() {
+	p.http.Close()
+	p.target.Close()
+}
+
+// echoTarget is a target handler echoing a PTY session's input back until the
+// line "exit" is typed, Ctrl+C discarding the line, and printing exec
+// sessions' commands.
+func echoTarget(s gliderssh.Session) {
+	if len(s.Command()) > 0 {
+		fmt.Fprintf(s, "ran %s\n", strings.Join(s.Command(), " "))
+		s.Exit(0)
+		return
+	}
+	var line []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := s.Read(buf)
+		if err != nil {
+			return
+		}
+		s.Write(buf[:n])
+		for _, b := range buf[:n] {
+			if b == 0x03 {
+				line = line[:0]
+				continue
+			}
+			if b != '\r' {
+				line = append(line, b)
+				continue
+			}
+			if string(line) == "exit" {
+				s.Exit(0)
+				return
+			}
+			line = line[:0]
+		}
+	}
+}
+
+// startShell starts a PTY session through client, returning its input and
+// the output shown in its terminal.
+func startShell(t *testing.T, client *ssh.Client) (*ssh.Session, io.WriteCloser, *lockedBuffer) {
+	t.Helper()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A terminal shows both, so out holds both.
+	out := &lockedBuffer{}
+	sess.Stdout = out
+	sess.Stderr = out
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	return sess, stdin, out
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// checkGoroutines fails the test if more goroutines are left running than
+// before it started, once given time to exit.
+func checkGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionTeardownLeaks(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow OverflowPolicy
+		// session runs a session through client, returning once the
+		// client is done with it.
+		session func(t *testing.T, client *ssh.Client)
+		// stuck holds up the sink until the session is done.
+		stuck bool
+	}{{
+		name:     "shell exits under drop",
+		overflow: OverflowDrop,
+		session:  exitShell,
+	}, {
+		name:     "shell exits under block",
+		overflow: OverflowBlock,
+		session:  exitShell,
+	}, {
+		name:     "shell exits under kill",
+		overflow: OverflowKill,
+		session:  exitShell,
+	}, {
+		name:     "killed on overflow",
+		overflow: OverflowKill,
+		stuck:    true,
+		session: func(t *testing.T, client *ssh.Client) {
+			sess, stdin, _ := startShell(t, client)
+			// Far more lines than the queues hold while the sink is stuck.
+			stdin.Write(bytes.Repeat([]byte("a\r"), 2*auditQueueSize+16))
+			done := make(chan error, 1)
+			go func() { done <- sess.Wait() }()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Error("session not killed on overflow")
+			}
+		},
+	}, {
+		name:     "exec",
+		overflow: OverflowDrop,
+		session: func(t *testing.T, client *ssh.Client) {
+			sess, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := sess.Output("uptime")
+			if err != nil || string(out) != "ran uptime\n" {
+				t.Errorf("exec output %q, %v", out, err)
+			}
+		},
+	}, {
+		name:     "client disconnects mid-session",
+		overflow: OverflowDrop,
+		session: func(t *testing.T, client *ssh.Client) {
+			_, stdin, out := startShell(t, client)
+			io.WriteString(stdin, "ls\r")
+			waitFor(t, func() bool { return strings.Contains(out.String(), "ls") })
+			client.Close()
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+
+			sink := &testSink{}
+			if test.stuck {
+				sink.release = make(chan struct{})
+			}
+			size := 64
+			if test.stuck {
+				size = 1
+			}
+			p := newTestProxy(t, sink, echoTarget,
+				WithInputQueue(InputQueueConfig{Size: size, Overflow: test.overflow}),
+				WithEchoTimeout(10*time.Millisecond),
+			)
+			client := p.dial(t)
+			test.session(t, client)
+			client.Close()
+			if sink.release != nil {
+				close(sink.release)
+			}
+			// The session must end by itself, before the target goes away.
+			waitFor(t, func() bool {
+				types := sink.types()
+				return len(p.mitm.sessions.list()) == 0 && len(types) > 0 && types[len(types)-1] == EventDisconnect
+			})
+			p.close()
+			checkGoroutines(t, before)
+		})
+	}
+}
+
+// exitShell starts a shell through client and exits it.
+func exitShell(t *testing.T, client *ssh.Client) {
+	sess, stdin, _ := startShell(t, client)
+	io.WriteString(stdin, "echo hi\rexit\r")
+	if err := sess.Wait(); err != nil {
+		t.Errorf("shell exited with %v", err)
+	}
+}
+
+func TestSessionChannels(t *testing.T) {
+	sink := &testSink{}
+	dir := t.TempDir()
+	p := newTestProxy(t, sink, echoTarget, WithSessionRecording(dir))
+	defer p.close()
+	client := p.dial(t)
+	defer client.Close()
+
+	// Each channel of the connection is named the same way in the admin
+	// API, its recording and its events.
+	for _, typed := range []string{"first\r", "second\r"} {
+		sess, stdin, out := startShell(t, client)
+		io.WriteString(stdin, typed)
+		waitFor(t, func() bool { return strings.Contains(out.String(), typed) })
+		defer func() {
+			io.WriteString(stdin, "exit\r")
+			sess.Wait()
+		}()
+	}
+	sessionID := hex.EncodeToString(client.SessionID())
+	want := []string{sessionID, sessionID + "-2"}
+	infos := p.mitm.sessions.list()
+	if len(infos) != 2 || infos[0].ID != want[0] || infos[1].ID != want[1] {
+		t.Fatalf("sessions %+v, want IDs %q", infos, want)
+	}
+	for i, name := range want {
+		if _, err := os.Stat(recordingPath(dir, name)); err != nil {
+			t.Errorf("recording of channel %s: %v", name, err)
+		}
+		typed := []string{"first", "second"}[i]
+		waitFor(t, func() bool {
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			for _, e := range sink.events {
+				if input, ok := e.Data.(InputEvent); ok && e.Session.Channel == name && strings.Contains(input.Data, typed) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	gliderssh "github.com/gliderlabs/ssh"
+)
+
+// asciicastHeader is the first line of an asciicast v2 recording.
+// See https://docs.asciinema.org/manual/asciicast/v2/
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recordingMetadata is stored alongside each recording, so recordings can be
+// found by who made them and when without parsing every recording.
+type recordingMetadata struct {
+	// Recording is the name of the recording, the SessionID of the first
+	// PTY channel of a connection, followed by "-2", "-3" and so on for
+	// any further channels.
+	Recording     string     `json:"recording"`
+	SessionID     string     `json:"session_id"`
+	User          string     `json:"user"`
+	ClientAddr    string     `json:"client_addr"`
+	ClientVersion string     `json:"client_version"`
+	Start         time.Time  `json:"start"`
+	End           *time.Time `json:"end,omitempty"`
+}
+
+const (
+	asciicastOutput = "o"
+	asciicastInput  = "i"
+	asciicastResize = "r"
+)
+
+// sessionRecorder writes a PTY session to an asciicast v2 file, one event per line.
+//
+// When redacting, output is recorded a line at a time so secrets printed
+// across several writes are redacted whole, and its events are timed by when
+// each line ended rather than when each write was made.
+//
+// All methods are safe to call on a nil recorder, in which case nothing is recorded.
+type sessionRecorder struct {
+	mu      sync.Mutex
+	output  *lineRedactor
+	dir     string
+	meta    recordingMetadata
+	f       *os.File
+	start   time.Time
+	pending map[string][]byte
+	closed  bool
+}
+
+// newSessionRecorder creates the recording for sess within dir and writes its
+// header. Secrets found by redactor are redacted from the recorded output,
+// recorded input is expected to have been redacted already.
+func newSessionRecorder(dir string, sess SessionDetails, pty gliderssh.Pty, redactor *Redactor) (*sessionRecorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	// Every channel of a connection shares its SessionID, so recordings are
+	// named after the channel.
+	name := sess.Channel
+	f, err := os.OpenFile(recordingPath(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	r := &sessionRecorder{
+		dir:     dir,
+		f:       f,
+		start:   time.Now(),
+		pending: map[string][]byte{},
+	}
+	if redactor != nil {
+		r.output = redactor.newLineRedactor(func(p []byte) {
+			r.record(asciicastOutput, p)
+		})
+	}
+	r.meta = recordingMetadata{
+		Recording:     name,
+		SessionID:     sess.SessionID,
+		User:          sess.User,
+		ClientAddr:    sess.ClientAddr,
+		ClientVersion: sess.ClientVersion,
+		Start:         r.start,
+	}
+
+	env := map[string]string{}
+	for _, kv := range sess.Environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	env["TERM"] = pty.Term
+
+	header, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     pty.Window.Width,
+		Height:    pty.Window.Height,
+		Timestamp: r.start.Unix(),
+		Env:       env,
+	})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to marshal recording header: %w", err)
+	}
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+	if err := r.writeMetadata(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// recordingPath returns the path of the named recording within dir.
+func recordingPath(dir, name string) string {
+	return filepath.Join(dir, name+".cast")
+}
+
+// recordingMetadataPath returns the path of the named recording's metadata within dir.
+func recordingMetadataPath(dir, name string) string {
+	return filepath.Join(dir, name+".json")
+}
+
+// writeMetadata replaces the recording's metadata file.
+func (r *sessionRecorder) writeMetadata() error {
+	b, err := json.MarshalIndent(r.meta, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal recording metadata: %w", err)
+	}
+	path := recordingMetadataPath(r.dir, r.meta.Recording)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("failed to write recording metadata: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write recording metadata: %w", err)
+	}
+	return nil
+}
+
+// writer returns a writer that writes to dst, recording what was written as output.
+func (r *sessionRecorder) writer(dst io.Writer) io.Writer {
+	if r == nil {
+		return dst
+	}
+	return &recordingWriter{recorder: r, dst: dst}
+}
+
+// input records input sent by the client, which is recorded as is.
+func (r *sessionRecorder) input(p []byte) {
+	if r == nil {
+		return
+	}
+	r.record(asciicastInput, p)
+}
+
+// resize records a change in the client's window size.
+func (r *sessionRecorder) resize(width, height int) {
+	if r == nil {
+		return
+	}
+	r.record(asciicastResize, []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+// record writes a single event. Incomplete UTF-8 sequences at the end of p are
+// held back until the rest of the sequence arrives, as events must be valid strings.
+func (r *sessionRecorder) record(code string, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	data := append(r.pending[code], p...)
+	data, r.pending[code] = splitIncompleteRune(data)
+	if len(data) == 0 {
+		return
+	}
+
+	elapsed := time.Since(r.start).Seconds()
+	event, err := json.Marshal([]any{elapsed, code, string(data)})
+	if err != nil {
+		return
+	}
+	r.f.Write(append(event, '\n'))
+}
+
+// close closes the recording file and records when the session ended.
+func (r *sessionRecorder) close() error {
+	if r == nil {
+		return nil
+	}
+	if r.output != nil {
+		r.output.flush()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	end := time.Now()
+	r.meta.End = &end
+	if err := r.writeMetadata(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// splitIncompleteRune splits p before a trailing incomplete UTF-8 sequence, if any.
+func splitIncompleteRune(p []byte) (complete, rest []byte) {
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return p[:i], append([]byte(nil), p[i:]...)
+			}
+			break
+		}
+	}
+	return p, nil
+}
+
+type recordingWriter struct {
+	recorder *sessionRecorder
+	dst      io.Writer
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	if w.recorder.output != nil {
+		w.recorder.output.write(p[:n])
+	} else {
+		w.recorder.record(asciicastOutput, p[:n])
+	}
+	return n, err
+}
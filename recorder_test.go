@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gliderssh "github.com/gliderlabs/ssh"
+)
+
+func TestSessionRecorder(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func(r *sessionRecorder)
+		want   [][2]string
+	}{{
+		name: "output and input",
+		record: func(r *sessionRecorder) {
+			r.writer(io.Discard).Write([]byte("$ "))
+			r.input([]byte("ls\r"))
+		},
+		want: [][2]string{{asciicastOutput, "$ "}, {asciicastInput, "ls\r"}},
+	}, {
+		name: "resize",
+		record: func(r *sessionRecorder) {
+			r.resize(120, 40)
+		},
+		want: [][2]string{{asciicastResize, "120x40"}},
+	}, {
+		name: "utf-8 split across writes",
+		record: func(r *sessionRecorder) {
+			w := r.writer(io.Discard)
+			w.Write([]byte("caf\xc3"))
+			w.Write([]byte("\xa9!"))
+		},
+		want: [][2]string{{asciicastOutput, "caf"}, {asciicastOutput, "é!"}},
+	}, {
+		name: "nothing after close",
+		record: func(r *sessionRecorder) {
+			r.close()
+			r.input([]byte("late"))
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sess := SessionDetails{SessionID: "abc", Channel: "abc", User: "test", Environ: []string{"LANG=C"}}
+			pty := gliderssh.Pty{Term: "xterm", Window: gliderssh.Window{Width: 80, Height: 24}}
+			r, err := newSessionRecorder(dir, sess, pty, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.record(r)
+			if err := r.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			header, events := readTestRecording(t, recordingPath(dir, "abc"))
+			if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Env["TERM"] != "xterm" || header.Env["LANG"] != "C" {
+				t.Errorf("unexpected header %+v", header)
+			}
+			if len(events) != len(test.want) {
+				t.Fatalf("got %d events, want %d: %v", len(events), len(test.want), events)
+			}
+			for i, e := range events {
+				if e[0] != test.want[i][0] || e[1] != test.want[i][1] {
+					t.Errorf("event %d = %q, want %q", i, e, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSessionRecorderChannels(t *testing.T) {
+	dir := t.TempDir()
+	var recorders []*sessionRecorder
+	for _, channel := range []string{"abc", "abc-2"} {
+		r, err := newSessionRecorder(dir, SessionDetails{SessionID: "abc", Channel: channel}, gliderssh.Pty{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorders = append(recorders, r)
+	}
+	for i, name := range []string{"abc", "abc-2"} {
+		recorders[i].close()
+		if _, err := os.Stat(recordingPath(dir, name)); err != nil {
+			t.Errorf("recording %s: %v", name, err)
+		}
+		b, err := os.ReadFile(recordingMetadataPath(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta recordingMetadata
+		if err := json.Unmarshal(b, &meta); err != nil {
+			t.Fatal(err)
+		}
+		if meta.Recording != name || meta.SessionID != "abc" || meta.End == nil {
+			t.Errorf("recording %s metadata %+v", name, meta)
+		}
+	}
+	// A recording is never overwritten.
+	if _, err := newSessionRecorder(dir, SessionDetails{SessionID: "abc", Channel: "abc-2"}, gliderssh.Pty{}, nil); err == nil {
+		t.Error("recording abc-2 created twice")
+	}
+}
+
+func TestSplitIncompleteRune(t *testing.T) {
+	tests := []struct {
+		in, complete, rest string
+	}{
+		{"abc", "abc", ""},
+		{"ab\xc3", "ab", "\xc3"},
+		{"a\xe2\x82", "a", "\xe2\x82"},
+		{"a\xe2\x82\xac", "a\xe2\x82\xac", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		complete, rest := splitIncompleteRune([]byte(test.in))
+		if string(complete) != test.complete || string(rest) != test.rest {
+			t.Errorf("splitIncompleteRune(%q) = %q, %q, want %q, %q", test.in, complete, rest, test.complete, test.rest)
+		}
+	}
+}
+
+// readTestRecording reads the header and the code and data of each event of
+// the recording at path.
+func readTestRecording(t *testing.T, path string) (asciicastHeader, [][2]string) {
+	t.Helper()
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var header asciicastHeader
+	if !scanner.Scan() {
+		t.Fatal("recording has no header")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	var events [][2]string
+	for scanner.Scan() {
+		var e []any
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, [2]string{e[1].(string), e[2].(string)})
+	}
+	return header, events
+}
+
+func TestSessionRecorderRedaction(t *testing.T) {
+	redactor, err := NewRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	r, err := newSessionRecorder(dir, SessionDetails{SessionID: "abc", Channel: "abc"}, gliderssh.Pty{}, redactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := r.writer(io.Discard)
+	for _, p := range []string{"DB_PASS", "WORD=hun", "ter2\r\n", "$ "} {
+		w.Write([]byte(p))
+	}
+	r.close()
+
+	_, events := readTestRecording(t, recordingPath(dir, "abc"))
+	want := [][2]string{{asciicastOutput, "DB_PASSWORD=[REDACTED]\r"}, {asciicastOutput, "\n"}, {asciicastOutput, "$ "}}
+	if len(events) != len(want) {
+		t.Fatalf("got events %q, want %q", events, want)
+	}
+	for i := range events {
+		if events[i] != want[i] {
+			t.Errorf("event %d = %q, want %q", i, events[i], want[i])
+		}
+	}
+}
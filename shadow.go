@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// shadowUpdate is a text message of the shadowing protocol. Output is sent as
+// binary messages, exactly as it is written to the user's terminal.
+type shadowUpdate struct {
+	// Type is "session" for the first message, describing the session, and
+	// "resize" when the user's terminal is resized.
+	Type    string       `json:"type"`
+	Session *SessionInfo `json:"session,omitempty"`
+	Width   int          `json:"width,omitempty"`
+	Height  int          `json:"height,omitempty"`
+}
+
+// handleShadowSession streams a session's output to an admin over a WebSocket,
+// until either the admin or the session goes away. The admin's messages are
+// ignored, the session cannot be written to. With ?notify=true the user is
+// told when the admin attaches and detaches.
+func (m *MITMAuditingSSHServerWithHTTP) handleShadowSession(w http.ResponseWriter, r *http.Request, admin string) {
+	m.streamSession(w, r, admin, false)
+}
+
+// handleControlSession is as handleShadowSession, but the admin takes control
+// of the session: their messages are sent to the target as keystrokes,
+// alongside the user's. Only one admin may be in control of a session at a
+// time, and both the admin and the user are shown when control is taken and
+// released.
+func (m *MITMAuditingSSHServerWithHTTP) handleControlSession(w http.ResponseWriter, r *http.Request, admin string) {
+	m.streamSession(w, r, admin, true)
+}
+
+// streamSession streams a session to an admin over a WebSocket, giving them
+// control of it if control is set.
+func (m *MITMAuditingSSHServerWithHTTP) streamSession(w http.ResponseWriter, r *http.Request, admin string, control bool) {
+	var notify bool
+	if v := r.URL.Query().Get("notify"); v != "" {
+		var err error
+		if notify, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid notify parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	live := m.sessions.get(r.PathValue("id"))
+	if live == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if control && live.sessionType != "pty" {
+		http.Error(w, "Only PTY sessions can be controlled", http.StatusConflict)
+		return
+	}
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		zapctx.Debug(r.Context(), "shadow websocket upgrade failed", zap.Error(err))
+		return
+	}
+	watcher, ok := live.attach(admin, notify)
+	if !ok {
+		conn.close("session ended")
+		return
+	}
+	if control {
+		if err := live.takeControl(watcher, m.redactor); err != nil {
+			live.detach(watcher, "")
+			conn.close(err.Error())
+			return
+		}
+		zapctx.Info(r.Context(), "admin took control of session", zap.String("session", live.id), zap.String("admin", admin))
+	} else {
+		zapctx.Info(r.Context(), "admin shadowing session", zap.String("session", live.id), zap.String("admin", admin))
+	}
+
+	// Without control, the admin's messages are only read to notice them
+	// going away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			_, input, err := conn.readMessage()
+			if err != nil {
+				return
+			}
+			if !control {
+				continue
+			}
+			n, err := live.inject(watcher, input)
+			m.metrics.bytes.add(float64(n), directionClientToTarget)
+			if err != nil {
+				zapctx.Error(r.Context(), "failed to send admin input", zap.Error(err))
+				conn.close(err.Error())
+				return
+			}
+		}
+	}()
+
+	info := live.info()
+	err = conn.writeJSON(shadowUpdate{Type: "session", Session: &info})
+	for err == nil {
+		select {
+		case <-gone:
+			err = net.ErrClosed
+		case msg, ok := <-watcher.messages:
+			switch {
+			case !ok:
+				// The session ended or the admin fell behind.
+				conn.close(watcher.reason)
+				<-gone
+				return
+			case msg.resize != nil:
+				err = conn.writeJSON(shadowUpdate{Type: "resize", Width: msg.resize.Width, Height: msg.resize.Height})
+			default:
+				err = conn.writeMessage(wsBinary, msg.output)
+			}
+		}
+	}
+	live.detach(watcher, "")
+	conn.close("")
+	<-gone
+}
+
+// writeJSON writes v as a text message.
+func (c *wsConn) writeJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(wsText, b)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	gliderssh "github.com/gliderlabs/ssh"
+)
+
+// wsClient is an admin's WebSocket connection to the admin API.
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialAdminWebSocket opens a WebSocket to path of the proxy's admin API,
+// authenticated with token.
+func dialAdminWebSocket(t *testing.T, p *testProxy, path, token string) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", p.http.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req, err := http.NewRequest(http.MethodGet, p.http.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", wsTestKey)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade = %d, want 101", resp.StatusCode)
+	}
+	return &wsClient{conn: conn, r: r}
+}
+
+func (c *wsClient) write(t *testing.T, opcode byte, payload string) {
+	t.Helper()
+	if _, err := c.conn.Write(clientFrame(true, opcode, []byte(payload))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *wsClient) read(t *testing.T) wsFrame {
+	t.Helper()
+	frame, err := readServerFrame(c.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// readUpdate reads a text message of the shadowing protocol.
+func (c *wsClient) readUpdate(t *testing.T) shadowUpdate {
+	t.Helper()
+	frame := c.read(t)
+	var update shadowUpdate
+	if err := json.Unmarshal([]byte(frame.payload), &update); frame.opcode != wsText || err != nil {
+		t.Fatalf("read %+v, %v, want a text message", frame, err)
+	}
+	return update
+}
+
+// readOutputUntil reads the session's output until it contains s, returning
+// the other messages read along the way.
+func (c *wsClient) readOutputUntil(t *testing.T, s string) []wsFrame {
+	t.Helper()
+	var output string
+	var others []wsFrame
+	for !strings.Contains(output, s) {
+		frame := c.read(t)
+		if frame.opcode != wsBinary {
+			others = append(others, frame)
+			continue
+		}
+		output += frame.payload
+	}
+	return others
+}
+
+// watchedShell is a shell started through a proxy, for admins to watch.
+type watchedShell struct {
+	// id is the session's ID in the admin API.
+	id     string
+	client interface{ Close() error }
+	sess   interface {
+		WindowChange(h, w int) error
+		Wait() error
+	}
+	stdin io.Writer
+	out   *lockedBuffer
+}
+
+// startWatchedShell starts a shell through the proxy, returning once it is
+// relaying input.
+func startWatchedShell(t *testing.T, p *testProxy) *watchedShell {
+	t.Helper()
+	client := p.dial(t)
+	sess, stdin, out := startShell(t, client)
+	// Once the shell echoes input, its input and output are relayed.
+	io.WriteString(stdin, "ready\r")
+	waitFor(t, func() bool { return strings.Contains(out.String(), "ready") })
+	return &watchedShell{
+		id:     p.mitm.sessions.list()[0].ID,
+		client: client,
+		sess:   sess,
+		stdin:  stdin,
+		out:    out,
+	}
+}
+
+// exit exits the shell and closes its client.
+func (s *watchedShell) exit() {
+	io.WriteString(s.stdin, "exit\r")
+	s.sess.Wait()
+	s.client.Close()
+}
+
+func TestShadowSession(t *testing.T) {
+	sink := &testSink{}
+	p := newTestProxy(t, sink, echoTarget, WithAdminAPI(testAdmins))
+	defer p.close()
+	shell := startWatchedShell(t, p)
+	defer shell.exit()
+	id, stdin, out := shell.id, shell.stdin, shell.out
+
+	admin := dialAdminWebSocket(t, p, "/admin/sessions/"+id+"/shadow?notify=true", "alice-token")
+	update := admin.readUpdate(t)
+	if update.Type != "session" || update.Session == nil || update.Session.ID != id {
+		t.Fatalf("first message %+v, want the session", update)
+	}
+	waitFor(t, func() bool { return strings.Contains(out.String(), "*** alice is watching this session ***") })
+
+	// The admin sees the output written to the user's terminal.
+	io.WriteString(stdin, "echo shadowed\r")
+	admin.readOutputUntil(t, "echo shadowed")
+
+	// A shadowing admin's messages are not sent to the target.
+	admin.write(t, wsBinary, "rm -rf /\r")
+	io.WriteString(stdin, "after\r")
+	admin.readOutputUntil(t, "after")
+	if strings.Contains(out.String(), "rm -rf") {
+		t.Errorf("shadowing admin's input reached the target: %q", out.String())
+	}
+
+	// The admin is told when the user's terminal is resized.
+	if err := shell.sess.WindowChange(30, 100); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		frame := admin.read(t)
+		if frame.opcode != wsText {
+			continue
+		}
+		var update shadowUpdate
+		json.Unmarshal([]byte(frame.payload), &update)
+		if update != (shadowUpdate{Type: "resize", Width: 100, Height: 30}) {
+			t.Errorf("update %+v, want the new size", update)
+		}
+		break
+	}
+
+	// Closing the WebSocket detaches the admin.
+	admin.write(t, wsClose, closePayload(1000, ""))
+	waitFor(t, func() bool { return len(eventData[ShadowEvent](sink)) == 2 })
+	want := []ShadowEvent{{Admin: "alice", Action: ShadowAttach}, {Admin: "alice", Action: ShadowDetach}}
+	for i, got := range eventData[ShadowEvent](sink) {
+		if got != want[i] {
+			t.Errorf("shadow events %+v, want %+v", eventData[ShadowEvent](sink), want)
+		}
+	}
+	waitFor(t, func() bool { return strings.Contains(out.String(), "*** alice stopped watching this session ***") })
+	if len(eventData[AdminInputEvent](sink)) != 0 {
+		t.Error("shadowing admin's input audited as sent")
+	}
+}
+
+func TestShadowSessionEnds(t *testing.T) {
+	sink := &testSink{}
+	p := newTestProxy(t, sink, echoTarget, WithAdminAPI(testAdmins))
+	defer p.close()
+	shell := startWatchedShell(t, p)
+
+	admin := dialAdminWebSocket(t, p, "/admin/sessions/"+shell.id+"/shadow", "alice-token")
+	admin.readUpdate(t)
+	shell.exit()
+
+	// The admin is detached once the session ends, without telling the user
+	// they were watched.
+	others := admin.readOutputUntil(t, "exit")
+	for len(others) == 0 || others[len(others)-1].opcode != wsClose {
+		others = append(others, admin.read(t))
+	}
+	if got := others[len(others)-1]; got.payload != closePayload(1000, "session ended") {
+		t.Errorf("close frame %q, want the session ended", got.payload)
+	}
+	waitFor(t, func() bool { return len(eventData[ShadowEvent](sink)) == 2 })
+	if got := eventData[ShadowEvent](sink)[1]; got != (ShadowEvent{Admin: "alice", Action: ShadowDetach, Reason: "session ended"}) {
+		t.Errorf("detach event %+v, want the session ended", got)
+	}
+	if strings.Contains(shell.out.String(), "watching") {
+		t.Errorf("user notified without notify: %q", shell.out.String())
+	}
+}
+
+func TestShadowSessionRequestErrors(t *testing.T) {
+	p := newTestProxy(t, &testSink{}, echoTarget, WithAdminAPI(testAdmins))
+	defer p.close()
+	shell := startWatchedShell(t, p)
+	defer shell.exit()
+	id := shell.id
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		upgrade    bool
+		wantStatus int
+	}{
+		{name: "unauthenticated", path: "/admin/sessions/" + id + "/shadow", upgrade: true, wantStatus: http.StatusUnauthorized},
+		{name: "unknown session", path: "/admin/sessions/unknown/shadow", token: "alice-token", upgrade: true, wantStatus: http.StatusNotFound},
+		{name: "invalid notify", path: "/admin/sessions/" + id + "/shadow?notify=maybe", token: "alice-token", upgrade: true, wantStatus: http.StatusBadRequest},
+		{name: "not a websocket", path: "/admin/sessions/" + id + "/shadow", token: "alice-token", wantStatus: http.StatusUpgradeRequired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, p.http.URL+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			if test.upgrade {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+				req.Header.Set("Sec-WebSocket-Version", "13")
+				req.Header.Set("Sec-WebSocket-Key", wsTestKey)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("status %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestControlSession(t *testing.T) {
+	sink := &testSink{}
+	p := newTestProxy(t, sink, echoTarget, WithAdminAPI(testAdmins))
+	defer p.close()
+	shell := startWatchedShell(t, p)
+	defer shell.exit()
+
+	admin := dialAdminWebSocket(t, p, "/admin/sessions/"+shell.id+"/control", "alice-token")
+	admin.readUpdate(t)
+	waitFor(t, func() bool {
+		return strings.Contains(shell.out.String(), "*** alice has taken control of this session, their keystrokes are sent alongside yours ***")
+	})
+
+	// Another admin cannot take control while alice has it.
+	other := dialAdminWebSocket(t, p, "/admin/sessions/"+shell.id+"/control", "bob-token")
+	if got := other.read(t); got != (wsFrame{wsClose, closePayload(1000, errSessionControlled.Error())}) {
+		t.Errorf("second controller read %+v, want closed as %q", got, errSessionControlled)
+	}
+
+	// The admin's keystrokes reach the target alongside the user's, and are
+	// audited as theirs.
+	admin.write(t, wsBinary, "whoami\r")
+	io.WriteString(shell.stdin, "hostname\r")
+	waitFor(t, func() bool {
+		out := shell.out.String()
+		return strings.Contains(out, "whoami") && strings.Contains(out, "hostname")
+	})
+	waitFor(t, func() bool { return len(eventData[AdminInputEvent](sink)) > 0 })
+	for _, e := range eventData[AdminInputEvent](sink) {
+		if e.Admin != "alice" || strings.Contains(e.Data, "hostname") {
+			t.Errorf("admin input %+v, want only alice's", e)
+		}
+	}
+	if got := eventData[AdminInputEvent](sink)[0].Data; !strings.Contains(got, "whoami") {
+		t.Errorf("admin input %q, want whoami", got)
+	}
+	for _, e := range eventData[InputEvent](sink) {
+		if strings.Contains(e.Data, "whoami") {
+			t.Errorf("admin input audited as the user's: %+v", e)
+		}
+	}
+
+	// Closing the WebSocket releases control.
+	admin.write(t, wsClose, closePayload(1000, ""))
+	waitFor(t, func() bool {
+		return strings.Contains(shell.out.String(), "*** alice has released control of this session ***")
+	})
+	waitFor(t, func() bool { return len(eventData[ShadowEvent](sink)) == 6 })
+	want := []ShadowEvent{
+		{Admin: "alice", Action: ShadowAttach},
+		{Admin: "alice", Action: ShadowTakeControl},
+		{Admin: "bob", Action: ShadowAttach},
+		{Admin: "bob", Action: ShadowDetach},
+		{Admin: "alice", Action: ShadowReleaseControl},
+		{Admin: "alice", Action: ShadowDetach},
+	}
+	for i, got := range eventData[ShadowEvent](sink) {
+		if got != want[i] {
+			t.Errorf("shadow events %+v, want %+v", eventData[ShadowEvent](sink), want)
+			break
+		}
+	}
+
+	// Control can be taken again once released.
+	again := dialAdminWebSocket(t, p, "/admin/sessions/"+shell.id+"/control", "bob-token")
+	if update := again.readUpdate(t); update.Type != "session" {
+		t.Errorf("first message %+v, want the session", update)
+	}
+}
+
+func TestControlExecSession(t *testing.T) {
+	// sleep runs until the client goes away.
+	target := func(s gliderssh.Session) {
+		if strings.Join(s.Command(), " ") == "sleep" {
+			<-s.Context().Done()
+			return
+		}
+		echoTarget(s)
+	}
+	p := newTestProxy(t, &testSink{}, target, WithAdminAPI(testAdmins))
+	defer p.close()
+	client := p.dial(t)
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Start("sleep"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(p.mitm.sessions.list()) == 1 })
+	id := p.mitm.sessions.list()[0].ID
+
+	// An exec session can be shadowed, but not controlled.
+	resp, body := adminRequest(t, p, http.MethodGet, "/admin/sessions/"+id+"/control", "alice-token", "")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("control = %d %q, want 409", resp.StatusCode, body)
+	}
+	admin := dialAdminWebSocket(t, p, "/admin/sessions/"+id+"/shadow", "alice-token")
+	if update := admin.readUpdate(t); update.Session == nil || update.Session.Type != "exec" {
+		t.Errorf("first message %+v, want the exec session", update)
+	}
+}
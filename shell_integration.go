@@ -0,0 +1,359 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ShellCommand is a command executed by the target's shell, as reported by
+// its shell integration markers (OSC 133 and OSC 7).
+type ShellCommand struct {
+	// Command is the command line as echoed back by the shell, after any tab
+	// completion or history expansion performed while it was edited.
+	Command string
+
+	// WorkingDirectory is the shell's working directory when the command was
+	// run, empty if the shell has not reported one.
+	WorkingDirectory string
+
+	// ExitCode is the command's exit status, nil if the session ended before
+	// the command finished or the shell did not report it.
+	ExitCode *int
+
+	// Started is when the shell started executing the command.
+	Started time.Time
+
+	// Duration is how long the command ran for.
+	Duration time.Duration
+}
+
+// SSHShellCommandAuditor may optionally be implemented by an SSHAuditLogger to
+// receive commands as delimited by the target shell's integration markers.
+// It is only used when the server is configured with WithShellIntegration.
+type SSHShellCommandAuditor interface {
+	// ReceiveShellCommands takes a commandChan, which sends each command once
+	// it has finished. It is called ONCE per PTY session, and commandChan is
+	// closed once the session ends.
+	ReceiveShellCommands(commandChan <-chan ShellCommand, sess SessionDetails)
+}
+
+// shellIntegrationSnippet is typed into bash shells when injection is enabled,
+// making bash emit the OSC 133 and OSC 7 markers around each prompt and
+// command. The leading space keeps it out of the shell's history under the
+// common HISTCONTROL=ignorespace setting.
+const shellIntegrationSnippet = ` if [ -n "$BASH_VERSION" ]; then ` +
+	`__mitm_prompt() { printf '\033]133;D;%s\007\033]7;file://%s%s\007' "$?" "$HOSTNAME" "$PWD"; }; ` +
+	`PROMPT_COMMAND="__mitm_prompt${PROMPT_COMMAND:+;$PROMPT_COMMAND}"; ` +
+	`PS1="\[\033]133;A\007\]$PS1\[\033]133;B\007\]"; ` +
+	`PS0="\033]133;C\007$PS0"; fi` + "\r"
+
+// maxOSCLength bounds the OSC sequences buffered while parsing, longer
+// sequences are not shell integration markers and are skipped.
+const maxOSCLength = 4096
+
+const (
+	oscGround = iota
+	oscEscape
+	oscCSI
+	oscString
+	oscStringEscape
+)
+
+const (
+	shellIdle = iota
+	// shellPrompt is between OSC 133;A and B, while the prompt is printed.
+	shellPrompt
+	// shellInput is between OSC 133;B and C, while the command is edited.
+	shellInput
+	// shellRunning is between OSC 133;C and D, while the command runs.
+	shellRunning
+)
+
+// shellIntegration parses the target's output for shell integration markers,
+// sending each completed command on a channel. It never blocks the output.
+type shellIntegration struct {
+	redactor *Redactor
+
+	mu     sync.Mutex
+	ch     chan ShellCommand
+	closed bool
+
+	state int
+	seq   []byte
+	phase int
+	// marked is set once the shell has sent an OSC 133 marker, so its
+	// phase is known.
+	marked bool
+	echo   echoLine
+	cwd    string
+	active ShellCommand
+}
+
+// newShellIntegration returns a shellIntegration redacting secrets found by
+// redactor from the commands it sends.
+func newShellIntegration(redactor *Redactor) *shellIntegration {
+	return &shellIntegration{
+		redactor: redactor,
+		ch:       make(chan ShellCommand, 64),
+	}
+}
+
+// commands returns the channel completed commands are sent on.
+func (s *shellIntegration) commands() <-chan ShellCommand {
+	return s.ch
+}
+
+// writer returns a writer that writes to dst, parsing what was written for
+// markers. A nil shellIntegration returns dst as is.
+func (s *shellIntegration) writer(dst io.Writer) io.Writer {
+	if s == nil {
+		return dst
+	}
+	return &shellIntegrationWriter{shell: s, dst: dst}
+}
+
+// parse parses output written by the target.
+func (s *shellIntegration) parse(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	for _, b := range p {
+		switch s.state {
+		case oscGround:
+			if b == 0x1b {
+				s.state = oscEscape
+			} else if s.phase == shellInput {
+				s.echo.writeByte(b)
+			}
+		case oscEscape:
+			switch b {
+			case ']':
+				s.state = oscString
+				s.seq = s.seq[:0]
+			case '[':
+				s.state = oscCSI
+				s.seq = s.seq[:0]
+			default:
+				s.state = oscGround
+			}
+		case oscCSI:
+			if b >= 0x40 && b <= 0x7e {
+				s.state = oscGround
+				if s.phase == shellInput {
+					s.echo.csi(string(s.seq), b)
+				}
+			} else if len(s.seq) < maxOSCLength {
+				s.seq = append(s.seq, b)
+			}
+		case oscString:
+			switch b {
+			case 0x07:
+				s.state = oscGround
+				s.osc(string(s.seq))
+			case 0x1b:
+				s.state = oscStringEscape
+			default:
+				if len(s.seq) < maxOSCLength {
+					s.seq = append(s.seq, b)
+				}
+			}
+		case oscStringEscape:
+			s.state = oscGround
+			if b == '\\' {
+				s.osc(string(s.seq))
+			}
+		}
+	}
+}
+
+// osc handles a complete OSC sequence.
+func (s *shellIntegration) osc(seq string) {
+	if len(seq) >= maxOSCLength {
+		return
+	}
+	code, args, _ := strings.Cut(seq, ";")
+	switch code {
+	case "7":
+		if u, err := url.Parse(args); err == nil && u.Scheme == "file" {
+			s.cwd = u.Path
+		}
+	case "133":
+		s.marked = true
+		marker, params, _ := strings.Cut(args, ";")
+		switch marker {
+		case "A":
+			s.phase = shellPrompt
+		case "B":
+			s.phase = shellInput
+			s.echo.reset()
+		case "C":
+			if s.phase != shellInput {
+				return
+			}
+			s.phase = shellRunning
+			s.active = ShellCommand{
+				Command:          s.redactor.Redact(s.echo.String()),
+				WorkingDirectory: s.cwd,
+				Started:          time.Now(),
+			}
+		case "D":
+			if s.phase != shellRunning {
+				return
+			}
+			s.phase = shellIdle
+			exit, _, _ := strings.Cut(params, ";")
+			if code, err := strconv.Atoi(exit); err == nil {
+				s.active.ExitCode = &code
+			}
+			s.send()
+		}
+	}
+}
+
+// running reports whether the shell is running a command, between its OSC
+// 133;C and D markers, rather than reading a command line. It reports false if
+// the shell has not sent any markers, or for a nil shellIntegration.
+func (s *shellIntegration) running() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.marked && s.phase == shellRunning
+}
+
+// send sends the active command, dropping it if the auditor is not keeping up.
+func (s *shellIntegration) send() {
+	s.active.Duration = time.Since(s.active.Started)
+	select {
+	case s.ch <- s.active:
+	default:
+	}
+	s.active = ShellCommand{}
+}
+
+// close sends any command still running and closes the command channel.
+func (s *shellIntegration) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if s.phase == shellRunning {
+		s.send()
+	}
+	s.closed = true
+	close(s.ch)
+}
+
+type shellIntegrationWriter struct {
+	shell *shellIntegration
+	dst   io.Writer
+}
+
+// Write parses p before writing it, so the shell's phase is known before the
+// client sees the output and replies to it, such as to a password prompt.
+func (w *shellIntegrationWriter) Write(p []byte) (int, error) {
+	w.shell.parse(p)
+	return w.dst.Write(p)
+}
+
+// echoLine models the terminal line the shell echoes a command onto, to
+// recover the command's final text from the shell's redrawing of it.
+type echoLine struct {
+	line   []rune
+	cursor int
+	utf8   []byte
+}
+
+func (l *echoLine) reset() {
+	l.line = l.line[:0]
+	l.cursor = 0
+	l.utf8 = l.utf8[:0]
+}
+
+func (l *echoLine) writeByte(b byte) {
+	if len(l.utf8) > 0 || b >= utf8.RuneSelf {
+		l.utf8 = append(l.utf8, b)
+		if !utf8.FullRune(l.utf8) {
+			return
+		}
+		r, _ := utf8.DecodeRune(l.utf8)
+		l.utf8 = l.utf8[:0]
+		l.put(r)
+		return
+	}
+	switch {
+	case b == '\b':
+		l.move(-1)
+	case b == '\r':
+		// Wrapped lines are redrawn from the start of the line, which still
+		// holds the prompt, so carriage returns are not followed.
+	case b < 0x20 || b == 0x7f:
+	default:
+		l.put(rune(b))
+	}
+}
+
+// put writes r at the cursor, overwriting what was there.
+func (l *echoLine) put(r rune) {
+	if l.cursor < len(l.line) {
+		l.line[l.cursor] = r
+	} else {
+		l.line = append(l.line, r)
+	}
+	l.cursor++
+}
+
+func (l *echoLine) move(n int) {
+	l.cursor = min(max(l.cursor+n, 0), len(l.line))
+}
+
+// csi handles the cursor movement and editing sequences shells redraw with.
+func (l *echoLine) csi(params string, final byte) {
+	n, err := strconv.Atoi(params)
+	if err != nil || n < 1 {
+		n = 1
+	}
+	switch final {
+	case 'C':
+		for i := 0; i < n; i++ {
+			if l.cursor == len(l.line) {
+				l.line = append(l.line, ' ')
+			}
+			l.cursor++
+		}
+	case 'D':
+		l.move(-n)
+	case 'K':
+		if params == "" || params == "0" {
+			l.line = l.line[:l.cursor]
+		}
+	case 'P':
+		end := min(l.cursor+n, len(l.line))
+		l.line = append(l.line[:l.cursor], l.line[end:]...)
+	case '@':
+		blanks := []rune(strings.Repeat(" ", n))
+		l.line = append(l.line[:l.cursor], append(blanks, l.line[l.cursor:]...)...)
+	case 'X':
+		for i := l.cursor; i < min(l.cursor+n, len(l.line)); i++ {
+			l.line[i] = ' '
+		}
+	}
+}
+
+// String returns the echoed command.
+func (l *echoLine) String() string {
+	return strings.TrimSpace(string(l.line))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	testPromptStart = "\x1b]133;A\x07"
+	testPromptEnd   = "\x1b]133;B\x07"
+	testCommandRun  = "\x1b]133;C\x07"
+)
+
+func testCommandDone(code string) string {
+	return "\x1b]133;D;" + code + "\x07"
+}
+
+func TestShellIntegration(t *testing.T) {
+	type command struct {
+		command, cwd string
+		exitCode     int
+		noExitCode   bool
+	}
+	tests := []struct {
+		name     string
+		redactor bool
+		writes   []string
+		want     []command
+	}{{
+		name: "command",
+		writes: []string{
+			"\x1b]7;file://host/home/test\x07" + testPromptStart + "$ " + testPromptEnd + "ls -l\r\n" + testCommandRun,
+			"total 0\r\n" + testCommandDone("0"),
+		},
+		want: []command{{command: "ls -l", cwd: "/home/test"}},
+	}, {
+		name: "exit code",
+		writes: []string{
+			testPromptStart + "$ " + testPromptEnd + "false\r\n" + testCommandRun + testCommandDone("1"),
+		},
+		want: []command{{command: "false", exitCode: 1}},
+	}, {
+		name: "markers split across writes",
+		writes: []string{
+			testPromptStart + "$ \x1b]13", "3;B\x07ec", "ho hi\r\n\x1b", "]133;C\x1b\\" + testCommandDone("0")[:6], testCommandDone("0")[6:],
+		},
+		want: []command{{command: "echo hi"}},
+	}, {
+		name: "redrawn line",
+		writes: []string{
+			// "o" is inserted into "ech x" by moving back and
+			// inserting a blank, then the rest of the line is erased.
+			testPromptStart + "$ " + testPromptEnd + "ech x\x1b[2D\x1b[1@o\x1b[K\r\n" + testCommandRun + testCommandDone("0"),
+		},
+		want: []command{{command: "echo"}},
+	}, {
+		name: "backspace and delete",
+		writes: []string{
+			testPromptStart + "$ " + testPromptEnd + "lss\b\x1b[P -x\b\x1b[1Pa\r\n" + testCommandRun + testCommandDone("0"),
+		},
+		want: []command{{command: "ls -a"}},
+	}, {
+		name: "colours are ignored",
+		writes: []string{
+			testPromptStart + "\x1b[32m$\x1b[0m " + testPromptEnd + "\x1b[1mpwd\x1b[0m\r\n" + testCommandRun + testCommandDone("0"),
+		},
+		want: []command{{command: "pwd"}},
+	}, {
+		name: "utf-8",
+		writes: []string{
+			testPromptStart + testPromptEnd + "echo caf\xc3", "\xa9\r\n" + testCommandRun + testCommandDone("0"),
+		},
+		want: []command{{command: "echo café"}},
+	}, {
+		name:     "redacted",
+		redactor: true,
+		writes: []string{
+			testPromptStart + testPromptEnd + "export DB_PASSWORD=hunter2\r\n" + testCommandRun + testCommandDone("0"),
+		},
+		want: []command{{command: "export DB_PASSWORD=" + redactedMarker}},
+	}, {
+		name: "run without a prompt is ignored",
+		writes: []string{
+			testCommandRun + testCommandDone("0"),
+		},
+	}, {
+		name: "empty prompt is not a command",
+		writes: []string{
+			testPromptStart + "$ " + testPromptEnd + testPromptStart + "$ " + testPromptEnd,
+		},
+	}, {
+		name: "overlong sequence is skipped",
+		writes: []string{
+			"\x1b]133;" + strings.Repeat("x", maxOSCLength) + "\x07" + testPromptStart + testPromptEnd + "id\r\n" + testCommandRun + testCommandDone("0"),
+		},
+		want: []command{{command: "id"}},
+	}, {
+		name: "still running when closed",
+		writes: []string{
+			testPromptStart + testPromptEnd + "sleep 100\r\n" + testCommandRun,
+		},
+		want: []command{{command: "sleep 100", noExitCode: true}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var redactor *Redactor
+			if test.redactor {
+				var err error
+				if redactor, err = NewRedactor(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := newShellIntegration(redactor)
+			var dst bytes.Buffer
+			w := s.writer(&dst)
+			for _, p := range test.writes {
+				if _, err := w.Write([]byte(p)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.close()
+
+			if got, want := dst.String(), strings.Join(test.writes, ""); got != want {
+				t.Errorf("output changed to %q", got)
+			}
+			var got []ShellCommand
+			for c := range s.commands() {
+				got = append(got, c)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got commands %+v, want %+v", got, test.want)
+			}
+			for i, c := range got {
+				want := test.want[i]
+				if c.Command != want.command || c.WorkingDirectory != want.cwd {
+					t.Errorf("command %d = %q in %q, want %q in %q", i, c.Command, c.WorkingDirectory, want.command, want.cwd)
+				}
+				switch {
+				case want.noExitCode && c.ExitCode != nil:
+					t.Errorf("command %d exit code %d, want none", i, *c.ExitCode)
+				case !want.noExitCode && (c.ExitCode == nil || *c.ExitCode != want.exitCode):
+					t.Errorf("command %d exit code %v, want %d", i, c.ExitCode, want.exitCode)
+				}
+			}
+		})
+	}
+}
+
+func TestShellIntegrationNil(t *testing.T) {
+	var s *shellIntegration
+	var dst bytes.Buffer
+	if w := s.writer(&dst); w != &dst {
+		t.Errorf("nil shell integration wrapped its writer")
+	}
+	s.close()
+}
+
+func TestShellIntegrationRunning(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{"no markers", "$ ls\r\n", false},
+		{"at the prompt", testPromptStart + "$ " + testPromptEnd, false},
+		{"running", testPromptStart + "$ " + testPromptEnd + "sudo ls\r\n" + testCommandRun + "[sudo] password: ", true},
+		{"finished", testPromptStart + "$ " + testPromptEnd + "ls\r\n" + testCommandRun + testCommandDone("0"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newShellIntegration(nil)
+			defer s.close()
+			s.writer(io.Discard).Write([]byte(test.output))
+			if got := s.running(); got != test.want {
+				t.Errorf("running() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
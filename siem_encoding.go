@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// EventEncoder encodes events for a sink, such as in a format a SIEM ingests.
+// Encoded events do not end in a newline.
+type EventEncoder interface {
+	Encode(e Event) ([]byte, error)
+}
+
+// JSONEncoder encodes events as JSON, as the sinks do by default.
+var JSONEncoder EventEncoder = jsonEncoder{}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(e Event) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// encodeEvent encodes e with encoder, or as JSON if encoder is nil.
+func encodeEvent(encoder EventEncoder, e Event) ([]byte, error) {
+	if encoder == nil {
+		return json.Marshal(e)
+	}
+	return encoder.Encode(e)
+}
+
+// SIEMProduct identifies the proxy in the headers of CEF and LEEF events.
+type SIEMProduct struct {
+	Vendor  string
+	Product string
+	Version string
+}
+
+// DefaultSIEMProduct is the product CEF and LEEF events are sent as when
+// none is given.
+var DefaultSIEMProduct = SIEMProduct{
+	Vendor:  "ale8k",
+	Product: "ssh-proxy",
+	Version: "1",
+}
+
+// siemField is a key and value of a CEF or LEEF event.
+type siemField struct {
+	key, value string
+}
+
+// siemEvent is the format independent mapping of an event to SIEM fields.
+type siemEvent struct {
+	name     string
+	severity int
+
+	user          string
+	srcHost       string
+	srcPort       string
+	sessionID     string
+	target        string
+	clientVersion string
+
+	// message is the command, input or output the event carries.
+	message          string
+	outcome          string
+	exitCode         string
+	workingDirectory string
+	dstHost          string
+	dstPort          string
+	durationMillis   string
+	// admin is the admin who acted on the session.
+	admin string
+}
+
+// newSIEMEvent maps e to SIEM fields. Severities follow CEF's 0 to 10 scale:
+// commands are more notable than session bookkeeping, and the requests the
+// proxy refuses more notable still.
+func newSIEMEvent(e Event) siemEvent {
+	s := siemEvent{
+		name:          string(e.Type),
+		severity:      3,
+		user:          e.Session.User,
+		sessionID:     e.Session.SessionID,
+		target:        e.Session.Target,
+		clientVersion: e.Session.ClientVersion,
+	}
+	if host, port, err := net.SplitHostPort(e.Session.ClientAddr); err == nil {
+		s.srcHost, s.srcPort = host, port
+	} else {
+		s.srcHost = e.Session.ClientAddr
+	}
+
+	switch data := e.Data.(type) {
+	case ConnectEvent:
+		s.name = "SSH connection opened"
+	case AuthEvent:
+		s.name = "SSH authentication"
+		s.outcome = "failure"
+		if data.Success {
+			s.outcome = "success"
+		}
+	case PtyRequestEvent:
+		s.name = "PTY requested"
+	case WindowChangeEvent:
+		s.name = "Window changed"
+		s.severity = 1
+	case ShellEvent:
+		s.name = "Shell started"
+	case ExecEvent:
+		s.name = "Command executed"
+		s.severity = 5
+		s.message = strings.Join(data.Command, " ")
+	case SubsystemEvent:
+		s.name = "Subsystem requested"
+		s.severity = 6
+		s.message = data.Name
+		s.outcome = siemOutcome(data.Accepted)
+	case PortForwardEvent:
+		s.name = "Port forwarding requested"
+		s.severity = 6
+		s.message = data.Direction
+		s.outcome = siemOutcome(data.Accepted)
+		s.dstHost = data.Host
+		s.dstPort = strconv.FormatUint(uint64(data.Port), 10)
+	case InputEvent:
+		s.name = "Input"
+		s.severity = 1
+		s.message = data.Data
+	case CommandEvent:
+		s.name = "Command entered"
+		s.severity = 5
+		s.message = data.Command
+	case OutputEvent:
+		s.name = "Output"
+		s.severity = 1
+		s.message = data.Data
+	case ShellCommandEvent:
+		s.name = "Shell command"
+		s.severity = 5
+		s.message = data.Command
+		s.workingDirectory = data.WorkingDirectory
+		if data.ExitCode != nil {
+			s.exitCode = strconv.Itoa(*data.ExitCode)
+		}
+		s.durationMillis = strconv.FormatInt(data.Duration.Milliseconds(), 10)
+	case ExitStatusEvent:
+		s.name = "Session exited"
+		s.exitCode = strconv.Itoa(data.ExitCode)
+		s.message = data.Signal
+	case DisconnectEvent:
+		s.name = "SSH connection closed"
+		s.durationMillis = strconv.FormatInt(data.Duration.Milliseconds(), 10)
+	case TerminateEvent:
+		s.name = "Session terminated by admin"
+		s.severity = 7
+		s.message = data.Reason
+		s.admin = data.Admin
+	case ShadowEvent:
+		s.severity = 5
+		switch data.Action {
+		case ShadowAttach:
+			s.name = "Session shadowed by admin"
+		case ShadowDetach:
+			s.name = "Session shadowing stopped"
+		case ShadowTakeControl:
+			s.name = "Session taken over by admin"
+			s.severity = 7
+		case ShadowReleaseControl:
+			s.name = "Session control released by admin"
+		}
+		s.message = data.Reason
+		s.admin = data.Admin
+	case AdminInputEvent:
+		s.name = "Admin input"
+		s.severity = 5
+		s.message = data.Data
+		s.admin = data.Admin
+	case PauseEvent:
+		s.name = "Session paused by admin"
+		s.severity = 7
+		s.message = data.Reason
+		s.admin = data.Admin
+	case ResumeEvent:
+		s.name = "Session resumed by admin"
+		s.severity = 5
+		s.message = data.Reason
+		s.admin = data.Admin
+	case CommandPolicyEvent:
+		s.name = "Command policy decision"
+		s.severity = 3
+		switch data.Action {
+		case PolicyDeny:
+			s.severity = 7
+		case PolicyApprove:
+			s.severity = 5
+		}
+		s.message = data.Command
+		s.outcome = string(data.Action)
+		s.admin = data.Admin
+	case CheckpointEvent:
+		s.name = "Audit checkpoint"
+		s.severity = 1
+		s.message = data.Signature
+	}
+	return s
+}
+
+func siemOutcome(accepted bool) string {
+	if accepted {
+		return "accepted"
+	}
+	return "refused"
+}
+
+// NewCEFEncoder returns an EventEncoder encoding events in ArcSight's Common
+// Event Format.
+func NewCEFEncoder(product SIEMProduct) EventEncoder {
+	return cefEncoder{product: product}
+}
+
+type cefEncoder struct {
+	product SIEMProduct
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+func (c cefEncoder) Encode(e Event) ([]byte, error) {
+	s := newSIEMEvent(e)
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeaderEscaper.Replace(c.product.Vendor),
+		cefHeaderEscaper.Replace(c.product.Product),
+		cefHeaderEscaper.Replace(c.product.Version),
+		cefHeaderEscaper.Replace(string(e.Type)),
+		cefHeaderEscaper.Replace(s.name),
+		s.severity,
+	)
+
+	fields := []siemField{
+		{"rt", strconv.FormatInt(e.Time.UnixMilli(), 10)},
+		{"suser", s.user},
+		{"src", s.srcHost},
+		{"spt", s.srcPort},
+		{"externalId", s.sessionID},
+		{"cs1Label", "Target"},
+		{"cs1", s.target},
+		{"cs2Label", "ClientVersion"},
+		{"cs2", s.clientVersion},
+		{"cn1Label", "Sequence"},
+		{"cn1", strconv.FormatUint(e.Sequence, 10)},
+		{"msg", s.message},
+		{"outcome", s.outcome},
+		{"dhost", s.dstHost},
+		{"dpt", s.dstPort},
+		{"cs3Label", "WorkingDirectory"},
+		{"cs3", s.workingDirectory},
+		{"cn2Label", "ExitCode"},
+		{"cn2", s.exitCode},
+		{"cn3Label", "DurationMillis"},
+		{"cn3", s.durationMillis},
+		{"cs4Label", "Admin"},
+		{"cs4", s.admin},
+	}
+	first := true
+	for i, f := range fields {
+		if f.value == "" || strings.HasSuffix(f.key, "Label") && fields[i+1].value == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		b.WriteString(cefExtensionEscaper.Replace(f.value))
+	}
+	return []byte(b.String()), nil
+}
+
+// NewLEEFEncoder returns an EventEncoder encoding events in QRadar's Log Event
+// Extended Format, version 2.0, with tab delimited attributes.
+func NewLEEFEncoder(product SIEMProduct) EventEncoder {
+	return leefEncoder{product: product}
+}
+
+type leefEncoder struct {
+	product SIEMProduct
+}
+
+var (
+	leefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ", "\t", " ")
+	leefAttributeEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\r", `\r`, "\n", `\n`)
+)
+
+func (l leefEncoder) Encode(e Event) ([]byte, error) {
+	s := newSIEMEvent(e)
+	var b strings.Builder
+	// x09 declares the tab attribute delimiter.
+	fmt.Fprintf(&b, "LEEF:2.0|%s|%s|%s|%s|x09|",
+		leefHeaderEscaper.Replace(l.product.Vendor),
+		leefHeaderEscaper.Replace(l.product.Product),
+		leefHeaderEscaper.Replace(l.product.Version),
+		leefHeaderEscaper.Replace(string(e.Type)),
+	)
+
+	fields := []siemField{
+		{"devTime", strconv.FormatInt(e.Time.UnixMilli(), 10)},
+		{"cat", s.name},
+		{"sev", strconv.Itoa(s.severity)},
+		{"usrName", s.user},
+		{"src", s.srcHost},
+		{"srcPort", s.srcPort},
+		{"sessionId", s.sessionID},
+		{"target", s.target},
+		{"clientVersion", s.clientVersion},
+		{"seq", strconv.FormatUint(e.Sequence, 10)},
+		{"msg", s.message},
+		{"outcome", s.outcome},
+		{"dst", s.dstHost},
+		{"dstPort", s.dstPort},
+		{"workingDirectory", s.workingDirectory},
+		{"exitCode", s.exitCode},
+		{"durationMillis", s.durationMillis},
+		{"admin", s.admin},
+	}
+	first := true
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte('\t')
+		}
+		first = false
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		b.WriteString(leefAttributeEscaper.Replace(f.value))
+	}
+	return []byte(b.String()), nil
+}
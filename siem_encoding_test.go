@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// siemTestEvent returns a command event, at Unix millisecond 1714564800000,
+// by a session with the given user and target.
+func siemTestEvent(user, target, command string) Event {
+	return Event{
+		Version:  EventVersion,
+		Sequence: 7,
+		Type:     EventCommand,
+		Time:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Session: SessionDetails{
+			SessionID:  "abc",
+			User:       user,
+			ClientAddr: "10.0.0.1:5000",
+			Target:     target,
+		},
+		Data: CommandEvent{Command: command},
+	}
+}
+
+func TestCEFEncoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		product SIEMProduct
+		event   Event
+		want    string
+	}{{
+		name:    "plain",
+		product: DefaultSIEMProduct,
+		event:   siemTestEvent("alice", "db:22", "ls -la"),
+		want: "CEF:0|ale8k|ssh-proxy|1|command|Command entered|5|rt=1714564800000 suser=alice src=10.0.0.1 spt=5000 externalId=abc " +
+			"cs1Label=Target cs1=db:22 cn1Label=Sequence cn1=7 msg=ls -la",
+	}, {
+		name:    "header escaping",
+		product: SIEMProduct{Vendor: `a|b\c`, Product: "ssh\nproxy", Version: "1\r2"},
+		event:   siemTestEvent("alice", "", "ls"),
+		want:    `CEF:0|a\|b\\c|ssh proxy|1 2|command|Command entered|5|rt=1714564800000 suser=alice src=10.0.0.1 spt=5000 externalId=abc cn1Label=Sequence cn1=7 msg=ls`,
+	}, {
+		name:    "extension escaping",
+		product: DefaultSIEMProduct,
+		event:   siemTestEvent("al=ice", "db|1:22", "echo a=b\\c |\r\nrm"),
+		want: `CEF:0|ale8k|ssh-proxy|1|command|Command entered|5|rt=1714564800000 suser=al\=ice src=10.0.0.1 spt=5000 externalId=abc ` +
+			`cs1Label=Target cs1=db|1:22 cn1Label=Sequence cn1=7 msg=echo a\=b\\c |\r\nrm`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NewCEFEncoder(test.product).Encode(test.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Encode() =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLEEFEncoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		product SIEMProduct
+		event   Event
+		want    string
+	}{{
+		name:    "plain",
+		product: DefaultSIEMProduct,
+		event:   siemTestEvent("alice", "db:22", "ls -la"),
+		want: "LEEF:2.0|ale8k|ssh-proxy|1|command|x09|devTime=1714564800000\tcat=Command entered\tsev=5\tusrName=alice\t" +
+			"src=10.0.0.1\tsrcPort=5000\tsessionId=abc\ttarget=db:22\tseq=7\tmsg=ls -la",
+	}, {
+		name:    "header escaping",
+		product: SIEMProduct{Vendor: `a|b\c`, Product: "ssh\tproxy", Version: "1\n2"},
+		event:   siemTestEvent("alice", "", "ls"),
+		want: `LEEF:2.0|a\|b\\c|ssh proxy|1 2|command|x09|devTime=1714564800000` + "\tcat=Command entered\tsev=5\tusrName=alice\t" +
+			"src=10.0.0.1\tsrcPort=5000\tsessionId=abc\tseq=7\tmsg=ls",
+	}, {
+		name:    "attribute escaping",
+		product: DefaultSIEMProduct,
+		event:   siemTestEvent("al=ice", "db|1:22", "echo\ta=b\\c\r\nrm"),
+		want: "LEEF:2.0|ale8k|ssh-proxy|1|command|x09|devTime=1714564800000\tcat=Command entered\tsev=5\tusrName=al=ice\t" +
+			`src=10.0.0.1` + "\t" + `srcPort=5000` + "\t" + `sessionId=abc` + "\t" + `target=db|1:22` + "\t" + `seq=7` + "\t" + `msg=echo\ta=b\\c\r\nrm`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NewLEEFEncoder(test.product).Encode(test.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Encode() =\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewSIEMEvent(t *testing.T) {
+	exitCode := 1
+	tests := []struct {
+		name         string
+		data         EventData
+		clientAddr   string
+		wantName     string
+		wantSeverity int
+		wantOutcome  string
+		wantSrcHost  string
+	}{
+		{name: "connect", data: ConnectEvent{}, clientAddr: "[::1]:22", wantName: "SSH connection opened", wantSeverity: 3, wantSrcHost: "::1"},
+		{name: "unparsed address", data: ConnectEvent{}, clientAddr: "pipe", wantName: "SSH connection opened", wantSeverity: 3, wantSrcHost: "pipe"},
+		{name: "failed auth", data: AuthEvent{}, wantName: "SSH authentication", wantSeverity: 3, wantOutcome: "failure"},
+		{name: "refused port forward", data: PortForwardEvent{}, wantName: "Port forwarding requested", wantSeverity: 6, wantOutcome: "refused"},
+		{name: "shell command", data: ShellCommandEvent{Command: "false", ExitCode: &exitCode}, wantName: "Shell command", wantSeverity: 5},
+		{name: "denied command", data: CommandPolicyEvent{Action: PolicyDeny}, wantName: "Command policy decision", wantSeverity: 7, wantOutcome: string(PolicyDeny)},
+		{name: "take control", data: ShadowEvent{Action: ShadowTakeControl}, wantName: "Session taken over by admin", wantSeverity: 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSIEMEvent(Event{Session: SessionDetails{ClientAddr: test.clientAddr}, Data: test.data})
+			if s.name != test.wantName || s.severity != test.wantSeverity || s.outcome != test.wantOutcome {
+				t.Errorf("newSIEMEvent() = %q severity %d outcome %q, want %q severity %d outcome %q",
+					s.name, s.severity, s.outcome, test.wantName, test.wantSeverity, test.wantOutcome)
+			}
+			if test.clientAddr != "" && s.srcHost != test.wantSrcHost {
+				t.Errorf("srcHost = %q, want %q", s.srcHost, test.wantSrcHost)
+			}
+		})
+	}
+}
+
+func TestEncodedEventsAreSingleLines(t *testing.T) {
+	e := siemTestEvent("alice\n", "db\r\n", "a\nb\rc")
+	for name, encoder := range map[string]EventEncoder{
+		"cef":  NewCEFEncoder(SIEMProduct{Vendor: "a\nb"}),
+		"leef": NewLEEFEncoder(SIEMProduct{Vendor: "a\nb"}),
+		"json": JSONEncoder,
+	} {
+		got, err := encoder.Encode(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.ContainsAny(string(got), "\r\n") {
+			t.Errorf("%s event %q spans lines", name, got)
+		}
+	}
+}
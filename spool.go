@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// ErrSpoolFull is returned by a fail-closed Spool's AdmitSession while it is full.
+var ErrSpoolFull = errors.New("audit spool is full")
+
+// SpoolConfig configures a Spool.
+type SpoolConfig struct {
+	// Dir is the directory the spool's segments and read position are kept in.
+	Dir string
+
+	// MaxBytes caps the size of the undelivered events on disk, beyond which
+	// new events are dropped. 0 leaves the spool unbounded.
+	MaxBytes int64
+
+	// SegmentSize is the size events are split into files at, so delivered
+	// events can be deleted. It is capped at half of MaxBytes.
+	SegmentSize int64
+
+	// FailClosed refuses new sessions while the spool is full, rather than
+	// let them run without being audited.
+	FailClosed bool
+
+	// BatchSize is the most events handed to the sink at once.
+	BatchSize int
+
+	// RetryInterval is how long delivery waits after failing before trying
+	// again, doubling with each failure up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+}
+
+// DefaultSpoolConfig returns the spool configuration used when nothing else is
+// configured, spooling to dir.
+func DefaultSpoolConfig(dir string) SpoolConfig {
+	return SpoolConfig{
+		Dir:              dir,
+		MaxBytes:         1 << 30,
+		SegmentSize:      16 << 20,
+		BatchSize:        100,
+		RetryInterval:    time.Second,
+		MaxRetryInterval: time.Minute,
+	}
+}
+
+// spoolPosition is a position within the spool's segments.
+type spoolPosition struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// Spool is an EventSink writing events ahead to disk before they are
+// delivered to another sink, so they survive the sink being unavailable and
+// the proxy restarting. Events are delivered at least once and in order: the
+// spool's read position is only advanced once the sink has taken them, and
+// delivery resumes from it after a restart.
+//
+// Sinks implementing EventDeliverer have failed deliveries retried, other
+// sinks are considered to have taken an event once HandleEvent returns.
+type Spool struct {
+	cfg  SpoolConfig
+	sink EventSink
+	done chan struct{}
+	stop chan struct{}
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	writeSeg  uint64
+	writeFile *os.File
+	writeSize int64
+	// size is the size of every segment on disk.
+	size    int64
+	readPos spoolPosition
+	full    bool
+	closed  bool
+}
+
+// NewSpool returns a Spool delivering to sink, which resumes delivering any
+// events left in cfg.Dir by a previous Spool.
+func NewSpool(cfg SpoolConfig, sink EventSink) (*Spool, error) {
+	if cfg.BatchSize < 1 {
+		return nil, fmt.Errorf("spool batch size must be at least 1")
+	}
+	if cfg.MaxBytes > 0 && (cfg.SegmentSize <= 0 || cfg.SegmentSize > cfg.MaxBytes/2) {
+		// Keeping a segment within half the spool guarantees the spool only
+		// fills while whole segments wait to be delivered and deleted.
+		cfg.SegmentSize = cfg.MaxBytes / 2
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	s := &Spool{
+		cfg:  cfg,
+		sink: sink,
+		done: make(chan struct{}),
+		stop: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *Spool) segmentPath(segment uint64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d.jsonl", segment))
+}
+
+func (s *Spool) positionPath() string {
+	return filepath.Join(s.cfg.Dir, "position.json")
+}
+
+// recover restores the spool's segments and read position from disk.
+func (s *Spool) recover() error {
+	if b, err := os.ReadFile(s.positionPath()); err == nil {
+		if err := json.Unmarshal(b, &s.readPos); err != nil {
+			return fmt.Errorf("invalid spool position: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read spool position: %w", err)
+	}
+
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to list spool: %w", err)
+	}
+	var segments []uint64
+	for _, entry := range entries {
+		segment, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".jsonl"), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), ".jsonl") {
+			continue
+		}
+		if segment < s.readPos.Segment {
+			// Delivered, but not deleted before the proxy stopped.
+			os.Remove(s.segmentPath(segment))
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	if len(segments) == 0 {
+		s.readPos = spoolPosition{Segment: max(s.readPos.Segment, 1)}
+		s.writeSeg = s.readPos.Segment
+	} else {
+		if segments[0] > s.readPos.Segment {
+			s.readPos = spoolPosition{Segment: segments[0]}
+		}
+		s.writeSeg = segments[len(segments)-1]
+	}
+	for _, segment := range segments {
+		info, err := os.Stat(s.segmentPath(segment))
+		if err != nil {
+			return fmt.Errorf("failed to stat spool segment: %w", err)
+		}
+		s.size += info.Size()
+	}
+	return s.openSegment()
+}
+
+// openSegment opens the segment being written for appending, discarding any
+// event left half written by a crash.
+func (s *Spool) openSegment() error {
+	f, err := os.OpenFile(s.segmentPath(s.writeSeg), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to read spool segment: %w", err)
+	}
+	complete := int64(bytes.LastIndexByte(b, '\n') + 1)
+	if complete < int64(len(b)) {
+		if err := f.Truncate(complete); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to truncate spool segment: %w", err)
+		}
+		s.size -= int64(len(b)) - complete
+	}
+	if _, err := f.Seek(complete, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to seek spool segment: %w", err)
+	}
+	s.writeFile = f
+	s.writeSize = complete
+	return nil
+}
+
+// HandleEvent implements EventSink, writing e to disk before returning.
+func (s *Spool) HandleEvent(e Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		zapctx.Error(context.TODO(), "failed to encode audit event", zap.Error(err))
+		return
+	}
+	line = append(line, '\n')
+	n := int64(len(line))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if s.cfg.MaxBytes > 0 && s.size+n > s.cfg.MaxBytes {
+		if !s.full {
+			zapctx.Error(context.TODO(), "audit spool is full, dropping events", zap.String("dir", s.cfg.Dir))
+		}
+		s.full = true
+		return
+	}
+	if s.cfg.SegmentSize > 0 && s.writeSize > 0 && s.writeSize+n > s.cfg.SegmentSize {
+		if err := s.rotate(); err != nil {
+			zapctx.Error(context.TODO(), "failed to rotate audit spool", zap.Error(err))
+			return
+		}
+	}
+
+	written, err := s.writeFile.Write(line)
+	if err == nil {
+		err = s.writeFile.Sync()
+	}
+	if err != nil {
+		zapctx.Error(context.TODO(), "failed to write audit spool", zap.Error(err))
+		if written > 0 {
+			// Drop the partial event, so the segment stays readable.
+			s.writeFile.Truncate(s.writeSize)
+			s.writeFile.Seek(s.writeSize, io.SeekStart)
+		}
+		return
+	}
+	s.writeSize += n
+	s.size += n
+	s.cond.Broadcast()
+}
+
+// rotate starts writing a new segment.
+func (s *Spool) rotate() error {
+	if err := s.writeFile.Close(); err != nil {
+		return err
+	}
+	s.writeSeg++
+	return s.openSegment()
+}
+
+// AdmitSession implements SessionAdmitter, refusing sessions while a
+// fail-closed spool is full.
+func (s *Spool) AdmitSession() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg.FailClosed && s.full {
+		return ErrSpoolFull
+	}
+	return nil
+}
+
+// Unwrap implements SinkWrapper, returning the sink events are delivered to.
+func (s *Spool) Unwrap() EventSink {
+	return s.sink
+}
+
+// run delivers spooled events to the sink until the spool is closed.
+func (s *Spool) run() {
+	defer close(s.done)
+	backoff := s.cfg.RetryInterval
+	for {
+		s.mu.Lock()
+		for !s.closed && s.readPos == (spoolPosition{s.writeSeg, s.writeSize}) {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		pos, current, limit := s.readPos, s.readPos.Segment == s.writeSeg, s.writeSize
+		s.mu.Unlock()
+
+		if !current {
+			info, err := os.Stat(s.segmentPath(pos.Segment))
+			if err != nil || pos.Offset >= info.Size() {
+				s.advance(pos.Segment)
+				continue
+			}
+			limit = info.Size()
+		}
+
+		events, end, err := s.read(pos, limit)
+		if err == nil {
+			err = s.deliver(events)
+		}
+		if err != nil {
+			zapctx.Error(context.TODO(), "failed to deliver spooled audit events", zap.Error(err))
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, s.cfg.MaxRetryInterval)
+			continue
+		}
+		backoff = s.cfg.RetryInterval
+		s.commit(spoolPosition{Segment: pos.Segment, Offset: end})
+	}
+}
+
+// read reads up to BatchSize events from pos, reading no further than limit.
+// Events that cannot be decoded are skipped.
+func (s *Spool) read(pos spoolPosition, limit int64) ([]Event, int64, error) {
+	f, err := os.Open(s.segmentPath(pos.Segment))
+	if err != nil {
+		return nil, pos.Offset, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(io.NewSectionReader(f, pos.Offset, limit-pos.Offset))
+	end := pos.Offset
+	var events []Event
+	for len(events) < s.cfg.BatchSize {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// Only whole events are written within the limit.
+			break
+		}
+		end += int64(len(line))
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			zapctx.Error(context.TODO(), "skipping invalid spooled audit event", zap.Error(err))
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, end, nil
+}
+
+// deliver hands events to the sink.
+func (s *Spool) deliver(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if deliverer, ok := s.sink.(EventDeliverer); ok {
+		return deliverer.DeliverEvents(events)
+	}
+	for _, e := range events {
+		s.sink.HandleEvent(e)
+	}
+	return nil
+}
+
+// commit records that events up to pos have been delivered.
+func (s *Spool) commit(pos spoolPosition) {
+	s.mu.Lock()
+	s.readPos = pos
+	s.mu.Unlock()
+	s.savePosition(pos)
+}
+
+// advance deletes a delivered segment and moves on to the next one.
+func (s *Spool) advance(segment uint64) {
+	pos := spoolPosition{Segment: segment + 1}
+	s.savePosition(pos)
+
+	var size int64
+	if info, err := os.Stat(s.segmentPath(segment)); err == nil {
+		size = info.Size()
+	}
+	if err := os.Remove(s.segmentPath(segment)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		zapctx.Error(context.TODO(), "failed to delete audit spool segment", zap.Error(err))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readPos = pos
+	s.size -= size
+	if s.full && (s.cfg.MaxBytes <= 0 || s.size < s.cfg.MaxBytes) {
+		zapctx.Info(context.TODO(), "audit spool has space again", zap.String("dir", s.cfg.Dir))
+		s.full = false
+	}
+}
+
+// savePosition atomically writes the read position to disk.
+func (s *Spool) savePosition(pos spoolPosition) {
+	b, _ := json.Marshal(pos)
+	tmp := s.positionPath() + ".tmp"
+	err := os.WriteFile(tmp, b, 0o600)
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.positionPath())
+	}
+	if err != nil {
+		zapctx.Error(context.TODO(), "failed to save audit spool position", zap.Error(err))
+	}
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Close stops delivering events, leaving any not yet delivered on disk to be
+// delivered by the next Spool. Events handled after Close are dropped.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		<-s.done
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeFile.Close()
+}
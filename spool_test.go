@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDeliverer is an EventDeliverer failing its next failures deliveries,
+// and every delivery while it is stuck.
+type testDeliverer struct {
+	mu       sync.Mutex
+	failures int
+	stuck    bool
+	batches  [][]uint64
+}
+
+func (d *testDeliverer) HandleEvent(e Event) {
+	d.DeliverEvents([]Event{e})
+}
+
+func (d *testDeliverer) DeliverEvents(events []Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stuck {
+		return errors.New("stuck")
+	}
+	if d.failures > 0 {
+		d.failures--
+		return errors.New("failed")
+	}
+	seqs := make([]uint64, len(events))
+	for i, e := range events {
+		seqs[i] = e.Sequence
+	}
+	d.batches = append(d.batches, seqs)
+	return nil
+}
+
+func (d *testDeliverer) setStuck(stuck bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stuck = stuck
+}
+
+// delivered returns the sequences of the events delivered, in order.
+func (d *testDeliverer) delivered() []uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var seqs []uint64
+	for _, batch := range d.batches {
+		seqs = append(seqs, batch...)
+	}
+	return seqs
+}
+
+// testSpoolConfig returns a configuration spooling to dir, retrying quickly.
+func testSpoolConfig(dir string) SpoolConfig {
+	cfg := DefaultSpoolConfig(dir)
+	cfg.RetryInterval = time.Millisecond
+	cfg.MaxRetryInterval = 10 * time.Millisecond
+	return cfg
+}
+
+// spoolSegments returns the segment files in dir.
+func spoolSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	segments, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+// eventLineSize returns the size of testEvent as a spooled line.
+func eventLineSize(t *testing.T) int64 {
+	t.Helper()
+	b, err := json.Marshal(testEvent(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(b)) + 1
+}
+
+func checkSequences(t *testing.T, got []uint64, from, to uint64) {
+	t.Helper()
+	if len(got) != int(to-from+1) {
+		t.Fatalf("delivered %v, want events %d to %d", got, from, to)
+	}
+	for i, seq := range got {
+		if seq != from+uint64(i) {
+			t.Fatalf("delivered %v, want events %d to %d in order", got, from, to)
+		}
+	}
+}
+
+func TestSpoolDelivery(t *testing.T) {
+	tests := []struct {
+		name        string
+		batchSize   int
+		segmentSize int64
+		events      int
+		failures    int
+	}{
+		{name: "single events", batchSize: 1, events: 5},
+		{name: "batches", batchSize: 4, events: 10},
+		{name: "retried after failures", batchSize: 3, events: 6, failures: 3},
+		{name: "across segments", batchSize: 2, segmentSize: 3, events: 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := testSpoolConfig(dir)
+			cfg.BatchSize = test.batchSize
+			if test.segmentSize > 0 {
+				cfg.SegmentSize = test.segmentSize * eventLineSize(t)
+			}
+			sink := &testDeliverer{failures: test.failures}
+			spool, err := NewSpool(cfg, sink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer spool.Close()
+
+			for i := 1; i <= test.events; i++ {
+				spool.HandleEvent(testEvent(uint64(i)))
+			}
+			waitFor(t, func() bool { return len(sink.delivered()) == test.events })
+			checkSequences(t, sink.delivered(), 1, uint64(test.events))
+			sink.mu.Lock()
+			for _, batch := range sink.batches {
+				if len(batch) > test.batchSize {
+					t.Errorf("delivered a batch of %d events, want at most %d", len(batch), test.batchSize)
+				}
+			}
+			sink.mu.Unlock()
+			// Only the segment being written is left once all are delivered.
+			waitFor(t, func() bool { return len(spoolSegments(t, dir)) == 1 })
+		})
+	}
+}
+
+func TestSpoolHandleEventSink(t *testing.T) {
+	sink := &testSink{}
+	spool, err := NewSpool(testSpoolConfig(t.TempDir()), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	spool.HandleEvent(testEvent(1))
+	spool.HandleEvent(testEvent(2))
+	waitFor(t, func() bool { return len(sink.types()) == 2 })
+}
+
+func TestSpoolRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testSpoolConfig(dir)
+	cfg.SegmentSize = 2 * eventLineSize(t)
+
+	// The first spool delivers some events before its sink gets stuck.
+	sink := &testDeliverer{}
+	spool, err := NewSpool(cfg, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		spool.HandleEvent(testEvent(uint64(i)))
+	}
+	waitFor(t, func() bool { return len(sink.delivered()) == 3 })
+	sink.setStuck(true)
+	for i := 4; i <= 7; i++ {
+		spool.HandleEvent(testEvent(uint64(i)))
+	}
+	spool.Close()
+
+	// A torn write left by a crash is discarded.
+	segments := spoolSegments(t, dir)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"version":1,"seq":`)
+	f.Close()
+
+	sink = &testDeliverer{}
+	spool, err = NewSpool(cfg, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	spool.HandleEvent(testEvent(8))
+	waitFor(t, func() bool { return len(sink.delivered()) == 5 })
+	checkSequences(t, sink.delivered(), 4, 8)
+}
+
+func TestSpoolFull(t *testing.T) {
+	tests := []struct {
+		name       string
+		failClosed bool
+		wantErr    error
+	}{
+		{name: "fail open", failClosed: false, wantErr: nil},
+		{name: "fail closed", failClosed: true, wantErr: ErrSpoolFull},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testSpoolConfig(t.TempDir())
+			cfg.MaxBytes = 4 * eventLineSize(t)
+			cfg.FailClosed = test.failClosed
+			sink := &testDeliverer{stuck: true}
+			spool, err := NewSpool(cfg, sink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer spool.Close()
+
+			// Four events fill the spool, the fifth is dropped.
+			for i := 1; i <= 5; i++ {
+				spool.HandleEvent(testEvent(uint64(i)))
+			}
+			if err := spool.AdmitSession(); err != test.wantErr {
+				t.Errorf("AdmitSession() = %v, want %v", err, test.wantErr)
+			}
+
+			// Delivering the first segment makes room again.
+			sink.setStuck(false)
+			waitFor(t, func() bool { return spool.AdmitSession() == nil })
+			waitFor(t, func() bool { return len(sink.delivered()) == 4 })
+			checkSequences(t, sink.delivered(), 1, 4)
+
+			spool.HandleEvent(testEvent(6))
+			waitFor(t, func() bool { return len(sink.delivered()) == 5 })
+			if got := sink.delivered()[4]; got != 6 {
+				t.Errorf("delivered event %d after making room, want 6", got)
+			}
+		})
+	}
+}
+
+func TestSpoolClosed(t *testing.T) {
+	sink := &testDeliverer{}
+	spool, err := NewSpool(testSpoolConfig(t.TempDir()), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	spool.HandleEvent(testEvent(1))
+	if err := spool.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+	if got := sink.delivered(); len(got) != 0 {
+		t.Errorf("delivered %v after Close", got)
+	}
+}
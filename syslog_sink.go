@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// SyslogSinkConfig configures a SyslogSink.
+type SyslogSinkConfig struct {
+	// Network is how the collector is reached: "udp", "tcp", "tls", "unix"
+	// for a stream unix socket or "unixgram" for a datagram one, such as /dev/log.
+	Network string
+
+	// Address is the collector's address, or the path of its unix socket.
+	Address string
+
+	// TLSConfig configures the connection when Network is "tls".
+	TLSConfig *tls.Config
+
+	// Facility is the syslog facility messages are sent with.
+	Facility int
+
+	// Hostname and AppName identify the proxy in each message, Hostname
+	// defaults to the machine's hostname.
+	Hostname string
+	AppName  string
+
+	// EnterpriseID is the private enterprise number the structured data
+	// elements are named with, such as session@32473.
+	EnterpriseID string
+
+	// BufferSize is the number of messages held while the collector cannot be
+	// reached, beyond which the oldest are dropped. It must be at least 1.
+	BufferSize int
+
+	// WriteTimeout bounds each write to the collector, after which the
+	// connection is taken as failed and reconnected.
+	WriteTimeout time.Duration
+
+	// Encoder, when set, encodes each event as the message's MSG part, such
+	// as in CEF or LEEF, in place of the structured data.
+	Encoder EventEncoder
+
+	// ReconnectInterval is the delay before the first reconnection attempt,
+	// it doubles with each failed attempt up to MaxReconnectInterval. It must
+	// be positive, and MaxReconnectInterval no less.
+	ReconnectInterval    time.Duration
+	MaxReconnectInterval time.Duration
+}
+
+// DefaultSyslogSinkConfig returns the syslog sink configuration used when
+// nothing else is configured, sending to the collector at address over network.
+func DefaultSyslogSinkConfig(network, address string) SyslogSinkConfig {
+	return SyslogSinkConfig{
+		Network: network,
+		Address: address,
+		// Facility 13 is "log audit".
+		Facility: 13,
+		AppName:  "ssh-proxy",
+		// 32473 is reserved for documentation by RFC 5612, replace it with
+		// your organisation's own.
+		EnterpriseID:         "32473",
+		BufferSize:           10000,
+		WriteTimeout:         10 * time.Second,
+		ReconnectInterval:    time.Second,
+		MaxReconnectInterval: 30 * time.Second,
+	}
+}
+
+// syslogSeverityInfo is the severity of every audit message, "informational".
+const syslogSeverityInfo = 6
+
+// SyslogSink is an EventSink sending each event as an RFC 5424 syslog message,
+// with the event's session details and data carried as structured data.
+// Messages are sent by a single goroutine, which reconnects to the collector
+// should it restart, buffering messages meanwhile.
+type SyslogSink struct {
+	cfg    SyslogSinkConfig
+	procID string
+	done   chan struct{}
+	stop   chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending [][]byte
+	// head counts the messages sent or dropped, the index of pending[0].
+	head    uint64
+	dropped int
+	closed  bool
+
+	// health is the sink's delivery counts and last error. It is unhealthy
+	// from a failed send until it has reconnected and sent a message.
+	health SinkHealth
+}
+
+// NewSyslogSink returns a SyslogSink sending to the configured collector. The
+// collector does not have to be reachable yet.
+func NewSyslogSink(cfg SyslogSinkConfig) (*SyslogSink, error) {
+	switch cfg.Network {
+	case "udp", "tcp", "tls", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", cfg.Network)
+	}
+	if cfg.BufferSize < 1 {
+		return nil, fmt.Errorf("syslog buffer size %d is less than 1", cfg.BufferSize)
+	}
+	if cfg.WriteTimeout <= 0 {
+		return nil, fmt.Errorf("syslog write timeout %v is not positive", cfg.WriteTimeout)
+	}
+	if cfg.ReconnectInterval <= 0 || cfg.MaxReconnectInterval < cfg.ReconnectInterval {
+		return nil, fmt.Errorf("syslog reconnect intervals %v and %v must be positive and in order",
+			cfg.ReconnectInterval, cfg.MaxReconnectInterval)
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+	s := &SyslogSink{
+		cfg:    cfg,
+		procID: strconv.Itoa(os.Getpid()),
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		health: SinkHealth{Name: "syslog", Healthy: true},
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s, nil
+}
+
+// HandleEvent implements EventSink.
+func (s *SyslogSink) HandleEvent(e Event) {
+	msg, err := s.format(e)
+	if err != nil {
+		zapctx.Error(context.TODO(), "failed to format syslog message", zap.Error(err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if len(s.pending) >= s.cfg.BufferSize {
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.head++
+		s.dropped++
+		s.health.Dropped++
+	}
+	s.pending = append(s.pending, msg)
+	s.cond.Broadcast()
+}
+
+// format formats e as an RFC 5424 message.
+func (s *SyslogSink) format(e Event) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ",
+		s.cfg.Facility*8+syslogSeverityInfo,
+		e.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(s.cfg.Hostname, 255),
+		syslogHeaderField(s.cfg.AppName, 48),
+		syslogHeaderField(s.procID, 128),
+		syslogHeaderField(string(e.Type), 32),
+	)
+	if s.cfg.Encoder != nil {
+		msg, err := s.cfg.Encoder.Encode(e)
+		if err != nil {
+			return nil, err
+		}
+		// No structured data, followed by the encoded event.
+		b.WriteString("- ")
+		b.Write(msg)
+		return []byte(b.String()), nil
+	}
+
+	data, err := syslogParams(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	command, _ := json.Marshal(e.Session.ShellCommand)
+	environ, _ := json.Marshal(e.Session.Environ)
+	s.element(&b, "event", [][2]string{
+		{"version", strconv.Itoa(e.Version)},
+		{"seq", strconv.FormatUint(e.Sequence, 10)},
+	})
+	s.element(&b, "session", [][2]string{
+		{"session_id", e.Session.SessionID},
+		{"user", e.Session.User},
+		{"client_addr", e.Session.ClientAddr},
+		{"client_version", e.Session.ClientVersion},
+		{"target", e.Session.Target},
+		{"shell_command", string(command)},
+		{"environ", string(environ)},
+	})
+	s.element(&b, "data", data)
+	return []byte(b.String()), nil
+}
+
+// element writes a structured data element named id@EnterpriseID.
+func (s *SyslogSink) element(b *strings.Builder, id string, params [][2]string) {
+	fmt.Fprintf(b, "[%s@%s", id, s.cfg.EnterpriseID)
+	for _, p := range params {
+		fmt.Fprintf(b, " %s=\"%s\"", p[0], syslogParamValue(p[1]))
+	}
+	b.WriteByte(']')
+}
+
+// syslogParams returns the fields of an event's data as structured data
+// parameters, named as they are in the data's JSON. Strings are sent as is,
+// other values as JSON.
+func syslogParams(data EventData) ([][2]string, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	params := make([][2]string, 0, len(fields))
+	for name, value := range fields {
+		var str string
+		if err := json.Unmarshal(value, &str); err != nil {
+			str = string(value)
+		}
+		params = append(params, [2]string{name, str})
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i][0] < params[j][0] })
+	return params, nil
+}
+
+// syslogHeaderField returns v as a header field, which is limited to
+// printable ASCII without spaces and max bytes, or "-" if it is empty.
+func syslogHeaderField(v string, max int) string {
+	v = strings.Map(func(r rune) rune {
+		if r < '!' || r > '~' {
+			return -1
+		}
+		return r
+	}, v)
+	if v == "" {
+		return "-"
+	}
+	if len(v) > max {
+		v = v[:max]
+	}
+	return v
+}
+
+// syslogParamValue escapes the characters RFC 5424 requires escaping in a
+// parameter value.
+var syslogParamValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace
+
+// run sends pending messages until the sink is closed and they have been sent.
+func (s *SyslogSink) run() {
+	defer close(s.done)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	backoff := s.cfg.ReconnectInterval
+
+	for {
+		s.mu.Lock()
+		for len(s.pending) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		msg, head := s.pending[0], s.head
+		dropped := s.dropped
+		s.dropped = 0
+		closed := s.closed
+		s.mu.Unlock()
+
+		if dropped > 0 {
+			zapctx.Warn(context.TODO(), "syslog collector fell behind, dropped audit messages", zap.Int("dropped", dropped))
+		}
+
+		err := s.send(&conn, msg)
+		if err == nil {
+			backoff = s.cfg.ReconnectInterval
+			s.mu.Lock()
+			// The message may have been dropped for a newer one meanwhile.
+			if s.head == head {
+				s.pending[0] = nil
+				s.pending = s.pending[1:]
+				s.head++
+			}
+			if !s.health.Healthy {
+				zapctx.Info(context.TODO(), "reconnected to syslog collector")
+			}
+			s.health.Healthy = true
+			s.health.Delivered++
+			s.health.LastDelivered = time.Now()
+			s.mu.Unlock()
+			continue
+		}
+
+		zapctx.Error(context.TODO(), "failed to send syslog message", zap.Error(err))
+		s.mu.Lock()
+		s.health.Healthy = false
+		s.health.LastError = err.Error()
+		s.health.LastErrorTime = time.Now()
+		s.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		if closed {
+			// No more attempts are made once the sink is closed.
+			return
+		}
+		select {
+		case <-s.stop:
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.cfg.MaxReconnectInterval)
+	}
+}
+
+// send sends msg, connecting to the collector first if needed.
+func (s *SyslogSink) send(conn *net.Conn, msg []byte) error {
+	if *conn == nil {
+		c, err := s.dial()
+		if err != nil {
+			return err
+		}
+		*conn = c
+	}
+	if err := (*conn).SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+	switch s.cfg.Network {
+	case "udp", "unixgram":
+		_, err := (*conn).Write(msg)
+		return err
+	default:
+		// Stream transports frame messages by octet counting (RFC 6587).
+		_, err := fmt.Fprintf(*conn, "%d %s", len(msg), msg)
+		return err
+	}
+}
+
+func (s *SyslogSink) dial() (net.Conn, error) {
+	if s.cfg.Network == "tls" {
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", s.cfg.Address, s.cfg.TLSConfig)
+	}
+	return net.DialTimeout(s.cfg.Network, s.cfg.Address, 10*time.Second)
+}
+
+// Health implements sinkHealthReporter, reporting the sink unhealthy while it
+// is reconnecting to the collector after a failed send.
+func (s *SyslogSink) Health() []SinkHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	health := s.health
+	health.Queued = len(s.pending)
+	return []SinkHealth{health}
+}
+
+// Close stops accepting events and waits for those pending to be sent, giving
+// up on them if the collector cannot be reached.
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		<-s.done
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSyslogConfig returns a configuration sending to address over network,
+// reconnecting quickly.
+func testSyslogConfig(network, address string) SyslogSinkConfig {
+	cfg := DefaultSyslogSinkConfig(network, address)
+	cfg.Hostname = "proxy.example.com"
+	cfg.ReconnectInterval = 10 * time.Millisecond
+	cfg.MaxReconnectInterval = 50 * time.Millisecond
+	return cfg
+}
+
+// readSyslogFrame reads an octet-counted message (RFC 6587) from r.
+func readSyslogFrame(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	length, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatalf("failed to read frame length: %v", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		t.Fatalf("bad frame length %q: %v", length, err)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	return string(msg)
+}
+
+func TestSyslogSinkFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   Event
+		encoder EventEncoder
+		want    []string
+	}{{
+		name: "structured data",
+		event: Event{
+			Version:  EventVersion,
+			Sequence: 3,
+			Type:     EventInput,
+			Time:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			Session:  SessionDetails{SessionID: "abc", User: "alice", ShellCommand: []string{"ls"}},
+			Data:     InputEvent{Data: `echo "a]b\c"`},
+		},
+		want: []string{
+			"<110>1 2024-05-01T12:00:00.000000Z proxy.example.com ssh-proxy ",
+			" input [event@32473 version=\"" + strconv.Itoa(EventVersion) + "\" seq=\"3\"]",
+			`[session@32473 session_id="abc" user="alice"`,
+			`shell_command="[\"ls\"\]"`,
+			`[data@32473 data="echo \"a\]b\\c\""]`,
+		},
+	}, {
+		name: "encoded",
+		event: Event{
+			Version: EventVersion,
+			Type:    EventConnect,
+			Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			Session: SessionDetails{SessionID: "abc"},
+			Data:    ConnectEvent{},
+		},
+		encoder: NewCEFEncoder(DefaultSIEMProduct),
+		want: []string{
+			" connect - CEF:0|",
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			cfg := testSyslogConfig("udp", conn.LocalAddr().String())
+			cfg.Encoder = test.encoder
+			sink, err := NewSyslogSink(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+
+			sink.HandleEvent(test.event)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 64*1024)
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := string(buf[:n])
+			for _, want := range test.want {
+				if !strings.Contains(msg, want) {
+					t.Errorf("message %q does not contain %q", msg, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSyslogSinkOctetCounting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sink, err := NewSyslogSink(testSyslogConfig("tcp", l.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	events := []Event{testEvent(1), testEvent(2), testEvent(3)}
+	// A message containing newlines and spaces must still be framed whole.
+	events[1].Data = InputEvent{Data: "line one\nline two"}
+	for _, e := range events {
+		sink.HandleEvent(e)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, e := range events {
+		msg := readSyslogFrame(t, r)
+		if !strings.HasPrefix(msg, "<110>1 ") {
+			t.Errorf("message %q has the wrong header", msg)
+		}
+		if want := `seq="` + strconv.FormatUint(e.Sequence, 10) + `"`; !strings.Contains(msg, want) {
+			t.Errorf("message %q does not contain %q", msg, want)
+		}
+	}
+}
+
+func TestSyslogSinkReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	sink, err := NewSyslogSink(testSyslogConfig("tcp", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.HandleEvent(testEvent(1))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readSyslogFrame(t, bufio.NewReader(conn))
+	waitFor(t, func() bool { return sink.Health()[0].Delivered == 1 })
+
+	// Take the collector down, events fail to send until it is back.
+	conn.Close()
+	l.Close()
+	seq := uint64(2)
+	waitFor(t, func() bool {
+		sink.HandleEvent(testEvent(seq))
+		seq++
+		time.Sleep(5 * time.Millisecond)
+		return !sink.Health()[0].Healthy
+	})
+	health := sink.Health()[0]
+	if health.LastError == "" || health.LastErrorTime.IsZero() {
+		t.Errorf("unhealthy sink has no last error: %+v", health)
+	}
+	if health.Queued == 0 {
+		t.Errorf("no events queued while the collector is down")
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	// Every event queued while down is sent once reconnected, ending with
+	// the last one.
+	last := `seq="` + strconv.FormatUint(seq-1, 10) + `"`
+	for !strings.Contains(readSyslogFrame(t, r), last) {
+	}
+	waitFor(t, func() bool {
+		health := sink.Health()[0]
+		return health.Healthy && health.Queued == 0
+	})
+}
+
+func TestSyslogSinkRequiredHealth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	// Nothing listens at the collector's address.
+	l.Close()
+	sink, err := NewSyslogSink(testSyslogConfig("tcp", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	tests := []struct {
+		name      string
+		required  bool
+		wantAdmit bool
+	}{
+		{name: "required", required: true, wantAdmit: false},
+		{name: "optional", required: false, wantAdmit: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			multi, err := NewMultiSink(MultiSinkTarget{Name: "siem", Sink: sink, Required: test.required})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer multi.Close()
+
+			multi.HandleEvent(testEvent(1))
+			waitFor(t, func() bool { return !multi.Health()[0].Healthy })
+			if health := multi.Health()[0]; health.LastError == "" {
+				t.Errorf("unhealthy target has no last error: %+v", health)
+			}
+			err = multi.AdmitSession()
+			if admitted := err == nil; admitted != test.wantAdmit {
+				t.Errorf("AdmitSession() = %v, want admitted %v", err, test.wantAdmit)
+			}
+		})
+	}
+}
+
+func TestNewSyslogSinkNetwork(t *testing.T) {
+	tests := []struct {
+		network string
+		wantErr bool
+	}{
+		{network: "udp"},
+		{network: "tcp"},
+		{network: "tls"},
+		{network: "unix"},
+		{network: "unixgram"},
+		{network: "http", wantErr: true},
+		{network: "", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.network, func(t *testing.T) {
+			sink, err := NewSyslogSink(testSyslogConfig(test.network, "127.0.0.1:1"))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewSyslogSink(%q) error = %v, want error %v", test.network, err, test.wantErr)
+			}
+			if sink != nil {
+				sink.Close()
+			}
+		})
+	}
+}
+
+func TestNewSyslogSinkConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*SyslogSinkConfig)
+		wantErr bool
+	}{{
+		name:   "default",
+		modify: func(*SyslogSinkConfig) {},
+	}, {
+		name:    "no buffer",
+		modify:  func(cfg *SyslogSinkConfig) { cfg.BufferSize = 0 },
+		wantErr: true,
+	}, {
+		name:    "no write timeout",
+		modify:  func(cfg *SyslogSinkConfig) { cfg.WriteTimeout = 0 },
+		wantErr: true,
+	}, {
+		name:    "no reconnect interval",
+		modify:  func(cfg *SyslogSinkConfig) { cfg.ReconnectInterval = 0 },
+		wantErr: true,
+	}, {
+		name:    "max reconnect interval below the first",
+		modify:  func(cfg *SyslogSinkConfig) { cfg.MaxReconnectInterval = time.Millisecond },
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testSyslogConfig("udp", "127.0.0.1:1")
+			test.modify(&cfg)
+			sink, err := NewSyslogSink(cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewSyslogSink() error = %v, want error %v", err, test.wantErr)
+			}
+			if sink != nil {
+				sink.Close()
+			}
+		})
+	}
+}
+
+func TestSyslogSinkWriteTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "syslog.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// The collector accepts the connection but never reads from it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-done
+	}()
+
+	cfg := testSyslogConfig("unix", path)
+	cfg.WriteTimeout = 100 * time.Millisecond
+	sink, err := NewSyslogSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.HandleEvent(Event{Type: EventInput, Data: InputEvent{Data: strings.Repeat("x", 8<<20)}})
+
+	waitFor(t, func() bool { return !sink.Health()[0].Healthy })
+	if health := sink.Health()[0]; !strings.Contains(health.LastError, "timeout") {
+		t.Errorf("last error %q, want a timeout", health.LastError)
+	}
+}
+
+func TestSyslogHeaderField(t *testing.T) {
+	tests := []struct {
+		v    string
+		max  int
+		want string
+	}{
+		{v: "", max: 10, want: "-"},
+		{v: "host name", max: 10, want: "hostname"},
+		{v: "héllo\n", max: 10, want: "hllo"},
+		{v: "abcdefghij", max: 4, want: "abcd"},
+	}
+	for _, test := range tests {
+		if got := syslogHeaderField(test.v, test.max); got != test.want {
+			t.Errorf("syslogHeaderField(%q, %d) = %q, want %q", test.v, test.max, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+const (
+	// webhookTimestampHeader holds the Unix time a request was signed at.
+	webhookTimestampHeader = "X-Audit-Timestamp"
+	// webhookSignatureHeader holds "sha256=" followed by the hex HMAC-SHA256
+	// of the timestamp, a ".", and the request body.
+	webhookSignatureHeader = "X-Audit-Signature"
+)
+
+// WebhookSinkConfig configures a WebhookSink.
+type WebhookSinkConfig struct {
+	// URL is where batches of events are POSTed to.
+	URL string
+
+	// Headers are added to every request, such as for authorization.
+	Headers http.Header
+
+	// Secret signs each request with HMAC-SHA256 when set, see
+	// webhookSignatureHeader.
+	Secret []byte
+
+	// BatchSize is the most events sent in one request, and FlushInterval
+	// how long events wait for a batch to fill before being sent anyway.
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// MaxRetries is how many times a failed request is retried, waiting
+	// RetryInterval before the first retry and twice as long before each
+	// following one, up to MaxRetryInterval.
+	MaxRetries       int
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	// BufferSize is the most events waiting to be sent, beyond which events
+	// go straight to the dead-letter file.
+	BufferSize int
+
+	// DeadLetterPath is a file that events which could not be sent are
+	// appended to, a line each as they would have been sent. When empty
+	// they are dropped.
+	DeadLetterPath string
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	// Timeout bounds each request, from connecting to reading the response,
+	// after which it is failed and retried. It must be positive.
+	Timeout time.Duration
+
+	// Encoder, when set, encodes each event in place of JSON, and batches
+	// are sent as the encoded events separated by newlines.
+	Encoder EventEncoder
+}
+
+// DefaultWebhookSinkConfig returns the webhook sink configuration used when
+// nothing else is configured, sending to url.
+func DefaultWebhookSinkConfig(url string) WebhookSinkConfig {
+	return WebhookSinkConfig{
+		URL:              url,
+		BatchSize:        100,
+		FlushInterval:    time.Second,
+		MaxRetries:       5,
+		RetryInterval:    500 * time.Millisecond,
+		MaxRetryInterval: 30 * time.Second,
+		BufferSize:       10000,
+		Timeout:          10 * time.Second,
+	}
+}
+
+// WebhookSink is an EventSink POSTing batches of events to a URL as a JSON
+// array, or as newline separated lines when it has an Encoder. Batches are
+// sent one at a time by a single goroutine, and are retried with exponential
+// backoff before being written to the dead-letter file.
+type WebhookSink struct {
+	cfg    WebhookSinkConfig
+	client *http.Client
+	done   chan struct{}
+	stop   chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending [][]byte
+	flush   bool
+	closed  bool
+
+	deadLetterMu sync.Mutex
+}
+
+// NewWebhookSink returns a WebhookSink sending to the configured URL.
+func NewWebhookSink(cfg WebhookSinkConfig) (*WebhookSink, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook url is empty")
+	}
+	if cfg.BatchSize < 1 {
+		return nil, fmt.Errorf("webhook batch size must be at least 1")
+	}
+	if cfg.Timeout <= 0 {
+		return nil, fmt.Errorf("webhook timeout must be positive")
+	}
+	s := &WebhookSink{
+		cfg:    cfg,
+		client: cfg.Client,
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	if cfg.FlushInterval > 0 {
+		go s.flushLoop()
+	}
+	return s, nil
+}
+
+// HandleEvent implements EventSink.
+func (s *WebhookSink) HandleEvent(e Event) {
+	event, err := encodeEvent(s.cfg.Encoder, e)
+	if err != nil {
+		zapctx.Error(context.TODO(), "failed to encode audit event", zap.Error(err))
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.deadLetter([][]byte{event}, fmt.Errorf("webhook sink closed"))
+		return
+	}
+	if len(s.pending) >= s.cfg.BufferSize {
+		s.mu.Unlock()
+		s.deadLetter([][]byte{event}, fmt.Errorf("webhook buffer full"))
+		return
+	}
+	s.pending = append(s.pending, event)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// DeliverEvents implements EventDeliverer, POSTing events as a single batch
+// and retrying it until it is accepted or MaxRetries is exhausted. Events
+// which are not delivered are left to the caller rather than dead-lettered.
+func (s *WebhookSink) DeliverEvents(events []Event) error {
+	batch := make([][]byte, len(events))
+	for i, e := range events {
+		event, err := encodeEvent(s.cfg.Encoder, e)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit event: %w", err)
+		}
+		batch[i] = event
+	}
+	return s.send(batch)
+}
+
+// flushLoop has the pending events sent every FlushInterval, whether or not
+// a batch has filled.
+func (s *WebhookSink) flushLoop() {
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.flush = len(s.pending) > 0
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// run sends batches until the sink is closed and the pending events are sent.
+func (s *WebhookSink) run() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		for len(s.pending) < s.cfg.BatchSize && !s.flush && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		n := min(len(s.pending), s.cfg.BatchSize)
+		batch := s.pending[:n:n]
+		s.pending = s.pending[n:]
+		if len(s.pending) == 0 {
+			s.flush = false
+		}
+		s.mu.Unlock()
+
+		if err := s.send(batch); err != nil {
+			s.deadLetter(batch, err)
+		}
+	}
+}
+
+// send POSTs batch, retrying on failure. Once the sink is closed, no further
+// retries are made.
+func (s *WebhookSink) send(batch [][]byte) error {
+	var body []byte
+	if s.cfg.Encoder == nil {
+		body = append([]byte("["), bytes.Join(batch, []byte(","))...)
+		body = append(body, ']')
+	} else {
+		body = bytes.Join(batch, []byte("\n"))
+	}
+	backoff := s.cfg.RetryInterval
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= s.cfg.MaxRetries {
+			return err
+		}
+		zapctx.Warn(context.TODO(), "failed to send audit events, retrying", zap.Error(err), zap.Stringer("backoff", backoff))
+		select {
+		case <-s.stop:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.cfg.MaxRetryInterval)
+	}
+}
+
+// post makes a single request, reporting whether it is worth retrying if it fails.
+func (s *WebhookSink) post(body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range s.cfg.Headers {
+		req.Header[name] = values
+	}
+	if s.cfg.Encoder == nil {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if len(s.cfg.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(s.cfg.Secret, timestamp, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook responded %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// signWebhook returns the hex HMAC-SHA256 of a request signed at timestamp.
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter appends events that could not be sent to the dead-letter file.
+func (s *WebhookSink) deadLetter(events [][]byte, reason error) {
+	zapctx.Error(context.TODO(), "failed to send audit events", zap.Int("events", len(events)), zap.Error(reason))
+	if s.cfg.DeadLetterPath == "" {
+		return
+	}
+
+	s.deadLetterMu.Lock()
+	defer s.deadLetterMu.Unlock()
+	f, err := os.OpenFile(s.cfg.DeadLetterPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		zapctx.Error(context.TODO(), "failed to open dead-letter file", zap.Error(err))
+		return
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	for _, event := range events {
+		buf.Write(event)
+		buf.WriteByte('\n')
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		zapctx.Error(context.TODO(), "failed to write dead-letter file", zap.Error(err))
+		return
+	}
+	if err := f.Sync(); err != nil {
+		zapctx.Error(context.TODO(), "failed to sync dead-letter file", zap.Error(err))
+	}
+}
+
+// Close stops accepting events and waits for those pending to be sent. Once
+// closed, failed batches are not retried.
+func (s *WebhookSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		<-s.done
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request received by a webhookCollector.
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	time   time.Time
+}
+
+// webhookCollector is a webhook endpoint responding to each request with the
+// next of its statuses, and 200 once they run out.
+type webhookCollector struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []webhookRequest
+}
+
+func newWebhookCollector(t *testing.T, statuses ...int) *webhookCollector {
+	c := &webhookCollector{statuses: statuses}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		c.mu.Lock()
+		c.requests = append(c.requests, webhookRequest{header: r.Header.Clone(), body: body, time: time.Now()})
+		status := http.StatusOK
+		if len(c.statuses) > 0 {
+			status, c.statuses = c.statuses[0], c.statuses[1:]
+		}
+		c.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *webhookCollector) received() []webhookRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]webhookRequest(nil), c.requests...)
+}
+
+// testWebhookConfig returns a configuration sending to url, retrying quickly
+// and flushing only when a batch fills or the sink is closed.
+func testWebhookConfig(url string) WebhookSinkConfig {
+	cfg := DefaultWebhookSinkConfig(url)
+	cfg.FlushInterval = 0
+	cfg.RetryInterval = 10 * time.Millisecond
+	cfg.MaxRetryInterval = 100 * time.Millisecond
+	return cfg
+}
+
+// decodeBatch decodes a JSON batch, returning the sequence of each event.
+func decodeBatch(t *testing.T, body []byte) []uint64 {
+	t.Helper()
+	var events []Event
+	if err := json.Unmarshal(body, &events); err != nil {
+		t.Fatalf("bad batch %q: %v", body, err)
+	}
+	seqs := make([]uint64, len(events))
+	for i, e := range events {
+		seqs[i] = e.Sequence
+	}
+	return seqs
+}
+
+func TestWebhookSinkBatching(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchSize int
+		events    int
+		want      []int
+	}{
+		{name: "full batches", batchSize: 3, events: 6, want: []int{3, 3}},
+		{name: "remainder sent on close", batchSize: 3, events: 7, want: []int{3, 3, 1}},
+		{name: "one per request", batchSize: 1, events: 2, want: []int{1, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newWebhookCollector(t)
+			cfg := testWebhookConfig(c.URL)
+			cfg.BatchSize = test.batchSize
+			sink, err := NewWebhookSink(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= test.events; i++ {
+				sink.HandleEvent(testEvent(uint64(i)))
+			}
+			sink.Close()
+
+			requests := c.received()
+			if len(requests) != len(test.want) {
+				t.Fatalf("got %d requests, want %d", len(requests), len(test.want))
+			}
+			next := uint64(1)
+			for i, req := range requests {
+				if got := req.header.Get("Content-Type"); got != "application/json" {
+					t.Errorf("request %d Content-Type = %q", i, got)
+				}
+				seqs := decodeBatch(t, req.body)
+				if len(seqs) != test.want[i] {
+					t.Errorf("request %d has %d events, want %d", i, len(seqs), test.want[i])
+				}
+				for _, seq := range seqs {
+					if seq != next {
+						t.Errorf("request %d has event %d, want %d", i, seq, next)
+					}
+					next++
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookSinkFlushInterval(t *testing.T) {
+	c := newWebhookCollector(t)
+	cfg := testWebhookConfig(c.URL)
+	cfg.FlushInterval = 10 * time.Millisecond
+	sink, err := NewWebhookSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.HandleEvent(testEvent(1))
+	sink.HandleEvent(testEvent(2))
+	// The batch is far from full, but is sent once the interval passes.
+	waitFor(t, func() bool { return len(c.received()) == 1 })
+	if seqs := decodeBatch(t, c.received()[0].body); len(seqs) != 2 {
+		t.Errorf("flushed %v, want 2 events", seqs)
+	}
+}
+
+func TestWebhookSinkSignature(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		headers http.Header
+	}{
+		{name: "signed", secret: "s3cret"},
+		{name: "unsigned"},
+		{name: "extra headers", secret: "s3cret", headers: http.Header{"Authorization": {"Bearer token"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newWebhookCollector(t)
+			cfg := testWebhookConfig(c.URL)
+			cfg.Secret = []byte(test.secret)
+			cfg.Headers = test.headers
+			sink, err := NewWebhookSink(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.HandleEvent(testEvent(1))
+			sink.Close()
+
+			requests := c.received()
+			if len(requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(requests))
+			}
+			req := requests[0]
+			for name := range test.headers {
+				if got, want := req.header.Get(name), test.headers.Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+			timestamp, signature := req.header.Get(webhookTimestampHeader), req.header.Get(webhookSignatureHeader)
+			if test.secret == "" {
+				if timestamp != "" || signature != "" {
+					t.Errorf("unsigned request has timestamp %q and signature %q", timestamp, signature)
+				}
+				return
+			}
+			mac := hmac.New(sha256.New, []byte(test.secret))
+			mac.Write([]byte(timestamp + "."))
+			mac.Write(req.body)
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+				t.Errorf("signature = %q, want %q", signature, want)
+			}
+		})
+	}
+}
+
+func TestWebhookSinkRetry(t *testing.T) {
+	tests := []struct {
+		name           string
+		statuses       []int
+		wantRequests   int
+		wantDeadLetter bool
+	}{
+		{name: "accepted", statuses: nil, wantRequests: 1},
+		{name: "retried on 5xx", statuses: []int{500, 503}, wantRequests: 3},
+		{name: "retried on 429", statuses: []int{429}, wantRequests: 2},
+		{name: "not retried on 4xx", statuses: []int{400}, wantRequests: 1, wantDeadLetter: true},
+		{name: "retries exhausted", statuses: []int{500, 500, 500, 500}, wantRequests: 3, wantDeadLetter: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newWebhookCollector(t, test.statuses...)
+			cfg := testWebhookConfig(c.URL)
+			cfg.MaxRetries = 2
+			cfg.BatchSize = 1
+			cfg.DeadLetterPath = filepath.Join(t.TempDir(), "dead-letter.jsonl")
+			sink, err := NewWebhookSink(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.HandleEvent(testEvent(1))
+			waitFor(t, func() bool { return len(c.received()) >= test.wantRequests })
+			sink.Close()
+
+			requests := c.received()
+			if len(requests) != test.wantRequests {
+				t.Fatalf("got %d requests, want %d", len(requests), test.wantRequests)
+			}
+			// Each retry waits twice as long as the one before.
+			backoff := cfg.RetryInterval
+			for i := 1; i < len(requests); i++ {
+				if gap := requests[i].time.Sub(requests[i-1].time); gap < backoff {
+					t.Errorf("retry %d after %v, want at least %v", i, gap, backoff)
+				}
+				backoff *= 2
+			}
+
+			_, err = os.Stat(cfg.DeadLetterPath)
+			if deadLettered := err == nil; deadLettered != test.wantDeadLetter {
+				t.Fatalf("dead-lettered %v, want %v", deadLettered, test.wantDeadLetter)
+			}
+			if test.wantDeadLetter {
+				if dead := readEventLines(t, cfg.DeadLetterPath); len(dead) != 1 || dead[0].Sequence != 1 {
+					t.Errorf("dead-lettered %+v, want event 1", dead)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookSinkTimeout(t *testing.T) {
+	// The endpoint never responds, until the test ends.
+	done := make(chan struct{})
+	var requests int
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	cfg := testWebhookConfig(server.URL)
+	cfg.Timeout = 50 * time.Millisecond
+	cfg.MaxRetries = 1
+	cfg.BatchSize = 1
+	cfg.DeadLetterPath = filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	sink, err := NewWebhookSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.HandleEvent(testEvent(1))
+	waitFor(t, func() bool {
+		_, err := os.Stat(cfg.DeadLetterPath)
+		return err == nil
+	})
+	sink.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 {
+		t.Errorf("got %d requests, want the first and a retry", requests)
+	}
+	if dead := readEventLines(t, cfg.DeadLetterPath); len(dead) != 1 || dead[0].Sequence != 1 {
+		t.Errorf("dead-lettered %+v, want event 1", dead)
+	}
+}
+
+func TestNewWebhookSinkTimeout(t *testing.T) {
+	cfg := testWebhookConfig("http://127.0.0.1:1")
+	cfg.Timeout = 0
+	if _, err := NewWebhookSink(cfg); err == nil {
+		t.Error("NewWebhookSink() with no timeout succeeded, want an error")
+	}
+}
+
+func TestWebhookSinkBufferFull(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var received []uint64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []Event
+		json.NewDecoder(r.Body).Decode(&events)
+		mu.Lock()
+		for _, e := range events {
+			received = append(received, e.Sequence)
+		}
+		mu.Unlock()
+		<-release
+	}))
+	defer srv.Close()
+
+	cfg := testWebhookConfig(srv.URL)
+	cfg.BatchSize = 1
+	cfg.BufferSize = 1
+	cfg.DeadLetterPath = filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	sink, err := NewWebhookSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first event is being sent, the second waits in the buffer and the
+	// third finds it full.
+	sink.HandleEvent(testEvent(1))
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 1
+	})
+	sink.HandleEvent(testEvent(2))
+	sink.HandleEvent(testEvent(3))
+	close(release)
+	sink.Close()
+
+	if got := readEventLines(t, cfg.DeadLetterPath); len(got) != 1 || got[0].Sequence != 3 {
+		t.Errorf("dead-lettered %+v, want event 3", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[1] != 2 {
+		t.Errorf("received %v, want [1 2]", received)
+	}
+}
+
+func TestWebhookSinkEncoder(t *testing.T) {
+	c := newWebhookCollector(t)
+	cfg := testWebhookConfig(c.URL)
+	cfg.BatchSize = 2
+	cfg.Encoder = NewCEFEncoder(DefaultSIEMProduct)
+	sink, err := NewWebhookSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.HandleEvent(testEvent(1))
+	sink.HandleEvent(testEvent(2))
+	sink.Close()
+
+	requests := c.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	if got := requests[0].header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+	lines := strings.Split(string(requests[0].body), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("body has %d lines, want 2: %q", len(lines), requests[0].body)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "CEF:0|") {
+			t.Errorf("line %q is not CEF", line)
+		}
+	}
+}
+
+func TestWebhookSinkDeliverEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+	}{
+		{name: "accepted", statuses: []int{500}},
+		{name: "rejected", statuses: []int{400}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newWebhookCollector(t, test.statuses...)
+			cfg := testWebhookConfig(c.URL)
+			cfg.DeadLetterPath = filepath.Join(t.TempDir(), "dead-letter.jsonl")
+			sink, err := NewWebhookSink(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+
+			err = sink.DeliverEvents([]Event{testEvent(1), testEvent(2)})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("DeliverEvents() = %v, want error %v", err, test.wantErr)
+			}
+			// Undelivered events are the caller's to keep, not dead-lettered.
+			if _, err := os.Stat(cfg.DeadLetterPath); err == nil {
+				t.Errorf("DeliverEvents dead-lettered events")
+			}
+			requests := c.received()
+			if seqs := decodeBatch(t, requests[len(requests)-1].body); len(seqs) != 2 {
+				t.Errorf("delivered %v, want 2 events in one batch", seqs)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The WebSocket opcodes, see RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsMaxMessageSize is the largest message read from a WebSocket client.
+const wsMaxMessageSize = 1 << 20
+
+// wsGUID is appended to the client's key to derive Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsConn is the server side of a WebSocket connection, implementing as much
+// of RFC 6455 as the admin API needs: messages are read whole and written as
+// single frames, and extensions are not supported.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// writeMu serializes frames, as pongs are written alongside messages.
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// upgradeWebSocket completes a WebSocket handshake, taking over the request's
+// connection. If it fails, a response has been written.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing websocket key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return nil, errors.New("hijacking not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// headerContains reports whether the comma separated values of a header
+// include token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeMessage writes a text or binary message as a single frame.
+func (c *wsConn) writeMessage(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.writeFrame(opcode, payload)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	// Server frames are never masked.
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	_, err := (&net.Buffers{header, payload}).WriteTo(c.conn)
+	return err
+}
+
+// readMessage reads the next text or binary message, answering pings along
+// the way. It returns io.EOF once the client closes the connection.
+func (c *wsConn) readMessage() (opcode byte, payload []byte, err error) {
+	for {
+		fin, op, data, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			c.writeMu.Lock()
+			if !c.closed {
+				err = c.writeFrame(wsPong, data)
+			}
+			c.writeMu.Unlock()
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// The client's status code, if any, is echoed back.
+			c.closeWith(data[:min(len(data), 2)])
+			return 0, nil, io.EOF
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, errors.New("websocket continuation without a message")
+			}
+		default:
+			if opcode != 0 {
+				return 0, nil, errors.New("websocket message interrupted by another")
+			}
+			opcode = op
+		}
+		if len(payload)+len(data) > wsMaxMessageSize {
+			return 0, nil, fmt.Errorf("websocket message larger than %d bytes", wsMaxMessageSize)
+		}
+		payload = append(payload, data...)
+		if fin {
+			return opcode, payload, nil
+		}
+	}
+}
+
+// readFrame reads a single frame, unmasking its payload.
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("websocket client frame not masked")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if length > wsMaxMessageSize {
+		return false, 0, nil, fmt.Errorf("websocket frame larger than %d bytes", wsMaxMessageSize)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// close closes the connection with a normal closure status and reason.
+func (c *wsConn) close(reason string) {
+	// A close frame's payload is limited to 125 bytes, 2 of them the status.
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	c.closeWith(append(binary.BigEndian.AppendUint16(nil, 1000), reason...))
+}
+
+// closeWith sends a close frame with payload and closes the connection.
+func (c *wsConn) closeWith(payload []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.writeFrame(wsClose, payload)
+	c.conn.Close()
+}
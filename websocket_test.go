@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsTestKey is the Sec-WebSocket-Key of RFC 6455 section 1.3, and
+// wsTestAccept its Sec-WebSocket-Accept.
+const (
+	wsTestKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	wsTestAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// clientFrame returns a frame as a client sends it, masked.
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	return appendFrame(fin, opcode, payload, true)
+}
+
+func appendFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// wsFrame is a frame read from the server.
+type wsFrame struct {
+	opcode  byte
+	payload string
+}
+
+// readServerFrame reads a frame the server sent, which must be unmasked and
+// final.
+func readServerFrame(r io.Reader) (wsFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return wsFrame{}, err
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		return wsFrame{}, errors.New("server frame fragmented or masked")
+	}
+	length := uint64(header[1])
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return wsFrame{}, err
+	}
+	return wsFrame{opcode: header[0] & 0x0f, payload: string(payload)}, nil
+}
+
+// closePayload returns the payload of a close frame with status and reason.
+func closePayload(status uint16, reason string) string {
+	return string(binary.BigEndian.AppendUint16(nil, status)) + reason
+}
+
+// pipeWebSocket returns the server side of a WebSocket connection and the
+// client's end of it.
+func pipeWebSocket(t *testing.T) (*wsConn, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return &wsConn{conn: server, r: bufio.NewReader(server)}, client
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+	}{{
+		name: "valid",
+		header: http.Header{
+			"Connection":            {"keep-alive, Upgrade"},
+			"Upgrade":               {"websocket"},
+			"Sec-Websocket-Version": {"13"},
+			"Sec-Websocket-Key":     {wsTestKey},
+		},
+		wantStatus: http.StatusSwitchingProtocols,
+	}, {
+		name:       "not an upgrade",
+		header:     http.Header{"Sec-Websocket-Version": {"13"}, "Sec-Websocket-Key": {wsTestKey}},
+		wantStatus: http.StatusUpgradeRequired,
+	}, {
+		name: "unsupported version",
+		header: http.Header{
+			"Connection":            {"Upgrade"},
+			"Upgrade":               {"WebSocket"},
+			"Sec-Websocket-Version": {"8"},
+			"Sec-Websocket-Key":     {wsTestKey},
+		},
+		wantStatus: http.StatusUpgradeRequired,
+	}, {
+		name: "missing key",
+		header: http.Header{
+			"Connection":            {"Upgrade"},
+			"Upgrade":               {"websocket"},
+			"Sec-Websocket-Version": {"13"},
+		},
+		wantStatus: http.StatusBadRequest,
+	}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err == nil {
+			conn.close("bye")
+		}
+	}))
+	defer srv.Close()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = test.header
+			if err := req.Write(conn); err != nil {
+				t.Fatal(err)
+			}
+			r := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(r, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("status %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+			if test.wantStatus != http.StatusSwitchingProtocols {
+				return
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Accept"); got != wsTestAccept {
+				t.Errorf("Sec-WebSocket-Accept = %q, want %q", got, wsTestAccept)
+			}
+			frame, err := readServerFrame(r)
+			if err != nil || frame != (wsFrame{wsClose, closePayload(1000, "bye")}) {
+				t.Errorf("read %+v, %v, want a close frame", frame, err)
+			}
+		})
+	}
+}
+
+func TestWSConnReadMessage(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 300)
+	half := bytes.Repeat([]byte("x"), wsMaxMessageSize/2+1)
+	tests := []struct {
+		name        string
+		frames      [][]byte
+		wantOpcode  byte
+		wantPayload string
+		wantErr     string
+		// wantReplies are the frames the server sends while reading.
+		wantReplies []wsFrame
+	}{{
+		name:        "text",
+		frames:      [][]byte{clientFrame(true, wsText, []byte("hi"))},
+		wantOpcode:  wsText,
+		wantPayload: "hi",
+	}, {
+		name:        "binary with a 16 bit length",
+		frames:      [][]byte{clientFrame(true, wsBinary, large)},
+		wantOpcode:  wsBinary,
+		wantPayload: string(large),
+	}, {
+		name: "fragmented",
+		frames: [][]byte{
+			clientFrame(false, wsText, []byte("he")),
+			clientFrame(false, wsContinuation, []byte("l")),
+			clientFrame(true, wsContinuation, []byte("lo")),
+		},
+		wantOpcode:  wsText,
+		wantPayload: "hello",
+	}, {
+		name: "ping within a fragmented message",
+		frames: [][]byte{
+			clientFrame(false, wsText, []byte("he")),
+			clientFrame(true, wsPing, []byte("are you there")),
+			clientFrame(true, wsContinuation, []byte("llo")),
+		},
+		wantOpcode:  wsText,
+		wantPayload: "hello",
+		wantReplies: []wsFrame{{wsPong, "are you there"}},
+	}, {
+		name: "pong ignored",
+		frames: [][]byte{
+			clientFrame(true, wsPong, nil),
+			clientFrame(true, wsBinary, []byte{0, 1}),
+		},
+		wantOpcode:  wsBinary,
+		wantPayload: "\x00\x01",
+	}, {
+		name:        "close echoes the status",
+		frames:      [][]byte{clientFrame(true, wsClose, []byte(closePayload(1001, "going away")))},
+		wantErr:     io.EOF.Error(),
+		wantReplies: []wsFrame{{wsClose, closePayload(1001, "")}},
+	}, {
+		name:        "close without a status",
+		frames:      [][]byte{clientFrame(true, wsClose, nil)},
+		wantErr:     io.EOF.Error(),
+		wantReplies: []wsFrame{{wsClose, ""}},
+	}, {
+		name:    "unmasked",
+		frames:  [][]byte{appendFrame(true, wsText, []byte("hi"), false)},
+		wantErr: "not masked",
+	}, {
+		name:    "continuation without a message",
+		frames:  [][]byte{clientFrame(true, wsContinuation, []byte("hi"))},
+		wantErr: "continuation without a message",
+	}, {
+		name: "message interrupted by another",
+		frames: [][]byte{
+			clientFrame(false, wsText, []byte("he")),
+			clientFrame(true, wsText, []byte("llo")),
+		},
+		wantErr: "interrupted by another",
+	}, {
+		name:    "frame too large",
+		frames:  [][]byte{{0x80 | wsBinary, 0x80 | 127, 0, 0, 0, 0, 0x7f, 0, 0, 0}},
+		wantErr: "websocket frame larger than",
+	}, {
+		name: "message too large",
+		frames: [][]byte{
+			clientFrame(false, wsBinary, half),
+			clientFrame(true, wsContinuation, half),
+		},
+		wantErr: "websocket message larger than",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, client := pipeWebSocket(t)
+			go func() {
+				for _, frame := range test.frames {
+					if _, err := client.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+			replies := make(chan []wsFrame)
+			go func() {
+				var frames []wsFrame
+				for {
+					frame, err := readServerFrame(client)
+					if err != nil {
+						replies <- frames
+						return
+					}
+					frames = append(frames, frame)
+				}
+			}()
+
+			opcode, payload, err := c.readMessage()
+			c.conn.Close()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("readMessage() error = %v, want %q", err, test.wantErr)
+				}
+			} else if err != nil || opcode != test.wantOpcode || string(payload) != test.wantPayload {
+				t.Errorf("readMessage() = %d %q %v, want %d %q", opcode, payload, err, test.wantOpcode, test.wantPayload)
+			}
+			got := <-replies
+			if len(got) != len(test.wantReplies) {
+				t.Fatalf("server replied %+v, want %+v", got, test.wantReplies)
+			}
+			for i := range got {
+				if got[i] != test.wantReplies[i] {
+					t.Errorf("server replied %+v, want %+v", got, test.wantReplies)
+				}
+			}
+		})
+	}
+}
+
+func TestWSConnWriteMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		length     int
+		wantHeader []byte
+	}{
+		{name: "empty", length: 0, wantHeader: []byte{0x82, 0}},
+		{name: "7 bit length", length: 125, wantHeader: []byte{0x82, 125}},
+		{name: "16 bit length", length: 126, wantHeader: []byte{0x82, 126, 0, 126}},
+		{name: "largest 16 bit length", length: 0xffff, wantHeader: []byte{0x82, 126, 0xff, 0xff}},
+		{name: "64 bit length", length: 0x10000, wantHeader: []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, client := pipeWebSocket(t)
+			payload := bytes.Repeat([]byte("x"), test.length)
+			written := make(chan error, 1)
+			go func() { written <- c.writeMessage(wsBinary, payload) }()
+
+			got := make([]byte, len(test.wantHeader)+test.length)
+			if _, err := io.ReadFull(client, got); err != nil {
+				t.Fatal(err)
+			}
+			// A pipe's writes wait to be read, even empty ones.
+			go io.Copy(io.Discard, client)
+			if err := <-written; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[:len(test.wantHeader)], test.wantHeader) {
+				t.Errorf("header % x, want % x", got[:len(test.wantHeader)], test.wantHeader)
+			}
+			if !bytes.Equal(got[len(test.wantHeader):], payload) {
+				t.Error("payload not written unmasked")
+			}
+		})
+	}
+}
+
+func TestWSConnClose(t *testing.T) {
+	c, client := pipeWebSocket(t)
+	frames := make(chan wsFrame)
+	go func() {
+		for {
+			frame, err := readServerFrame(client)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	// A close frame's reason is cut short to fit its 125 byte payload.
+	c.close(strings.Repeat("r", 200))
+	if frame := <-frames; frame != (wsFrame{wsClose, closePayload(1000, strings.Repeat("r", 123))}) {
+		t.Errorf("close frame %q, want its reason truncated", frame.payload)
+	}
+	if _, ok := <-frames; ok {
+		t.Error("frame sent after closing")
+	}
+	if err := c.writeMessage(wsText, []byte("late")); err != net.ErrClosed {
+		t.Errorf("writeMessage() after close = %v, want %v", err, net.ErrClosed)
+	}
+	// Closing again does nothing.
+	c.close("again")
+}